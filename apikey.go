@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// APIKeyPrefix starts every API key, so that leaked keys are easy to
+	// search for.
+	APIKeyPrefix = "gmsa_"
+	// APIKeyHeader is the header API keys are sent in.
+	APIKeyHeader = "X-API-Key"
+	// the number of random bytes in an API key's public ID
+	apiKeyIDLength = 8
+	// the number of random bytes in an API key's secret
+	apiKeySecretLength = 32
+	// how stale a key's stored LastUsed may get before it's written to the
+	// user file. It's always current in memory.
+	apiKeyUsageResolution = time.Hour
+)
+
+// APIKey is a long-lived credential for a service account or script, issued
+// to a user. Only a hash of the secret part of the key is stored; the key
+// itself is shown once, when it's created.
+type APIKey struct {
+	// ID is the public part of the key, used to list and revoke it.
+	ID string
+	// Name describes what the key is for.
+	Name string
+	// Scopes limit what the key may be used for. See HasScope.
+	Scopes  []string
+	Created time.Time
+	// Expires is when the key stops working, or zero if it doesn't.
+	Expires time.Time
+	// LastUsed is when the key last authenticated a request, to the nearest
+	// hour once it's been saved.
+	LastUsed      time.Time
+	HashValue     [KeyLength]byte
+	Salt          salt
+	PepperVersion uint8
+}
+
+// HasScope reports whether the key was issued with the given scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the key has expired.
+func (k *APIKey) Expired() bool {
+	return !k.Expires.IsZero() && k.Expires.Before(time.Now())
+}
+
+// withoutSecret gets a copy of the key without the hash of its secret.
+func (k APIKey) withoutSecret() APIKey {
+	k.HashValue = [KeyLength]byte{}
+	k.Salt = salt{}
+	k.Scopes = append([]string(nil), k.Scopes...)
+	return k
+}
+
+// updateUser replaces the given user's token with a copy modified by the
+// given function.
+func updateUser(name Username, modify func(*Token) error) error {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	current := AllUsers[name]
+	if current == nil {
+		return NoSuchUser(&name)
+	}
+	updated := *current
+	updated.APIKeys = append([]APIKey(nil), current.APIKeys...)
+	if err := modify(&updated); err != nil {
+		return err
+	}
+	AllUsers[name] = &updated
+	return nil
+}
+
+// CreateAPIKey issues a new API key for the user and saves it. The returned
+// key is the only copy of the secret; it can't be recovered later. A zero
+// expires means the key doesn't expire.
+func (u *Username) CreateAPIKey(
+	name string, scopes []string, expires time.Time,
+) (key string, info APIKey, err error) {
+	random := make([]byte, apiKeyIDLength+apiKeySecretLength)
+	if _, err = rand.Read(random); err != nil {
+		return
+	}
+	info = APIKey{
+		ID:            hex.EncodeToString(random[:apiKeyIDLength]),
+		Name:          name,
+		Scopes:        append([]string(nil), scopes...),
+		Created:       time.Now(),
+		Expires:       expires,
+		PepperVersion: currentPepperVersion(),
+	}
+	secret := base64.RawURLEncoding.EncodeToString(random[apiKeyIDLength:])
+	if err = info.Salt.Randomize(); err != nil {
+		return
+	}
+	info.HashValue, err = hashSecret([]byte(secret), info.Salt, info.PepperVersion)
+	if err != nil {
+		return
+	}
+	err = updateUser(*u, func(token *Token) error {
+		token.APIKeys = append(token.APIKeys, info)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if err = SyncAllUsers(); err != nil {
+		return
+	}
+	return APIKeyPrefix + info.ID + "_" + secret, info.withoutSecret(), nil
+}
+
+// APIKeys lists the user's API keys, without their hashes.
+func (u *Username) APIKeys() []APIKey {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	token := AllUsers[*u]
+	if token == nil {
+		return nil
+	}
+	keys := make([]APIKey, 0, len(token.APIKeys))
+	for _, key := range token.APIKeys {
+		keys = append(keys, key.withoutSecret())
+	}
+	return keys
+}
+
+// RevokeAPIKey deletes the user's API key with the given ID and saves the
+// change.
+func (u *Username) RevokeAPIKey(id string) error {
+	err := updateUser(*u, func(token *Token) error {
+		for index, key := range token.APIKeys {
+			if key.ID == id {
+				token.APIKeys = append(token.APIKeys[:index], token.APIKeys[index+1:]...)
+				return nil
+			}
+		}
+		return fmt.Errorf("%v has no API key with the ID %s", *u, id)
+	})
+	if err != nil {
+		return err
+	}
+	return SyncAllUsers()
+}
+
+// parseAPIKey splits a key into its ID and secret.
+func parseAPIKey(key string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return "", "", false
+	}
+	key = key[len(APIKeyPrefix):]
+	idLength := hex.EncodedLen(apiKeyIDLength)
+	if len(key) < idLength+2 || key[idLength] != '_' {
+		return "", "", false
+	}
+	return key[:idLength], key[idLength+1:], true
+}
+
+// findAPIKey gets the user an API key was issued to and a copy of the key.
+func findAPIKey(id string) (Username, *APIKey) {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	for name, token := range AllUsers {
+		for _, key := range token.APIKeys {
+			if key.ID == id {
+				found := key
+				return name, &found
+			}
+		}
+	}
+	return "", nil
+}
+
+// CheckAPIKey finds who an API key was issued to. If it isn't a valid,
+// unexpired key, the error satisfies IsCredentialsRejected with the status
+// 401 Unauthorized. The returned key doesn't include its hash.
+func CheckAPIKey(key string) (Username, APIKey, error) {
+	rejected := CredentialsRejected(http.StatusUnauthorized, "invalid API key")
+	id, secret, ok := parseAPIKey(key)
+	if !ok {
+		return "", APIKey{}, rejected
+	}
+	user, found := findAPIKey(id)
+	if found == nil {
+		return "", APIKey{}, rejected
+	}
+	hash, err := hashSecret([]byte(secret), found.Salt, found.PepperVersion)
+	if err != nil {
+		log.Printf("error checking API key %s: %v", id, err)
+		return "", APIKey{}, rejected
+	}
+	if subtle.ConstantTimeCompare(hash[:], found.HashValue[:]) != 1 {
+		return "", APIKey{}, rejected
+	}
+	if found.Expired() {
+		return "", APIKey{}, CredentialsRejected(
+			http.StatusUnauthorized,
+			"API key expired",
+		)
+	}
+	found.LastUsed = recordAPIKeyUse(user, id, found.LastUsed)
+	return user, found.withoutSecret(), nil
+}
+
+// recordAPIKeyUse sets the key's LastUsed to now, and saves it if the stored
+// time is out of date.
+func recordAPIKeyUse(user Username, id string, previous time.Time) time.Time {
+	now := time.Now()
+	updateUser(user, func(token *Token) error {
+		for index := range token.APIKeys {
+			if token.APIKeys[index].ID == id {
+				token.APIKeys[index].LastUsed = now
+			}
+		}
+		return nil
+	})
+	if now.Sub(previous) > apiKeyUsageResolution {
+		if err := SyncAllUsers(); err != nil {
+			log.Printf("error saving the last use of API key %s: %v", id, err)
+		}
+	}
+	return now
+}
+
+type apiKeyContextKey struct{}
+
+// AuthenticatedAPIKey is stored in the context of requests authenticated by
+// an API key.
+type AuthenticatedAPIKey struct {
+	User Username
+	Key  APIKey
+}
+
+// AuthenticateAPIKey checks the request's X-API-Key header, if it has one. If
+// the key is valid, the returned request carries it in its context; see
+// APIKeyFrom. If there's no header, the request is returned as it was and ok
+// is false.
+func AuthenticateAPIKey(r *http.Request) (authenticated *http.Request, ok bool, err error) {
+	header := r.Header.Get(APIKeyHeader)
+	if header == "" {
+		return r, false, nil
+	}
+	user, key, err := CheckAPIKey(header)
+	if err != nil {
+		return r, false, err
+	}
+	ctx := context.WithValue(
+		r.Context(),
+		apiKeyContextKey{},
+		&AuthenticatedAPIKey{User: user, Key: key},
+	)
+	return r.WithContext(ctx), true, nil
+}
+
+// APIKeyFrom gets the API key which authenticated the request, or nil if it
+// wasn't authenticated by one.
+func APIKeyFrom(r *http.Request) *AuthenticatedAPIKey {
+	authenticated, _ := r.Context().Value(apiKeyContextKey{}).(*AuthenticatedAPIKey)
+	return authenticated
+}
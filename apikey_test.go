@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestAPIKeys(t *testing.T) {
+	const password = "test API key user's password"
+	var (
+		test = attest.New(t)
+		user = Username("test API key user")
+	)
+	AllUsers = make(UserCollection)
+	test.Handle(CreateNewUser(string(user), password))
+	key, info, err := user.CreateAPIKey("deploys", []string{"deploy"}, time.Time{})
+	test.Handle(err)
+	test.Attest(strings.HasPrefix(key, APIKeyPrefix), "key %s lacks the prefix", key)
+	test.Attest(!strings.Contains(key, " "), "key %s contains a space", key)
+	t.Run("stored hashed", func(t *testing.T) {
+		test := attest.New(t)
+		stored := lookupUser(user).APIKeys[0]
+		test.Equals(info.ID, stored.ID)
+		test.Attest(
+			!strings.Contains(key, string(stored.HashValue[:])),
+			"the key was stored in plain text",
+		)
+		listed := user.APIKeys()
+		test.Equals(1, len(listed))
+		test.Equals([KeyLength]byte{}, listed[0].HashValue)
+	})
+	t.Run("check", func(t *testing.T) {
+		test := attest.New(t)
+		owner, checked, err := CheckAPIKey(key)
+		test.Handle(err)
+		test.Equals(user, owner)
+		test.Attest(checked.HasScope("deploy"), "scope was lost")
+		test.Attest(!checked.HasScope("admin"), "key has a scope it wasn't issued")
+		test.Attest(!user.APIKeys()[0].LastUsed.IsZero(), "last use wasn't recorded")
+		_, _, err = CheckAPIKey(key + "x")
+		test.Equals(http.StatusUnauthorized, StatusOf(err))
+		_, _, err = CheckAPIKey("not a key")
+		test.Attest(IsCredentialsRejected(err), "a malformed key wasn't rejected")
+	})
+	t.Run("request", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		_, ok, err := AuthenticateAPIKey(req)
+		test.Handle(err)
+		test.Attest(!ok, "a request without a key was authenticated")
+		req.Header.Set(APIKeyHeader, key)
+		authenticated, ok, err := AuthenticateAPIKey(req)
+		test.Handle(err)
+		test.Attest(ok, "the request wasn't authenticated")
+		test.Equals(user, APIKeyFrom(authenticated).User)
+	})
+	t.Run("survives a password change", func(t *testing.T) {
+		test := attest.New(t)
+		test.Handle(user.ChangePassword(password, password+" 2"))
+		_, _, err := CheckAPIKey(key)
+		test.Handle(err)
+	})
+	t.Run("expiry", func(t *testing.T) {
+		test := attest.New(t)
+		expired, _, err := user.CreateAPIKey("old", nil, time.Now().Add(-time.Minute))
+		test.Handle(err)
+		_, _, err = CheckAPIKey(expired)
+		test.Attest(IsCredentialsRejected(err), "an expired key was accepted")
+	})
+	t.Run("revoke", func(t *testing.T) {
+		test := attest.New(t)
+		test.Handle(user.RevokeAPIKey(info.ID))
+		_, _, err := CheckAPIKey(key)
+		test.Attest(IsCredentialsRejected(err), "a revoked key was accepted")
+		test.NotNil(user.RevokeAPIKey(info.ID), "revoked a key twice")
+	})
+}
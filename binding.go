@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+)
+
+// Binding is a set of client attributes a session can be bound to, so that a
+// stolen session cookie doesn't work from another client.
+type Binding uint8
+
+const (
+	// BindSubnet requires requests to come from the subnet the session was
+	// started from. See BindingPolicy.IPv4Prefix and IPv6Prefix.
+	BindSubnet Binding = 1 << iota
+	// BindUserAgent requires requests to carry the User-Agent the session was
+	// started with.
+	BindUserAgent
+	// BindTLSChannel requires requests to be made over the TLS connection the
+	// session was started on (RFC 5929 and RFC 9266 channel binding). Clients
+	// usually open new connections as they go, so this only suits clients
+	// which are known to hold a single connection open, and it doesn't work
+	// behind a proxy which terminates TLS.
+	BindTLSChannel
+)
+
+// BindingAction is what happens to a request whose client doesn't match the
+// one its session is bound to.
+type BindingAction uint8
+
+const (
+	// RejectMismatch responds 401 Unauthorized, leaving the session working
+	// for the client it's bound to.
+	RejectMismatch BindingAction = iota
+	// ReauthenticateOnMismatch deletes the session and treats the request as
+	// having none, so the user has to sign in again.
+	ReauthenticateOnMismatch
+	// LogMismatch only logs the mismatch.
+	LogMismatch
+)
+
+const (
+	defaultIPv4Prefix = 24
+	defaultIPv6Prefix = 64
+)
+
+// BindingPolicy chooses which client attributes sessions are bound to, and
+// what to do when a request doesn't match them. A nil policy binds nothing.
+// Only sessions started by signing in (see NewSessionForClient) record the
+// client's attributes; other sessions aren't bound.
+type BindingPolicy struct {
+	Bind       Binding
+	OnMismatch BindingAction
+	// IPv4Prefix and IPv6Prefix are the lengths of the subnets BindSubnet
+	// compares. They default to 24 and 64.
+	IPv4Prefix, IPv6Prefix int
+}
+
+type bindingMismatch struct{ error }
+
+// IsBindingMismatch returns true if an error was returned because a request
+// didn't match the client its session is bound to.
+func IsBindingMismatch(err error) bool {
+	_, ok := err.(bindingMismatch)
+	return ok
+}
+
+// channelBinding gets a value identifying the request's TLS connection, or ""
+// if it wasn't made over TLS.
+func channelBinding(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	if r.TLS.Version >= tls.VersionTLS13 {
+		binding, err := r.TLS.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return ""
+		}
+		return hex.EncodeToString(binding)
+	}
+	return hex.EncodeToString(r.TLS.TLSUnique)
+}
+
+// sameSubnet reports whether the hosts of the two addresses are in the same
+// subnet.
+func (p *BindingPolicy) sameSubnet(a, b string) bool {
+	ipA, ipB := hostIP(a), hostIP(b)
+	if ipA == nil || ipB == nil {
+		return false
+	}
+	if v4A, v4B := ipA.To4(), ipB.To4(); v4A != nil || v4B != nil {
+		if v4A == nil || v4B == nil {
+			return false
+		}
+		prefix := p.IPv4Prefix
+		if prefix <= 0 {
+			prefix = defaultIPv4Prefix
+		}
+		mask := net.CIDRMask(prefix, 32)
+		return v4A.Mask(mask).Equal(v4B.Mask(mask))
+	}
+	prefix := p.IPv6Prefix
+	if prefix <= 0 {
+		prefix = defaultIPv6Prefix
+	}
+	mask := net.CIDRMask(prefix, 128)
+	return ipA.Mask(mask).Equal(ipB.Mask(mask))
+}
+
+func hostIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// Check compares the request with the client the session was started by.
+// Attributes which weren't recorded when the session started are skipped.
+// Errors satisfy IsBindingMismatch.
+func (p *BindingPolicy) Check(r *http.Request, metadata *SessionMetadata) error {
+	if p == nil {
+		return nil
+	}
+	mismatch := func(attribute string) error {
+		return bindingMismatch{fmt.Errorf(
+			"session for %s used from a different %s", metadata.User, attribute,
+		)}
+	}
+	if p.Bind&BindSubnet != 0 && metadata.RemoteAddr != "" &&
+		!p.sameSubnet(metadata.RemoteAddr, r.RemoteAddr) {
+		return mismatch("network")
+	}
+	if p.Bind&BindUserAgent != 0 && metadata.UserAgent != "" &&
+		metadata.UserAgent != r.UserAgent() {
+		return mismatch("user agent")
+	}
+	if p.Bind&BindTLSChannel != 0 && metadata.ChannelBinding != "" &&
+		metadata.ChannelBinding != channelBinding(r) {
+		return mismatch("TLS connection")
+	}
+	return nil
+}
+
+// Enforce checks the request against the session's binding and carries out
+// the policy's action if it doesn't match: the mismatch is logged, and with
+// ReauthenticateOnMismatch the session is deleted. It returns nil if the
+// request may go ahead with the session.
+func (p *BindingPolicy) Enforce(
+	r *http.Request, token Session, metadata *SessionMetadata,
+) error {
+	err := p.Check(r, metadata)
+	if err == nil {
+		return nil
+	}
+	log.Printf(
+		"WARNING %v: %s %s from %s (%s)\n",
+		err,
+		r.Method,
+		r.URL.Path,
+		r.RemoteAddr,
+		r.UserAgent(),
+	)
+	switch p.OnMismatch {
+	case LogMismatch:
+		return nil
+	case ReauthenticateOnMismatch:
+		token.Delete()
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestBinding(t *testing.T) {
+	test := attest.New(t)
+	request := func(addr, agent string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = addr
+		r.Header.Set("User-Agent", agent)
+		return r
+	}
+	token, metadata, err := NewSessionForClient(
+		"test binding user",
+		request("192.0.2.10:1234", "test binding agent"),
+	)
+	test.Handle(err)
+	defer token.Delete()
+	var policy *BindingPolicy
+	test.Handle(policy.Check(request("198.51.100.1:1", "other agent"), metadata))
+	policy = &BindingPolicy{Bind: BindSubnet | BindUserAgent}
+	test.Handle(policy.Check(request("192.0.2.200:4321", "test binding agent"), metadata))
+	err = policy.Check(request("192.0.3.10:1234", "test binding agent"), metadata)
+	test.Attest(IsBindingMismatch(err), "a request from another subnet was accepted")
+	err = policy.Check(request("192.0.2.10:1234", "other agent"), metadata)
+	test.Attest(IsBindingMismatch(err), "a request from another user agent was accepted")
+	policy.IPv4Prefix = 16
+	test.Handle(policy.Check(request("192.0.3.10:1234", "test binding agent"), metadata))
+
+	t.Run("IPv6", func(t *testing.T) {
+		test := attest.New(t)
+		v6, v6Metadata, err := NewSessionForClient(
+			"test binding user",
+			request("[2001:db8:1:2::10]:1234", ""),
+		)
+		test.Handle(err)
+		defer v6.Delete()
+		policy := &BindingPolicy{Bind: BindSubnet}
+		test.Handle(policy.Check(request("[2001:db8:1:2::99]:1", ""), v6Metadata))
+		test.Attest(
+			IsBindingMismatch(policy.Check(request("[2001:db8:1:3::10]:1", ""), v6Metadata)),
+			"a request from another IPv6 subnet was accepted",
+		)
+		test.Attest(
+			IsBindingMismatch(policy.Check(request("192.0.2.10:1", ""), v6Metadata)),
+			"a request over IPv4 matched an IPv6 session",
+		)
+	})
+	t.Run("actions", func(t *testing.T) {
+		test := attest.New(t)
+		stolen := request("198.51.100.1:1", "test binding agent")
+		policy := &BindingPolicy{Bind: BindSubnet, OnMismatch: LogMismatch}
+		test.Handle(policy.Enforce(stolen, token, metadata))
+		policy.OnMismatch = RejectMismatch
+		test.NotNil(policy.Enforce(stolen, token, metadata), "a mismatch wasn't rejected")
+		test.Attest(token.CurrentlyExists(), "a rejected mismatch deleted the session")
+		policy.OnMismatch = ReauthenticateOnMismatch
+		test.NotNil(policy.Enforce(stolen, token, metadata), "a mismatch wasn't rejected")
+		test.Attest(!token.CurrentlyExists(), "the session outlived a mismatch")
+	})
+}
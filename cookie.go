@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// DefaultCookieName is the name of the session cookie unless configured
+	// otherwise.
+	DefaultCookieName = "session_token"
+	// hostPrefix restricts a cookie to the exact host which set it, over
+	// HTTPS, for the whole site.
+	hostPrefix = "__Host-"
+)
+
+// CookieOptions configures the attributes of the session cookie. The zero
+// value is usable, and gives a secure, HttpOnly, SameSite=Lax cookie named
+// "session_token" on the path "/", which expires along with the session.
+type CookieOptions struct {
+	// Name of the cookie. Defaults to DefaultCookieName.
+	Name string
+	// Path the cookie is sent for. Defaults to "/".
+	Path string
+	// Domain the cookie is sent to. Defaults to the host which set it.
+	Domain string
+	// MaxAge in seconds. Defaults to the session expiry delay (see
+	// SetDefaultExpiry). A negative value gives a cookie which is deleted
+	// when the browser is closed.
+	MaxAge int
+	// Insecure allows the cookie to be sent over plain HTTP. Don't.
+	Insecure bool
+	// AllowScripts allows javascript to read the cookie (i.e. it's not
+	// HttpOnly).
+	AllowScripts bool
+	// SameSite defaults to http.SameSiteLaxMode.
+	SameSite http.SameSite
+	// HostPrefix prefixes the cookie name with "__Host-", which tells
+	// browsers to only accept the cookie if it's secure, has the path "/",
+	// and no domain.
+	HostPrefix bool
+}
+
+// DefaultExpiry is the amount of time new sessions last for.
+func DefaultExpiry() time.Duration {
+	return expiryDelay
+}
+
+// CookieName is the name the cookie is set with, including the "__Host-"
+// prefix if requested.
+func (o CookieOptions) CookieName() string {
+	name := o.Name
+	if name == "" {
+		name = DefaultCookieName
+	}
+	if o.HostPrefix && !strings.HasPrefix(name, hostPrefix) {
+		name = hostPrefix + name
+	}
+	return name
+}
+
+// Validate checks for combinations of options browsers will reject.
+func (o CookieOptions) Validate() error {
+	if o.HostPrefix || strings.HasPrefix(o.Name, hostPrefix) {
+		if o.Insecure {
+			return fmt.Errorf("%s cookies must be secure", hostPrefix)
+		}
+		if o.Domain != "" {
+			return fmt.Errorf("%s cookies can't specify a domain", hostPrefix)
+		}
+		if o.Path != "" && o.Path != "/" {
+			return fmt.Errorf(`%s cookies must have the path "/"`, hostPrefix)
+		}
+	}
+	if o.SameSite == http.SameSiteNoneMode && o.Insecure {
+		return fmt.Errorf("SameSite=None cookies must be secure")
+	}
+	return nil
+}
+
+// SessionsOptions converts the options to the gorilla/sessions equivalent.
+func (o CookieOptions) SessionsOptions() *sessions.Options {
+	opts := &sessions.Options{
+		Path:     o.Path,
+		Domain:   o.Domain,
+		MaxAge:   o.MaxAge,
+		Secure:   !o.Insecure,
+		HttpOnly: !o.AllowScripts,
+		SameSite: o.SameSite,
+	}
+	if opts.Path == "" || o.HostPrefix {
+		opts.Path = "/"
+	}
+	if o.HostPrefix {
+		opts.Domain = ""
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = int(expiryDelay / time.Second)
+	} else if opts.MaxAge < 0 {
+		// in gorilla/sessions a negative MaxAge deletes the cookie; zero
+		// leaves it out, which gives a browser-session cookie.
+		opts.MaxAge = 0
+	}
+	if opts.SameSite == 0 || opts.SameSite == http.SameSiteDefaultMode {
+		opts.SameSite = http.SameSiteLaxMode
+	}
+	return opts
+}
+
+// Cookie creates a cookie with these options holding the given value.
+func (o CookieOptions) Cookie(value string) *http.Cookie {
+	opts := o.SessionsOptions()
+	cookie := &http.Cookie{
+		Name:     o.CookieName(),
+		Value:    value,
+		Path:     opts.Path,
+		Domain:   opts.Domain,
+		MaxAge:   opts.MaxAge,
+		Secure:   opts.Secure,
+		HttpOnly: opts.HttpOnly,
+		SameSite: opts.SameSite,
+	}
+	if opts.MaxAge > 0 {
+		cookie.Expires = time.Now().Add(time.Duration(opts.MaxAge) * time.Second)
+	}
+	return cookie
+}
+
+// ExpiredCookie creates a cookie with these options which tells the browser
+// to delete the cookie.
+func (o CookieOptions) ExpiredCookie() *http.Cookie {
+	cookie := o.Cookie("")
+	cookie.MaxAge = -1
+	cookie.Expires = time.Unix(1, 0)
+	return cookie
+}
@@ -0,0 +1,44 @@
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestCookieOptions(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		test := attest.New(t)
+		var options CookieOptions
+		test.Handle(options.Validate())
+		test.Equals(DefaultCookieName, options.CookieName())
+		opts := options.SessionsOptions()
+		test.Equals("/", opts.Path)
+		test.Equals("", opts.Domain)
+		test.Equals(int(expiryDelay/time.Second), opts.MaxAge)
+		test.Attest(opts.Secure, "default cookie wasn't secure")
+		test.Attest(opts.HttpOnly, "default cookie wasn't HttpOnly")
+		test.Equals(http.SameSiteLaxMode, opts.SameSite)
+	})
+	t.Run("host prefix", func(t *testing.T) {
+		test := attest.New(t)
+		options := CookieOptions{Name: "sid", HostPrefix: true}
+		test.Handle(options.Validate())
+		test.Equals("__Host-sid", options.CookieName())
+		options.Domain = "example.com"
+		test.NotNil(options.Validate(), "__Host- cookie allowed a domain")
+		options.Domain = ""
+		options.Path = "/app"
+		test.NotNil(options.Validate(), "__Host- cookie allowed a path")
+		options.Path = ""
+		options.Insecure = true
+		test.NotNil(options.Validate(), "__Host- cookie allowed to be insecure")
+	})
+	t.Run("browser-session cookie", func(t *testing.T) {
+		test := attest.New(t)
+		options := CookieOptions{MaxAge: -1}
+		test.Equals(0, options.SessionsOptions().MaxAge)
+	})
+}
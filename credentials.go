@@ -0,0 +1,307 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+)
+
+const (
+	// UserField is the form field or JSON key the username is submitted in
+	// unless configured otherwise
+	UserField = "user"
+	// TokenField is the form field or JSON key the password or token is
+	// submitted in unless configured otherwise
+	TokenField = "token"
+	// the most that's read of a JSON sign-in body
+	maxCredentialsBody = 1 << 16
+)
+
+// DefaultCredentialContentTypes are the content types credentials may be
+// POSTed as unless configured otherwise.
+var DefaultCredentialContentTypes = []string{
+	"application/x-www-form-urlencoded",
+	"multipart/form-data",
+	"application/json",
+}
+
+// CredentialExtractor gets sign-in credentials from a request. If the request
+// doesn't carry any credentials the username is empty and the error is nil.
+// Credentials submitted in a way which isn't allowed give an error satisfying
+// IsCredentialsRejected.
+type CredentialExtractor interface {
+	Credentials(r *http.Request) (user Username, token string, err error)
+}
+
+// CredentialPolicy controls how sign-in credentials may be submitted. The
+// zero value is strict: credentials are only accepted in the body of a POST
+// request made over TLS, as a form or as a JSON object like
+//
+//	{"user": "name", "token": "password"}
+//
+// so that passwords don't end up in access logs or browser history. A policy
+// is itself a CredentialExtractor which reads forms and JSON bodies with the
+// default field names.
+type CredentialPolicy struct {
+	// AllowQuery accepts credentials in the URL's query string.
+	AllowQuery bool
+	// AllowInsecure accepts credentials over plain HTTP.
+	AllowInsecure bool
+	// TrustForwardedProto treats requests with "X-Forwarded-Proto: https" as
+	// having been made over TLS. Only set it behind a proxy which sets that
+	// header itself.
+	TrustForwardedProto bool
+	// ContentTypes credentials may be POSTed as. Defaults to
+	// DefaultCredentialContentTypes.
+	ContentTypes []string
+}
+
+// LenientCredentials accepts credentials from the query string or a form in
+// any request, which was the only behavior before CredentialPolicy existed.
+var LenientCredentials = &CredentialPolicy{
+	AllowQuery:    true,
+	AllowInsecure: true,
+}
+
+func policyOrLenient(p *CredentialPolicy) *CredentialPolicy {
+	if p == nil {
+		return LenientCredentials
+	}
+	return p
+}
+
+func (p *CredentialPolicy) acceptsContentType(mediaType string) bool {
+	contentTypes := p.ContentTypes
+	if len(contentTypes) == 0 {
+		contentTypes = DefaultCredentialContentTypes
+	}
+	for _, accepted := range contentTypes {
+		if accepted == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// postedAs returns the media type of a POST request's body if the policy
+// accepts credentials in it, otherwise "".
+func (p *CredentialPolicy) postedAs(r *http.Request) string {
+	if r.Method != http.MethodPost {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if !p.acceptsContentType(mediaType) {
+		return ""
+	}
+	return mediaType
+}
+
+func (p *CredentialPolicy) isTLS(r *http.Request) bool {
+	return r.TLS != nil ||
+		(p.TrustForwardedProto && r.Header.Get("X-Forwarded-Proto") == "https")
+}
+
+// checkTLS rejects credentials which weren't sent over TLS, unless the policy
+// allows it.
+func (p *CredentialPolicy) checkTLS(r *http.Request) error {
+	if p.AllowInsecure || p.isTLS(r) {
+		return nil
+	}
+	return CredentialsRejected(
+		http.StatusBadRequest,
+		"credentials must be sent over TLS",
+	)
+}
+
+// checkQuery rejects credentials in the query string, unless the policy
+// allows it.
+func (p *CredentialPolicy) checkQuery(r *http.Request) error {
+	if p.AllowQuery {
+		return nil
+	}
+	if r.Method != http.MethodPost {
+		return CredentialsRejected(
+			http.StatusMethodNotAllowed,
+			"credentials must be POSTed, not sent in the URL",
+		)
+	}
+	return CredentialsRejected(
+		http.StatusBadRequest,
+		"credentials must not be sent in the URL",
+	)
+}
+
+// ReadCredentials gets credentials from a form or JSON body with the default
+// field names. A nil policy is lenient.
+func (p *CredentialPolicy) ReadCredentials(
+	r *http.Request,
+) (user Username, token string, err error) {
+	return AnyCredentials{
+		FormCredentials{Policy: p},
+		JSONCredentials{Policy: p},
+	}.Credentials(r)
+}
+
+// Credentials is the same as ReadCredentials.
+func (p *CredentialPolicy) Credentials(r *http.Request) (Username, string, error) {
+	return p.ReadCredentials(r)
+}
+
+// fieldNames fills in the defaults for empty field names.
+func fieldNames(user, token string) (string, string) {
+	if user == "" {
+		user = UserField
+	}
+	if token == "" {
+		token = TokenField
+	}
+	return user, token
+}
+
+// FormCredentials reads credentials from form fields: the body of a POSTed
+// form, or the query string if the policy allows it.
+type FormCredentials struct {
+	// UserField and TokenField default to "user" and "token".
+	UserField, TokenField string
+	// Policy defaults to LenientCredentials.
+	Policy *CredentialPolicy
+}
+
+// Credentials reads the form fields.
+func (f FormCredentials) Credentials(r *http.Request) (Username, string, error) {
+	var (
+		p                     = policyOrLenient(f.Policy)
+		userField, tokenField = fieldNames(f.UserField, f.TokenField)
+		query                 = r.URL.Query()
+		user, token           string
+	)
+	if query.Get(userField) != "" || query.Get(tokenField) != "" {
+		if err := p.checkQuery(r); err != nil {
+			return "", "", err
+		}
+		user, token = query.Get(userField), query.Get(tokenField)
+	}
+	switch p.postedAs(r) {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if posted := r.PostFormValue(userField); posted != "" {
+			user, token = posted, r.PostFormValue(tokenField)
+		}
+	}
+	if user == "" {
+		return "", "", nil
+	}
+	if err := p.checkTLS(r); err != nil {
+		return "", "", err
+	}
+	return Username(user), token, nil
+}
+
+// JSONCredentials reads credentials from a POSTed JSON object.
+type JSONCredentials struct {
+	// UserField and TokenField are the keys, defaulting to "user" and
+	// "token".
+	UserField, TokenField string
+	// Policy defaults to LenientCredentials.
+	Policy *CredentialPolicy
+}
+
+// Credentials decodes the body, leaving it in place for the next handler.
+func (j JSONCredentials) Credentials(r *http.Request) (Username, string, error) {
+	p := policyOrLenient(j.Policy)
+	if p.postedAs(r) != "application/json" {
+		return "", "", nil
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxCredentialsBody))
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return "", "", CredentialsRejected(
+			http.StatusBadRequest,
+			fmt.Sprintf("error reading body: %v", err),
+		)
+	}
+	var credentials map[string]interface{}
+	if err = json.Unmarshal(body, &credentials); err != nil {
+		// not necessarily meant as a sign-in request
+		return "", "", nil
+	}
+	userField, tokenField := fieldNames(j.UserField, j.TokenField)
+	user, _ := credentials[userField].(string)
+	token, _ := credentials[tokenField].(string)
+	if user == "" {
+		return "", "", nil
+	}
+	if err = p.checkTLS(r); err != nil {
+		return "", "", err
+	}
+	return Username(user), token, nil
+}
+
+// BasicAuthCredentials reads credentials from an "Authorization: Basic"
+// header.
+type BasicAuthCredentials struct {
+	// Policy decides whether the header is accepted over plain HTTP. Defaults
+	// to LenientCredentials.
+	Policy *CredentialPolicy
+}
+
+// Credentials reads the header.
+func (b BasicAuthCredentials) Credentials(r *http.Request) (Username, string, error) {
+	user, token, ok := r.BasicAuth()
+	if !ok || user == "" {
+		return "", "", nil
+	}
+	if err := policyOrLenient(b.Policy).checkTLS(r); err != nil {
+		return "", "", err
+	}
+	return Username(user), token, nil
+}
+
+// HeaderCredentials reads credentials from custom headers.
+type HeaderCredentials struct {
+	UserHeader, TokenHeader string
+	// Policy decides whether the headers are accepted over plain HTTP.
+	// Defaults to LenientCredentials.
+	Policy *CredentialPolicy
+}
+
+// Credentials reads the headers.
+func (h HeaderCredentials) Credentials(r *http.Request) (Username, string, error) {
+	user := r.Header.Get(h.UserHeader)
+	if user == "" {
+		return "", "", nil
+	}
+	if err := policyOrLenient(h.Policy).checkTLS(r); err != nil {
+		return "", "", err
+	}
+	return Username(user), r.Header.Get(h.TokenHeader), nil
+}
+
+// AnyCredentials tries each extractor in turn, and returns the first
+// credentials or error found.
+type AnyCredentials []CredentialExtractor
+
+// Credentials tries each extractor.
+func (extractors AnyCredentials) Credentials(r *http.Request) (Username, string, error) {
+	for _, extractor := range extractors {
+		user, token, err := extractor.Credentials(r)
+		if err != nil || user != "" {
+			return user, token, err
+		}
+	}
+	return "", "", nil
+}
+
+// RejectCredentials responds with the status of an error returned by a
+// CredentialExtractor.
+func RejectCredentials(w http.ResponseWriter, err error) {
+	status := StatusOf(err)
+	if status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", http.MethodPost)
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%d %s", status, http.StatusText(status))
+}
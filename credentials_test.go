@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestReadCredentials(t *testing.T) {
+	var strict CredentialPolicy
+	post := func(contentType, body string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		req.TLS = new(tls.ConnectionState)
+		return req
+	}
+	t.Run("strict policy rejects the query string", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/login?user=u&token=p", nil)
+		_, _, err := strict.ReadCredentials(req)
+		test.Attest(IsCredentialsRejected(err), "query credentials weren't rejected")
+		test.Equals(http.StatusMethodNotAllowed, StatusOf(err))
+		req = post("application/x-www-form-urlencoded", "")
+		req.URL.RawQuery = "user=u&token=p"
+		_, _, err = strict.ReadCredentials(req)
+		test.Equals(http.StatusBadRequest, StatusOf(err))
+	})
+	t.Run("strict policy requires TLS", func(t *testing.T) {
+		test := attest.New(t)
+		req := post("application/x-www-form-urlencoded", "user=u&token=p")
+		req.TLS = nil
+		_, _, err := strict.ReadCredentials(req)
+		test.Attest(IsCredentialsRejected(err), "plain HTTP credentials weren't rejected")
+		req = post("application/x-www-form-urlencoded", "user=u&token=p")
+		req.TLS = nil
+		req.Header.Set("X-Forwarded-Proto", "https")
+		proxied := CredentialPolicy{TrustForwardedProto: true}
+		user, _, err := proxied.ReadCredentials(req)
+		test.Handle(err)
+		test.Equals(Username("u"), user)
+	})
+	t.Run("form", func(t *testing.T) {
+		test := attest.New(t)
+		user, token, err := strict.ReadCredentials(
+			post("application/x-www-form-urlencoded", "user=u&token=p"),
+		)
+		test.Handle(err)
+		test.Equals(Username("u"), user)
+		test.Equals("p", token)
+	})
+	t.Run("JSON", func(t *testing.T) {
+		test := attest.New(t)
+		body := `{"user": "u", "token": "p"}`
+		req := post("application/json; charset=utf-8", body)
+		user, token, err := strict.ReadCredentials(req)
+		test.Handle(err)
+		test.Equals(Username("u"), user)
+		test.Equals("p", token)
+		read := test.EatError(ioutil.ReadAll(req.Body)).([]byte)
+		test.Equals(body, string(read))
+	})
+	t.Run("unaccepted content type", func(t *testing.T) {
+		test := attest.New(t)
+		formOnly := CredentialPolicy{
+			ContentTypes: []string{"application/x-www-form-urlencoded"},
+		}
+		user, _, err := formOnly.ReadCredentials(
+			post("application/json", `{"user": "u", "token": "p"}`),
+		)
+		test.Handle(err)
+		test.Equals(Username(""), user)
+	})
+	t.Run("lenient policy", func(t *testing.T) {
+		test := attest.New(t)
+		var lenient *CredentialPolicy
+		req := httptest.NewRequest(http.MethodGet, "/login?user=u&token=p", nil)
+		user, token, err := lenient.ReadCredentials(req)
+		test.Handle(err)
+		test.Equals(Username("u"), user)
+		test.Equals("p", token)
+	})
+}
+
+func TestCredentialExtractors(t *testing.T) {
+	t.Run("form with custom field names", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/login",
+			strings.NewReader("email=u&password=p&user=other"),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		extractor := FormCredentials{UserField: "email", TokenField: "password"}
+		user, token, err := extractor.Credentials(req)
+		test.Handle(err)
+		test.Equals(Username("u"), user)
+		test.Equals("p", token)
+	})
+	t.Run("JSON with custom field names", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/login",
+			strings.NewReader(`{"login": "u", "secret": "p"}`),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		extractor := JSONCredentials{UserField: "login", TokenField: "secret"}
+		user, token, err := extractor.Credentials(req)
+		test.Handle(err)
+		test.Equals(Username("u"), user)
+		test.Equals("p", token)
+	})
+	t.Run("basic auth", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth("u", "p")
+		user, token, err := BasicAuthCredentials{}.Credentials(req)
+		test.Handle(err)
+		test.Equals(Username("u"), user)
+		test.Equals("p", token)
+		_, _, err = BasicAuthCredentials{Policy: new(CredentialPolicy)}.Credentials(req)
+		test.Attest(IsCredentialsRejected(err), "basic auth over plain HTTP wasn't rejected")
+	})
+	t.Run("headers", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User", "u")
+		req.Header.Set("X-Token", "p")
+		extractor := HeaderCredentials{UserHeader: "X-User", TokenHeader: "X-Token"}
+		user, token, err := extractor.Credentials(req)
+		test.Handle(err)
+		test.Equals(Username("u"), user)
+		test.Equals("p", token)
+	})
+	t.Run("first match wins", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/?user=q", nil)
+		req.SetBasicAuth("u", "p")
+		extractors := AnyCredentials{
+			HeaderCredentials{UserHeader: "X-User", TokenHeader: "X-Token"},
+			BasicAuthCredentials{},
+			FormCredentials{},
+		}
+		user, _, err := extractors.Credentials(req)
+		test.Handle(err)
+		test.Equals(Username("u"), user)
+		user, _, err = AnyCredentials{}.Credentials(req)
+		test.Handle(err)
+		test.Equals(Username(""), user)
+	})
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// encryptedHeader marks a user file as encrypted. It's also used as the
+// additional authenticated data, so it can't be swapped out for another
+// version's header.
+const encryptedHeader = "go-middleware-session-auth encrypted users v1\n"
+
+// usersKey provides the key the user file is encrypted with. If it's nil the
+// user file is stored as a plain gob.
+var usersKey KeyProvider
+
+// KeyProvider supplies the key used to encrypt the user file. Keys which
+// aren't exactly 32 bytes long are run through SHA-256 to get an AES-256 key,
+// so passphrases are acceptable, but random keys are preferable.
+type KeyProvider interface {
+	Key() ([]byte, error)
+}
+
+// StaticKey is a KeyProvider which always returns itself.
+type StaticKey []byte
+
+// Key returns the key.
+func (k StaticKey) Key() ([]byte, error) {
+	if len(k) == 0 {
+		return nil, fmt.Errorf("empty encryption key")
+	}
+	return k, nil
+}
+
+// EnvKey is a KeyProvider which reads the key from the environment variable
+// of the same name.
+type EnvKey string
+
+// Key reads the key from the environment.
+func (k EnvKey) Key() ([]byte, error) {
+	key := os.Getenv(string(k))
+	if key == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", string(k))
+	}
+	return []byte(key), nil
+}
+
+// KeyFile is a KeyProvider which reads the key from the file at the given
+// path. Leading and trailing whitespace is ignored.
+type KeyFile string
+
+// Key reads the key from the file.
+func (k KeyFile) Key() ([]byte, error) {
+	key, err := ioutil.ReadFile(string(k))
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file %s: %v", string(k), err)
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", string(k))
+	}
+	return key, nil
+}
+
+// EncryptUserFileWith sets the KeyProvider used to encrypt the user file from
+// the next write onward. A nil provider stores the file unencrypted. Once a
+// key is set unencrypted files are rejected, so that a file which has been
+// swapped for a plaintext one isn't trusted; use EncryptExistingUserFile to
+// encrypt an existing unencrypted file once.
+func EncryptUserFileWith(provider KeyProvider) {
+	usersKey = provider
+}
+
+// EncryptExistingUserFile is a one-time migration which reads the unencrypted
+// user file at ConfigLocation, rewrites it under the key set with
+// EncryptUserFileWith, and loads the users it contained.
+func EncryptExistingUserFile() error {
+	if usersKey == nil {
+		return fmt.Errorf(
+			"not encrypting %s; no key has been configured",
+			ConfigLocation,
+		)
+	}
+	data, err := ioutil.ReadFile(ConfigLocation)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(string(data), encryptedHeader) {
+		return fmt.Errorf("%s is already encrypted", ConfigLocation)
+	}
+	users := make(UserCollection)
+	if err = gob.NewDecoder(bytes.NewReader(data)).Decode(&users); err != nil {
+		return fmt.Errorf(
+			"couldn't read the unencrypted user file %s: %v",
+			ConfigLocation,
+			err,
+		)
+	}
+	if err = users.Validate(); err != nil {
+		return err
+	}
+	usersLock.Lock()
+	AllUsers = users
+	usersLock.Unlock()
+	return SyncAllUsers()
+}
+
+// RotateUserFileKey checks that the current key can read the user file, then
+// rewrites it under the new one. TOTP secrets encrypted with the user file's
+// key are re-encrypted with the new one too. The old key stays in use if
+// anything fails.
+func RotateUserFileKey(to KeyProvider) error {
+	if _, err := ReadFrom(ConfigLocation); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf(
+			"not rotating key; couldn't read %s with the current key: %v",
+			ConfigLocation,
+			err,
+		)
+	}
+	from := usersKey
+	restoreTOTP := func() {}
+	if totpKey == nil && from != nil {
+		var err error
+		if restoreTOTP, err = resealTOTPSecrets(from, to); err != nil {
+			return fmt.Errorf("not rotating key; %v", err)
+		}
+	}
+	usersKey = to
+	if err := SyncAllUsers(); err != nil {
+		usersKey = from
+		restoreTOTP()
+		if restoreErr := SyncAllUsers(); restoreErr != nil {
+			return fmt.Errorf(
+				"error rewriting %s under the new key: %v; and restoring it "+
+					"under the old one: %v",
+				ConfigLocation,
+				err,
+				restoreErr,
+			)
+		}
+		return err
+	}
+	return nil
+}
+
+func userFileCipher(provider KeyProvider) (cipher.AEAD, error) {
+	key, err := provider.Key()
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		derived := sha256.Sum256(key)
+		key = derived[:]
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptUsers seals a gob-encoded user collection
+func encryptUsers(plaintext []byte, provider KeyProvider) ([]byte, error) {
+	aead, err := userFileCipher(provider)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("error reading from random number generator! %v", err)
+	}
+	sealed := append([]byte(encryptedHeader), nonce...)
+	return aead.Seal(sealed, nonce, plaintext, []byte(encryptedHeader)), nil
+}
+
+// decryptUsers opens a file written by encryptUsers. Data without the
+// encrypted header is returned as-is if no key has been configured, and
+// rejected otherwise.
+func decryptUsers(data []byte, provider KeyProvider) ([]byte, error) {
+	if !strings.HasPrefix(string(data), encryptedHeader) {
+		if provider != nil {
+			return nil, fmt.Errorf(
+				"the user file isn't encrypted but a key has been configured; " +
+					"encrypt it once with EncryptExistingUserFile",
+			)
+		}
+		return data, nil
+	}
+	if provider == nil {
+		return nil, fmt.Errorf(
+			"the user file is encrypted but no key has been configured",
+		)
+	}
+	aead, err := userFileCipher(provider)
+	if err != nil {
+		return nil, err
+	}
+	data = data[len(encryptedHeader):]
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted user file is truncated")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(encryptedHeader))
+	if err != nil {
+		return nil, fmt.Errorf(
+			"couldn't decrypt the user file, is the key correct? %v",
+			err,
+		)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestEncryptedUserFile(t *testing.T) {
+	const (
+		username = "test encrypted user"
+		password = "test encrypted user's password"
+	)
+	defer EncryptUserFileWith(nil)
+	AllUsers = make(UserCollection)
+	test := attest.New(t)
+	test.Handle(CreateNewUser(username, password))
+	t.Run("round trip", func(t *testing.T) {
+		test := attest.New(t)
+		EncryptUserFileWith(StaticKey("test key"))
+		test.Handle(SyncAllUsers())
+		onDisk := test.EatError(ioutil.ReadFile(ConfigLocation)).([]byte)
+		test.Attest(
+			bytes.HasPrefix(onDisk, []byte(encryptedHeader)),
+			"user file wasn't encrypted",
+		)
+		test.Attest(
+			!bytes.Contains(onDisk, []byte(username)),
+			"username was readable in the encrypted file",
+		)
+		read := test.EatError(ReadFrom(ConfigLocation)).(UserCollection)
+		test.Equals(
+			AllUsers[Username(username)].HashValue,
+			read[Username(username)].HashValue,
+		)
+	})
+	t.Run("wrong key", func(t *testing.T) {
+		test := attest.New(t)
+		EncryptUserFileWith(StaticKey("test key"))
+		test.Handle(SyncAllUsers())
+		EncryptUserFileWith(StaticKey("some other key"))
+		_, err := ReadFrom(ConfigLocation)
+		test.NotNil(err, "got nil error reading the file with the wrong key")
+		EncryptUserFileWith(nil)
+		_, err = ReadFrom(ConfigLocation)
+		test.NotNil(err, "got nil error reading the file with no key")
+	})
+	t.Run("rotation", func(t *testing.T) {
+		test := attest.New(t)
+		EncryptUserFileWith(StaticKey("test key"))
+		test.Handle(SyncAllUsers())
+		test.Handle(RotateUserFileKey(StaticKey("test rotated key")))
+		read := test.EatError(ReadFrom(ConfigLocation)).(UserCollection)
+		test.Equals(1, len(read))
+		EncryptUserFileWith(StaticKey("test key"))
+		_, err := ReadFrom(ConfigLocation)
+		test.NotNil(err, "file could still be read with the old key")
+	})
+	t.Run("unencrypted file with a key", func(t *testing.T) {
+		test := attest.New(t)
+		EncryptUserFileWith(nil)
+		test.Handle(SyncAllUsers())
+		EncryptUserFileWith(StaticKey("test key"))
+		_, err := ReadFrom(ConfigLocation)
+		test.NotNil(err, "read an unencrypted file with a key configured")
+		test.Handle(EncryptExistingUserFile())
+		onDisk := test.EatError(ioutil.ReadFile(ConfigLocation)).([]byte)
+		test.Attest(
+			bytes.HasPrefix(onDisk, []byte(encryptedHeader)),
+			"user file wasn't encrypted",
+		)
+		read := test.EatError(ReadFrom(ConfigLocation)).(UserCollection)
+		test.Equals(1, len(read))
+		test.NotNil(
+			EncryptExistingUserFile(),
+			"encrypted an already encrypted file again",
+		)
+	})
+	t.Run("failed write", func(t *testing.T) {
+		test := attest.New(t)
+		EncryptUserFileWith(StaticKey("test key"))
+		test.Handle(SyncAllUsers())
+		before := test.EatError(ioutil.ReadFile(ConfigLocation)).([]byte)
+		EncryptUserFileWith(failingKey{})
+		test.NotNil(SyncAllUsers(), "got nil error writing with a broken key")
+		after := test.EatError(ioutil.ReadFile(ConfigLocation)).([]byte)
+		test.Attest(
+			bytes.Equal(before, after),
+			"the user file was changed by a failed write",
+		)
+		dir, name := path.Split(ConfigLocation)
+		files := test.EatError(ioutil.ReadDir(dir)).([]os.FileInfo)
+		for _, file := range files {
+			test.Attest(
+				!strings.HasPrefix(file.Name(), "."+name+"."),
+				"the temporary file %s was left behind",
+				file.Name(),
+			)
+		}
+	})
+}
+
+// failingKey is a KeyProvider which can't provide a key.
+type failingKey struct{}
+
+func (failingKey) Key() ([]byte, error) {
+	return nil, fmt.Errorf("test key provider failure")
+}
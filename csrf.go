@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+)
+
+const (
+	// CSRFHeader is the header a CSRF token may be submitted in
+	CSRFHeader = "X-CSRF-Token"
+	// CSRFFormField is the form field a CSRF token may be submitted in
+	CSRFFormField = "csrf_token"
+	// CSRFCookieName is the name of the double-submit cookie
+	CSRFCookieName = "csrf_token"
+	// 256 bits
+	csrfTokenLength = 32
+)
+
+// CSRFMode selects how requests which change state are protected from
+// cross-site request forgery.
+type CSRFMode int
+
+const (
+	// CSRFSynchronizer requires unsafe requests from signed-in users to carry
+	// the token stored with their session. Sign-in requests, which don't have
+	// a session yet, are checked against the double-submit cookie. This is
+	// the default.
+	CSRFSynchronizer CSRFMode = iota
+	// CSRFDoubleSubmit requires unsafe requests to carry the same token as
+	// the double-submit cookie.
+	CSRFDoubleSubmit
+	// CSRFDisabled turns CSRF protection off.
+	CSRFDisabled
+)
+
+// NewCSRFToken generates a random, URL-safe CSRF token.
+func NewCSRFToken() (string, error) {
+	token := make([]byte, csrfTokenLength)
+	if _, err := io.ReadFull(rand.Reader, token); err != nil {
+		return "", fmt.Errorf("error reading from random number generator! %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// IsSafeMethod returns true for HTTP methods which shouldn't change state,
+// and so don't need CSRF protection.
+func IsSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// CSRFTokenFrom gets the CSRF token submitted with the request, from the
+// X-CSRF-Token header or the csrf_token form field.
+func CSRFTokenFrom(r *http.Request) string {
+	if token := r.Header.Get(CSRFHeader); token != "" {
+		return token
+	}
+	return r.PostFormValue(CSRFFormField)
+}
+
+// CSRFTokensMatch compares tokens in constant time. Empty tokens never match.
+func CSRFTokensMatch(expected, submitted string) bool {
+	if expected == "" || submitted == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(submitted)) == 1
+}
+
+// CSRFTemplateField renders a hidden form field holding the token, for use
+// in html/template login and form templates:
+//
+//	<form method="POST">{{ .CSRFField }} ... </form>
+func CSRFTemplateField(token string) template.HTML {
+	return template.HTML(fmt.Sprintf(
+		`<input type="hidden" name="%s" value="%s">`,
+		CSRFFormField,
+		template.HTMLEscapeString(token),
+	))
+}
+
+// csrfCookieOptions derives the double-submit cookie's attributes from the
+// session cookie's. Scripts may read it so that they can copy it into the
+// X-CSRF-Token header.
+func csrfCookieOptions(session CookieOptions) CookieOptions {
+	options := session
+	options.Name = CSRFCookieName
+	options.AllowScripts = true
+	return options
+}
+
+// EnsureCSRFCookie gets the double-submit token from the request's cookie, or
+// generates a new one and sets the cookie on the response.
+func EnsureCSRFCookie(
+	w http.ResponseWriter, r *http.Request, session CookieOptions,
+) (string, error) {
+	options := csrfCookieOptions(session)
+	if cookie, err := r.Cookie(options.CookieName()); err == nil &&
+		cookie.Value != "" {
+		return cookie.Value, nil
+	}
+	token, err := NewCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, options.Cookie(token))
+	return token, nil
+}
+
+// CheckDoubleSubmit checks that an unsafe request carries the same token as
+// its double-submit cookie.
+func CheckDoubleSubmit(r *http.Request, session CookieOptions) error {
+	if IsSafeMethod(r.Method) {
+		return nil
+	}
+	cookie, err := r.Cookie(csrfCookieOptions(session).CookieName())
+	if err != nil {
+		return fmt.Errorf("no CSRF cookie")
+	}
+	if !CSRFTokensMatch(cookie.Value, CSRFTokenFrom(r)) {
+		return fmt.Errorf("CSRF token doesn't match the CSRF cookie")
+	}
+	return nil
+}
+
+// CheckCSRF checks an unsafe request from a signed-in user according to the
+// given mode.
+func CheckCSRF(
+	r *http.Request,
+	mode CSRFMode,
+	session CookieOptions,
+	metadata *SessionMetadata,
+) error {
+	switch {
+	case mode == CSRFDisabled || IsSafeMethod(r.Method):
+		return nil
+	case mode == CSRFDoubleSubmit:
+		return CheckDoubleSubmit(r, session)
+	case metadata == nil:
+		return fmt.Errorf("no session to check the CSRF token against")
+	case !CSRFTokensMatch(metadata.CSRFToken, CSRFTokenFrom(r)):
+		return fmt.Errorf("CSRF token doesn't match the session")
+	}
+	return nil
+}
+
+// CSRFFailed responds "403 Forbidden"
+func CSRFFailed(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusForbidden)
+	fmt.Fprintf(w, "%d Forbidden", http.StatusForbidden)
+}
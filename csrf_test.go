@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestCSRF(t *testing.T) {
+	var (
+		options     CookieOptions
+		_, metadata = NewSession()
+	)
+	post := func(token string) *http.Request {
+		form := url.Values{CSRFFormField: {token}}
+		req := httptest.NewRequest(
+			http.MethodPost, "/", strings.NewReader(form.Encode()),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+	t.Run("safe methods aren't checked", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		test.Handle(CheckCSRF(req, CSRFSynchronizer, options, nil))
+		test.Handle(CheckCSRF(req, CSRFDoubleSubmit, options, nil))
+	})
+	t.Run("synchronizer", func(t *testing.T) {
+		test := attest.New(t)
+		test.Handle(CheckCSRF(
+			post(metadata.CSRFToken), CSRFSynchronizer, options, metadata,
+		))
+		test.NotNil(
+			CheckCSRF(post("wrong"), CSRFSynchronizer, options, metadata),
+			"accepted the wrong token",
+		)
+		test.NotNil(
+			CheckCSRF(post(""), CSRFSynchronizer, options, metadata),
+			"accepted a missing token",
+		)
+		req := httptest.NewRequest(http.MethodDelete, "/", nil)
+		req.Header.Set(CSRFHeader, metadata.CSRFToken)
+		test.Handle(CheckCSRF(req, CSRFSynchronizer, options, metadata))
+	})
+	t.Run("double submit", func(t *testing.T) {
+		test := attest.New(t)
+		rec := httptest.NewRecorder()
+		token := test.EatError(
+			EnsureCSRFCookie(rec, httptest.NewRequest("GET", "/", nil), options),
+		).(string)
+		cookies := rec.Result().Cookies()
+		test.Equals(1, len(cookies))
+		test.Attest(!cookies[0].HttpOnly, "scripts can't read the CSRF cookie")
+		req := post(token)
+		req.AddCookie(cookies[0])
+		test.Handle(CheckCSRF(req, CSRFDoubleSubmit, options, nil))
+		req = post("wrong")
+		req.AddCookie(cookies[0])
+		test.NotNil(
+			CheckCSRF(req, CSRFDoubleSubmit, options, nil),
+			"accepted a token which didn't match the cookie",
+		)
+		test.NotNil(
+			CheckCSRF(post(token), CSRFDoubleSubmit, options, nil),
+			"accepted a token without a cookie",
+		)
+	})
+	t.Run("disabled", func(t *testing.T) {
+		test := attest.New(t)
+		test.Handle(CheckCSRF(post(""), CSRFDisabled, options, nil))
+	})
+}
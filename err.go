@@ -1,6 +1,9 @@
 package auth
 
-import "fmt"
+import (
+	"fmt"
+	"net/http"
+)
 
 type userExistsError struct{ error }
 
@@ -52,3 +55,88 @@ func NoSuchUser(user *Username) error {
 func IsNoSuchUser(err error) bool {
 	return fmt.Sprintf("%T", err) == "auth.wrongPasswordError"
 }
+
+type credentialsRejected struct {
+	error
+	status int
+}
+
+// CredentialsRejected returns an error that satisfies IsCredentialsRejected(),
+// for credentials which were submitted in a way the CredentialPolicy doesn't
+// allow. status is the HTTP status to respond with.
+func CredentialsRejected(status int, reason string) error {
+	return credentialsRejected{fmt.Errorf("credentials rejected: %s", reason), status}
+}
+
+// IsCredentialsRejected returns true if an error was created by calling
+// CredentialsRejected()
+func IsCredentialsRejected(err error) bool {
+	_, ok := err.(credentialsRejected)
+	return ok
+}
+
+// StatusOf gets the HTTP status an error created by CredentialsRejected()
+// should be reported with, 403 Forbidden for TooManySessions(), 401
+// Unauthorized for SecondFactorRequired(), or 400 Bad Request for any other
+// error.
+func StatusOf(err error) int {
+	if rejected, ok := err.(credentialsRejected); ok {
+		return rejected.status
+	}
+	if IsTooManySessions(err) {
+		return http.StatusForbidden
+	}
+	if IsSecondFactorRequired(err) {
+		return http.StatusUnauthorized
+	}
+	return http.StatusBadRequest
+}
+
+type tooManySessions struct{ error }
+
+// TooManySessions returns an error that satisfies IsTooManySessions()
+func TooManySessions(user Username, limit int) error {
+	return tooManySessions{
+		fmt.Errorf("%s is already signed in %d times, the most allowed", user, limit),
+	}
+}
+
+// IsTooManySessions returns true if an error was created by calling
+// TooManySessions()
+func IsTooManySessions(err error) bool {
+	_, ok := err.(tooManySessions)
+	return ok
+}
+
+type invalidTOTPCode struct{ error }
+
+// InvalidTOTPCode returns an error that satisfies IsInvalidTOTPCode()
+func InvalidTOTPCode(user *Username) error {
+	return invalidTOTPCode{
+		fmt.Errorf("incorrect or already used two-factor code for %v", user),
+	}
+}
+
+// IsInvalidTOTPCode returns true if an error was created by calling
+// InvalidTOTPCode()
+func IsInvalidTOTPCode(err error) bool {
+	_, ok := err.(invalidTOTPCode)
+	return ok
+}
+
+type secondFactorRequired struct{ error }
+
+// SecondFactorRequired returns an error that satisfies
+// IsSecondFactorRequired()
+func SecondFactorRequired(user Username) error {
+	return secondFactorRequired{
+		fmt.Errorf("%s has to enter a two-factor code to sign in", user),
+	}
+}
+
+// IsSecondFactorRequired returns true if an error was created by calling
+// SecondFactorRequired()
+func IsSecondFactorRequired(err error) bool {
+	_, ok := err.(secondFactorRequired)
+	return ok
+}
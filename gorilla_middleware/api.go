@@ -0,0 +1,567 @@
+package gorilla_middleware
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+)
+
+// Error codes returned in the "code" field of JSON API errors.
+const (
+	ErrorInvalidRequest      = "invalid_request"
+	ErrorInvalidCredentials  = "invalid_credentials"
+	ErrorCredentialsRejected = "credentials_rejected"
+	ErrorMethodNotAllowed    = "method_not_allowed"
+	ErrorNotSignedIn         = "not_signed_in"
+	ErrorCSRFFailed          = "csrf_failed"
+	ErrorInvalidRefreshToken = "invalid_refresh_token"
+	ErrorRefreshTokenReused  = "refresh_token_reused"
+	ErrorNoSuchSession       = "no_such_session"
+	ErrorUnsupported         = "unsupported"
+	ErrorTooManySessions     = "too_many_sessions"
+	ErrorSecondFactor        = "second_factor_required"
+	ErrorInvalidCode         = "invalid_code"
+	ErrorInternal            = "internal_error"
+)
+
+// APIError is the body of an unsuccessful JSON API response:
+//
+//	{"error": {"code": "invalid_credentials", "message": "..."}}
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// APISession is the body of a successful sign-in or session response.
+type APISession struct {
+	User    auth.Username `json:"user"`
+	Expires time.Time     `json:"expires"`
+	// CSRFToken must be sent in the X-CSRF-Token header of unsafe requests.
+	CSRFToken string `json:"csrf_token"`
+	// Token may be sent in an "Authorization: Bearer" header instead of the
+	// cookie. It's only included if some route accepts Bearer tokens, and
+	// expires at TokenExpires.
+	Token        string     `json:"token,omitempty"`
+	TokenExpires *time.Time `json:"token_expires,omitempty"`
+	// RefreshToken gets the next Token from POST /auth/refresh. Each refresh
+	// token can only be used once.
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("error writing JSON response: %v\n", err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, struct {
+		Error APIError `json:"error"`
+	}{APIError{Code: code, Message: message}})
+}
+
+func allowOnly(method string, w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeAPIError(
+		w,
+		http.StatusMethodNotAllowed,
+		ErrorMethodNotAllowed,
+		r.Method+" is not allowed, use "+method,
+	)
+	return false
+}
+
+// isFormPost reports whether the request has a content type a cross-site form
+// can be submitted with.
+func isFormPost(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data", "text/plain":
+		return true
+	}
+	return false
+}
+
+func apiSession(metadata *auth.SessionMetadata) APISession {
+	return APISession{
+		User:      metadata.User,
+		Expires:   metadata.Expiry,
+		CSRFToken: metadata.CSRFToken,
+	}
+}
+
+// API returns a handler serving the JSON API for single-page apps and mobile
+// clients:
+//
+//	POST /auth/login   {"user": "...", "token": "..."} -> APISession
+//	POST /auth/totp    {"code": "..."} -> APISession
+//	POST /auth/logout  [{"refresh_token": "..."}] -> 204 No Content
+//	GET  /auth/session -> APISession
+//	POST /auth/refresh {"refresh_token": "..."} -> APISession
+//	GET  /auth/sessions -> {"sessions": [auth.SessionInfo...]}
+//	DELETE /auth/sessions?id=... -> 204 No Content
+//
+// Mount it on a gorilla/mux router with
+//
+//	router.PathPrefix("/auth/").Handler(mw.API())
+//
+// or on a net/http ServeMux with http.Handle("/auth/", mw.API()). To mount the
+// endpoints at other paths use LoginAPI, SecondFactorAPI, LogoutAPI,
+// SessionAPI, RefreshAPI and SessionsAPI directly. If some route accepts
+// Bearer tokens, the session, logout and sessions endpoints accept the token
+// from the login response in an "Authorization: Bearer" header instead of the
+// cookie.
+func (m *Middleware) API() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/login", m.LoginAPI)
+	mux.HandleFunc("/auth/totp", m.SecondFactorAPI)
+	mux.HandleFunc("/auth/logout", m.LogoutAPI)
+	mux.HandleFunc("/auth/session", m.SessionAPI)
+	mux.HandleFunc("/auth/refresh", m.RefreshAPI)
+	mux.HandleFunc("/auth/sessions", m.SessionsAPI)
+	return mux
+}
+
+// LoginAPI signs the user in with POSTed credentials, sets the session cookie,
+// and responds with the new session. Credentials are read by the middleware's
+// CredentialExtractor. JSON requests and requests with credentials in headers
+// can't be sent cross-site without a CORS preflight, so only form submissions
+// are checked against the double-submit CSRF cookie. Users enrolled in
+// two-factor authentication get a 401 with the code "second_factor_required"
+// and a cookie holding the pending sign-in; they finish signing in with
+// SecondFactorAPI.
+func (m *Middleware) LoginAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowOnly(http.MethodPost, w, r) {
+		return
+	}
+	user, pass, err := m.credentials().Credentials(r)
+	if err != nil {
+		writeAPIError(w, auth.StatusOf(err), ErrorCredentialsRejected, err.Error())
+		return
+	}
+	if user != "" && m.CSRF != auth.CSRFDisabled && isFormPost(r) {
+		if err = auth.CheckDoubleSubmit(r, m.Cookie); err != nil {
+			writeAPIError(w, http.StatusForbidden, ErrorCSRFFailed, err.Error())
+			return
+		}
+	}
+	if user == "" {
+		writeAPIError(
+			w,
+			http.StatusBadRequest,
+			ErrorInvalidRequest,
+			`expected {"user": "...", "token": "..."}`,
+		)
+		return
+	}
+	if !user.IsAuthenticatedBy(pass) {
+		writeAPIError(
+			w,
+			http.StatusUnauthorized,
+			ErrorInvalidCredentials,
+			"incorrect username or password",
+		)
+		return
+	}
+	if user.HasTOTP() {
+		if err = auth.BeginSecondFactor(w, r, user, m.Cookie); err != nil {
+			log.Printf("error starting two-factor sign in for %s: %v\n", user, err)
+			writeAPIError(
+				w,
+				http.StatusInternalServerError,
+				ErrorInternal,
+				"couldn't start the sign in",
+			)
+			return
+		}
+		writeAPIError(
+			w,
+			http.StatusUnauthorized,
+			ErrorSecondFactor,
+			"enter a two-factor code to finish signing in",
+		)
+		return
+	}
+	m.apiSignIn(w, r, user)
+}
+
+// SecondFactorAPI finishes a sign-in started by LoginAPI with the code from
+// the user's authenticator app, and responds like LoginAPI. After too many
+// wrong codes the user has to start again.
+func (m *Middleware) SecondFactorAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowOnly(http.MethodPost, w, r) {
+		return
+	}
+	pending, _, ok := auth.PendingSecondFactor(r, m.Cookie)
+	if !ok {
+		writeAPIError(
+			w,
+			http.StatusUnauthorized,
+			ErrorNotSignedIn,
+			"no sign in is waiting for a two-factor code",
+		)
+		return
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	if isFormPost(r) {
+		if m.CSRF != auth.CSRFDisabled {
+			if err := auth.CheckDoubleSubmit(r, m.Cookie); err != nil {
+				writeAPIError(w, http.StatusForbidden, ErrorCSRFFailed, err.Error())
+				return
+			}
+		}
+		body.Code = r.PostFormValue(auth.TOTPField)
+	} else {
+		// a body which doesn't decode leaves the code empty
+		json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&body)
+	}
+	if body.Code == "" {
+		writeAPIError(w, http.StatusBadRequest, ErrorInvalidRequest, `expected {"code": "..."}`)
+		return
+	}
+	user, err := pending.CompleteSecondFactor(body.Code)
+	if err != nil {
+		if !pending.CurrentlyExists() {
+			auth.EndSecondFactor(w, m.Cookie)
+		}
+		writeAPIError(w, http.StatusUnauthorized, ErrorInvalidCode, err.Error())
+		return
+	}
+	auth.EndSecondFactor(w, m.Cookie)
+	m.apiSignIn(w, r, user, auth.AuthPassword, auth.AuthOTP)
+}
+
+// apiSignIn starts a session or issues a token for a user who has just
+// authenticated by the given methods, and responds with it.
+func (m *Middleware) apiSignIn(
+	w http.ResponseWriter, r *http.Request, user auth.Username, methods ...string,
+) {
+	var (
+		session  APISession
+		metadata *auth.SessionMetadata
+		err      error
+	)
+	if m.Tokens != nil {
+		var claims auth.Claims
+		_, claims, err = m.issueToken(w, user, methods...)
+		metadata = claims.Metadata()
+		session = apiSession(metadata)
+	} else {
+		var token auth.Session
+		token, metadata, err = auth.NewSessionForClient(user, r, methods...)
+		if auth.IsTooManySessions(err) {
+			writeAPIError(w, http.StatusForbidden, ErrorTooManySessions, err.Error())
+			return
+		}
+		if err == nil {
+			if err = m.setSession(w, r, token); err != nil {
+				token.Delete()
+			}
+			session = apiSession(metadata)
+		}
+	}
+	if err == nil && m.Schemes.Any().Allows(auth.SchemeBearer) {
+		var refresh string
+		refresh, err = auth.NewRefreshToken(
+			user, metadata.AuthenticatedAt, metadata.AuthMethods,
+		)
+		if err == nil {
+			session.RefreshToken = refresh
+			err = m.bearerToken(user, refresh, &session)
+		}
+	}
+	if err != nil {
+		log.Printf("error saving session for %s: %v\n", user, err)
+		writeAPIError(
+			w,
+			http.StatusInternalServerError,
+			ErrorInternal,
+			"couldn't save the session",
+		)
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// bearerToken issues a short-lived token for Bearer headers belonging to the
+// refresh token's family: a signed token if the middleware has a TokenSigner,
+// otherwise an access session.
+func (m *Middleware) bearerToken(
+	user auth.Username, refresh string, session *APISession,
+) error {
+	if m.Tokens != nil {
+		token, claims, err := auth.NewAccessTokenFor(
+			refresh, m.Tokens, m.roles(user)...,
+		)
+		if err != nil {
+			return err
+		}
+		expiry := claims.Expiry()
+		session.Token, session.TokenExpires = token, &expiry
+		return nil
+	}
+	access, metadata, err := auth.NewAccessSessionFor(refresh)
+	if err != nil {
+		return err
+	}
+	session.Token = auth.BearerToken(access, m.SignedIDs)
+	session.TokenExpires = &metadata.Expiry
+	return nil
+}
+
+// RefreshAPI exchanges a refresh token for a new Bearer token and the next
+// refresh token. Presenting a refresh token which has already been used
+// revokes every token descended from the same sign-in.
+func (m *Middleware) RefreshAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowOnly(http.MethodPost, w, r) {
+		return
+	}
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&body)
+	if err != nil || body.RefreshToken == "" {
+		writeAPIError(
+			w,
+			http.StatusBadRequest,
+			ErrorInvalidRequest,
+			`expected {"refresh_token": "..."}`,
+		)
+		return
+	}
+	user, next, err := auth.RotateRefreshToken(body.RefreshToken)
+	if auth.IsRefreshTokenReused(err) {
+		writeAPIError(w, http.StatusUnauthorized, ErrorRefreshTokenReused, err.Error())
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusUnauthorized, ErrorInvalidRefreshToken, err.Error())
+		return
+	}
+	session := APISession{User: user, RefreshToken: next}
+	if err = m.bearerToken(user, next, &session); err != nil {
+		log.Printf("error refreshing the token for %s: %v\n", user, err)
+		writeAPIError(
+			w,
+			http.StatusInternalServerError,
+			ErrorInternal,
+			"couldn't issue a new token",
+		)
+		return
+	}
+	session.Expires = *session.TokenExpires
+	writeJSON(w, http.StatusOK, session)
+}
+
+// apiCredential is what authenticated a request to the JSON API.
+type apiCredential struct {
+	// session is the current session, unless the middleware issues signed
+	// tokens
+	session  auth.Session
+	metadata *auth.SessionMetadata
+	// end signs the session or token out
+	end func()
+	// header is true if it came from a Bearer header, which can't be sent
+	// cross-site, so unsafe requests made with it aren't checked for CSRF
+	header bool
+}
+
+// checkCSRF checks an unsafe request made with the credential.
+func (c apiCredential) checkCSRF(r *http.Request, m *Middleware) error {
+	if c.header {
+		return nil
+	}
+	return auth.CheckCSRF(r, m.CSRF, m.Cookie, c.metadata)
+}
+
+// apiCurrentSession gets the request's valid session or signed token, or
+// responds with an error and returns false.
+func (m *Middleware) apiCurrentSession(
+	w http.ResponseWriter, r *http.Request,
+) (current apiCredential, ok bool) {
+	if current, ok = m.apiCredential(r); !ok {
+		writeAPIError(w, http.StatusUnauthorized, ErrorNotSignedIn, "not signed in")
+	}
+	return
+}
+
+// apiCredential gets the request's valid session or signed token. The API is
+// mounted outside SessionAuthentication, so Bearer headers are authenticated
+// here, if some route accepts them; otherwise the cookie is used. Ending a
+// Bearer token also revokes the refresh token family it was issued to.
+func (m *Middleware) apiCredential(
+	r *http.Request,
+) (current apiCredential, ok bool) {
+	current.header = m.Schemes.Any().Allows(auth.SchemeBearer) &&
+		bearerToken(r) != ""
+	if m.Tokens != nil {
+		var (
+			claims auth.Claims
+			err    error
+		)
+		if current.header {
+			claims, err = m.Tokens.Verify(bearerToken(r))
+		} else {
+			claims, err = m.currentClaims(r)
+		}
+		if err == nil {
+			current.metadata = claims.Metadata()
+			current.end = func() {
+				m.Tokens.Revoke(claims)
+				if current.header {
+					auth.RevokeRefreshTokenIssuingClaims(claims)
+				}
+			}
+			return current, true
+		}
+	} else {
+		var err error
+		if current.header {
+			current.session, err = m.bearerSession(r)
+		} else {
+			current.session, err = m.currentSession(r)
+		}
+		if err == nil {
+			metadata, exists := current.session.Touch()
+			if exists && m.Binding.Enforce(r, current.session, metadata) == nil {
+				current.metadata = metadata
+				current.end = func() {
+					current.session.Delete()
+					if current.header {
+						auth.RevokeRefreshTokenIssuing(current.session)
+					}
+				}
+				return current, true
+			}
+		}
+	}
+	return current, false
+}
+
+// bearerSession gets the session the request's Bearer header refers to.
+func (m *Middleware) bearerSession(r *http.Request) (auth.Session, error) {
+	authenticated, scheme, err := auth.AuthenticateHeader(
+		r, auth.SchemeBearer, m.SignedIDs, nil, m.Binding,
+	)
+	if err != nil {
+		return auth.Session{}, err
+	}
+	if scheme == 0 {
+		return auth.Session{}, errNoSession
+	}
+	return auth.AuthenticatedHeaderFrom(authenticated).Session, nil
+}
+
+// LogoutAPI deletes the current session, or revokes the current signed token,
+// and clears the session cookie. Signing out with a Bearer token revokes the
+// refresh token it was issued with too. A refresh token may also be sent as
+// {"refresh_token": "..."} to revoke it and everything issued with it, which
+// works even once the Bearer token has expired.
+func (m *Middleware) LogoutAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowOnly(http.MethodPost, w, r) {
+		return
+	}
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if !isFormPost(r) {
+		// the body is optional
+		json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<12)).Decode(&body)
+	}
+	// the refresh token is a secret, so a request carrying it can't have been
+	// forged cross-site
+	if body.RefreshToken != "" {
+		auth.RevokeRefreshToken(body.RefreshToken)
+	}
+	current, ok := m.apiCredential(r)
+	if !ok {
+		if body.RefreshToken != "" {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			writeAPIError(w, http.StatusUnauthorized, ErrorNotSignedIn, "not signed in")
+		}
+		return
+	}
+	if err := current.checkCSRF(r, m); err != nil {
+		writeAPIError(w, http.StatusForbidden, ErrorCSRFFailed, err.Error())
+		return
+	}
+	current.end()
+	if err := m.clearSession(w, r); err != nil {
+		log.Printf("error clearing session cookie: %v\n", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SessionAPI responds with the current session.
+func (m *Middleware) SessionAPI(w http.ResponseWriter, r *http.Request) {
+	if !allowOnly(http.MethodGet, w, r) {
+		return
+	}
+	if current, ok := m.apiCurrentSession(w, r); ok {
+		writeJSON(w, http.StatusOK, apiSession(current.metadata))
+	}
+}
+
+// SessionsAPI lists the signed-in user's sessions on GET, for showing them
+// where they're signed in; the current one is marked. DELETE signs them out
+// of the session with the given "id", or of every other session if there's
+// no id. Signed tokens aren't stored, so there's nothing to list in that mode.
+func (m *Middleware) SessionsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "GET, DELETE")
+		writeAPIError(
+			w,
+			http.StatusMethodNotAllowed,
+			ErrorMethodNotAllowed,
+			r.Method+" is not allowed, use GET or DELETE",
+		)
+		return
+	}
+	if m.Tokens != nil {
+		writeAPIError(
+			w,
+			http.StatusNotImplemented,
+			ErrorUnsupported,
+			"signed tokens can't be listed or revoked individually",
+		)
+		return
+	}
+	current, ok := m.apiCurrentSession(w, r)
+	if !ok {
+		return
+	}
+	user := current.metadata.User
+	if r.Method == http.MethodGet {
+		sessions := user.Sessions()
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == current.session.PublicID()
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Sessions []auth.SessionInfo `json:"sessions"`
+		}{sessions})
+		return
+	}
+	if err := current.checkCSRF(r, m); err != nil {
+		writeAPIError(w, http.StatusForbidden, ErrorCSRFFailed, err.Error())
+		return
+	}
+	if id := r.URL.Query().Get("id"); id == "" {
+		user.RevokeSessions(current.session)
+	} else if err := user.RevokeSession(id); err != nil {
+		writeAPIError(w, http.StatusNotFound, ErrorNoSuchSession, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
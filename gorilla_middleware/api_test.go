@@ -0,0 +1,309 @@
+package gorilla_middleware
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+)
+
+func TestJSONAPI(t *testing.T) {
+	var (
+		test   = attest.New(t)
+		signer = test.EatError(auth.NewIDSigner(
+			[]byte("test session ID signing key, 32+ bytes"),
+		)).(*auth.IDSigner)
+		api    = (&Middleware{SignedIDs: signer}).API()
+		cookie *http.Cookie
+		csrf   string
+	)
+	login := func(password string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/auth/login",
+			strings.NewReader(fmt.Sprintf(
+				`{"user": %q, "token": %q}`, testUsername, password,
+			)),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+	decodeError := func(test *attest.Test, rec *httptest.ResponseRecorder) string {
+		var body struct{ Error APIError }
+		test.Handle(json.NewDecoder(rec.Body).Decode(&body))
+		return body.Error.Code
+	}
+	t.Run("login with the wrong password", func(t *testing.T) {
+		test := attest.New(t)
+		rec := login("wrong password")
+		test.Equals(http.StatusUnauthorized, rec.Code)
+		test.Equals(ErrorInvalidCredentials, decodeError(&test, rec))
+	})
+	t.Run("login with GET", func(t *testing.T) {
+		test := attest.New(t)
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/auth/login", nil))
+		test.Equals(http.StatusMethodNotAllowed, rec.Code)
+		test.Equals(ErrorMethodNotAllowed, decodeError(&test, rec))
+	})
+	t.Run("login", func(t *testing.T) {
+		test := attest.New(t)
+		rec := login(testPassword)
+		test.Equals(http.StatusOK, rec.Code)
+		var session APISession
+		test.Handle(json.NewDecoder(rec.Body).Decode(&session))
+		test.Equals(auth.Username(testUsername), session.User)
+		test.Equals(1, len(rec.Result().Cookies()))
+		cookie, csrf = rec.Result().Cookies()[0], session.CSRFToken
+	})
+	t.Run("session", func(t *testing.T) {
+		test := attest.New(t)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/auth/session", nil)
+		req.AddCookie(cookie)
+		api.ServeHTTP(rec, req)
+		test.Equals(http.StatusOK, rec.Code)
+	})
+	t.Run("logout without a CSRF token", func(t *testing.T) {
+		test := attest.New(t)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+		req.AddCookie(cookie)
+		api.ServeHTTP(rec, req)
+		test.Equals(http.StatusForbidden, rec.Code)
+		test.Equals(ErrorCSRFFailed, decodeError(&test, rec))
+	})
+	t.Run("logout", func(t *testing.T) {
+		test := attest.New(t)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+		req.AddCookie(cookie)
+		req.Header.Set(auth.CSRFHeader, csrf)
+		api.ServeHTTP(rec, req)
+		test.Equals(http.StatusNoContent, rec.Code)
+		rec = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/auth/session", nil)
+		req.AddCookie(cookie)
+		api.ServeHTTP(rec, req)
+		test.Equals(http.StatusUnauthorized, rec.Code)
+		test.Equals(ErrorNotSignedIn, decodeError(&test, rec))
+	})
+}
+
+func TestRefreshAPI(t *testing.T) {
+	var (
+		test    = attest.New(t)
+		schemes = new(auth.SchemePolicy)
+		api     = (&Middleware{Schemes: schemes}).API()
+	)
+	test.Handle(schemes.Allow("/api/", auth.SchemeBearer))
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+	decode := func(test *attest.Test, rec *httptest.ResponseRecorder) APISession {
+		var session APISession
+		test.Equals(http.StatusOK, rec.Code)
+		test.Handle(json.NewDecoder(rec.Body).Decode(&session))
+		return session
+	}
+	login := decode(&test, post("/auth/login", fmt.Sprintf(
+		`{"user": %q, "token": %q}`, testUsername, testPassword,
+	)))
+	test.NotEqual("", login.Token)
+	test.NotEqual("", login.RefreshToken)
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return post("/auth/refresh", fmt.Sprintf(`{"refresh_token": %q}`, token))
+	}
+	refreshed := decode(&test, refresh(login.RefreshToken))
+	test.NotEqual(login.Token, refreshed.Token)
+	test.NotEqual(login.RefreshToken, refreshed.RefreshToken)
+	rec := refresh(login.RefreshToken)
+	test.Equals(http.StatusUnauthorized, rec.Code)
+	var body struct{ Error APIError }
+	test.Handle(json.NewDecoder(rec.Body).Decode(&body))
+	test.Equals(ErrorRefreshTokenReused, body.Error.Code)
+	test.Equals(http.StatusUnauthorized, refresh(refreshed.RefreshToken).Code)
+}
+
+func TestSessionsAPI(t *testing.T) {
+	var (
+		test = attest.New(t)
+		api  = (&Middleware{}).API()
+	)
+	login := func() (*http.Cookie, string) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/auth/login",
+			strings.NewReader(fmt.Sprintf(
+				`{"user": %q, "token": %q}`, testUsername, testPassword,
+			)),
+		)
+		req.Header.Set("Content-Type", "application/json")
+		api.ServeHTTP(rec, req)
+		test.Equals(http.StatusOK, rec.Code)
+		var session APISession
+		test.Handle(json.NewDecoder(rec.Body).Decode(&session))
+		return rec.Result().Cookies()[0], session.CSRFToken
+	}
+	request := func(method, target string, cookie *http.Cookie, csrf string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, nil)
+		req.AddCookie(cookie)
+		req.Header.Set(auth.CSRFHeader, csrf)
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+	list := func(cookie *http.Cookie) []auth.SessionInfo {
+		rec := request(http.MethodGet, "/auth/sessions", cookie, "")
+		test.Equals(http.StatusOK, rec.Code)
+		var body struct{ Sessions []auth.SessionInfo }
+		test.Handle(json.NewDecoder(rec.Body).Decode(&body))
+		return body.Sessions
+	}
+	first, csrf := login()
+	second, _ := login()
+	third, _ := login()
+	sessions := list(first)
+	current := 0
+	for _, s := range sessions {
+		if s.Current {
+			current++
+		}
+	}
+	test.Equals(1, current)
+	test.Attest(len(sessions) >= 3, "expected at least 3 sessions, got %d", len(sessions))
+
+	var secondID string
+	for _, s := range list(second) {
+		if s.Current {
+			secondID = s.ID
+		}
+	}
+	test.Equals(
+		http.StatusForbidden,
+		request(http.MethodDelete, "/auth/sessions?id="+secondID, first, "").Code,
+	)
+	test.Equals(
+		http.StatusNoContent,
+		request(http.MethodDelete, "/auth/sessions?id="+secondID, first, csrf).Code,
+	)
+	test.Equals(http.StatusUnauthorized, request(http.MethodGet, "/auth/sessions", second, "").Code)
+	test.Equals(
+		http.StatusNotFound,
+		request(http.MethodDelete, "/auth/sessions?id="+secondID, first, csrf).Code,
+	)
+	test.Equals(
+		http.StatusNoContent,
+		request(http.MethodDelete, "/auth/sessions", first, csrf).Code,
+	)
+	test.Equals(http.StatusUnauthorized, request(http.MethodGet, "/auth/sessions", third, "").Code)
+	test.Equals(1, len(list(first)))
+}
+
+func TestBearerAPI(t *testing.T) {
+	var (
+		test    = attest.New(t)
+		schemes = new(auth.SchemePolicy)
+		api     = (&Middleware{Schemes: schemes}).API()
+	)
+	test.Handle(schemes.Allow("/api/", auth.SchemeBearer))
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(
+		http.MethodPost,
+		"/auth/login",
+		strings.NewReader(fmt.Sprintf(
+			`{"user": %q, "token": %q}`, testUsername, testPassword,
+		)),
+	)
+	req.Header.Set("Content-Type", "application/json")
+	api.ServeHTTP(rec, req)
+	test.Equals(http.StatusOK, rec.Code)
+	var login APISession
+	test.Handle(json.NewDecoder(rec.Body).Decode(&login))
+	// a mobile client only keeps the token, not the cookie
+	request := func(method, target, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+	test.Equals(http.StatusOK, request(http.MethodGet, "/auth/session", login.Token).Code)
+	test.Equals(http.StatusOK, request(http.MethodGet, "/auth/sessions", login.Token).Code)
+	test.Equals(
+		http.StatusUnauthorized,
+		request(http.MethodGet, "/auth/session", "not a token").Code,
+	)
+	test.Equals(http.StatusNoContent, request(http.MethodPost, "/auth/logout", login.Token).Code)
+	test.Equals(
+		http.StatusUnauthorized,
+		request(http.MethodGet, "/auth/session", login.Token).Code,
+	)
+}
+
+func TestLogoutAPIRevokesRefreshTokens(t *testing.T) {
+	var (
+		test    = attest.New(t)
+		schemes = new(auth.SchemePolicy)
+		api     = (&Middleware{Schemes: schemes}).API()
+	)
+	test.Handle(schemes.Allow("/api/", auth.SchemeBearer))
+	post := func(path, body, token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		api.ServeHTTP(rec, req)
+		return rec
+	}
+	login := func(test *attest.Test) APISession {
+		rec := post("/auth/login", fmt.Sprintf(
+			`{"user": %q, "token": %q}`, testUsername, testPassword,
+		), "")
+		test.Equals(http.StatusOK, rec.Code)
+		var session APISession
+		test.Handle(json.NewDecoder(rec.Body).Decode(&session))
+		return session
+	}
+	refresh := func(token string) int {
+		return post(
+			"/auth/refresh", fmt.Sprintf(`{"refresh_token": %q}`, token), "",
+		).Code
+	}
+	t.Run("with the Bearer token", func(t *testing.T) {
+		test := attest.New(t)
+		session := login(&test)
+		test.Equals(http.StatusNoContent, post("/auth/logout", "", session.Token).Code)
+		test.Equals(http.StatusUnauthorized, refresh(session.RefreshToken))
+	})
+	t.Run("with the refresh token", func(t *testing.T) {
+		test := attest.New(t)
+		session := login(&test)
+		rec := post(
+			"/auth/logout",
+			fmt.Sprintf(`{"refresh_token": %q}`, session.RefreshToken),
+			"",
+		)
+		test.Equals(http.StatusNoContent, rec.Code)
+		test.Equals(http.StatusUnauthorized, refresh(session.RefreshToken))
+		rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/auth/session", nil)
+		req.Header.Set("Authorization", "Bearer "+session.Token)
+		api.ServeHTTP(rec, req)
+		test.Equals(http.StatusUnauthorized, rec.Code)
+	})
+}
@@ -0,0 +1,141 @@
+package gorilla_middleware
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+)
+
+// Config holds the settings for a Middleware created by New.
+type Config struct {
+	// Keyring holds the keys the session cookies are signed and encrypted
+	// with. Required unless SignedIDs or Tokens is set. To rotate them, call
+	// StartKeyRotation on the created Middleware.
+	Keyring *Keyring
+	// LoginHandler is called when authentication fails. Defaults to
+	// responding "401 Unauthorized".
+	LoginHandler http.HandlerFunc
+	// LogoutHandler responds once Logout has signed the user out. Defaults to
+	// responding "204 No Content".
+	LogoutHandler http.HandlerFunc
+	// SecondFactorHandler asks for a two-factor code. Defaults to responding
+	// "401 Unauthorized".
+	SecondFactorHandler http.HandlerFunc
+	// Cookie configures the attributes of the session cookie.
+	Cookie auth.CookieOptions
+	// SignedIDs, if set, makes the cookie carry only the session's signed ID.
+	// See Middleware.SignedIDs.
+	SignedIDs *auth.IDSigner
+	// CSRF selects how unsafe requests are protected from cross-site request
+	// forgery. Defaults to auth.CSRFSynchronizer.
+	CSRF auth.CSRFMode
+	// Credentials reads sign-in credentials from requests. Defaults to the
+	// zero auth.CredentialPolicy, which only accepts credentials POSTed over
+	// TLS.
+	Credentials auth.CredentialExtractor
+	// Schemes chooses how requests to each route may be authenticated.
+	// Defaults to only accepting session cookies.
+	Schemes *auth.SchemePolicy
+	// Tokens, if set, makes the middleware issue and verify signed tokens
+	// instead of sessions. See Middleware.Tokens.
+	Tokens *auth.TokenSigner
+	// Roles gets the roles to put in a user's signed tokens.
+	Roles func(auth.Username) []string
+	// Binding, if set, binds sessions to attributes of the client which
+	// started them.
+	Binding *auth.BindingPolicy
+}
+
+// New creates a Middleware from the given config. Nothing is read from the
+// environment or the filesystem; see ConfigFromEnv and LoadKeyring for that.
+func New(config Config) (*Middleware, error) {
+	if err := config.Cookie.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid session cookie options: %v", err)
+	}
+	m := &Middleware{
+		LoginHandler:        config.LoginHandler,
+		LogoutHandler:       config.LogoutHandler,
+		SecondFactorHandler: config.SecondFactorHandler,
+		Cookie:              config.Cookie,
+		SignedIDs:           config.SignedIDs,
+		CSRF:                config.CSRF,
+		Credentials:         config.Credentials,
+		Schemes:             config.Schemes,
+		Tokens:              config.Tokens,
+		Roles:               config.Roles,
+		Binding:             config.Binding,
+	}
+	if m.LoginHandler == nil {
+		m.LoginHandler = unauthorizedHandler
+	}
+	if m.LogoutHandler == nil {
+		m.LogoutHandler = loggedOutHandler
+	}
+	if m.SecondFactorHandler == nil {
+		m.SecondFactorHandler = secondFactorRequiredHandler
+	}
+	if m.Credentials == nil {
+		m.Credentials = new(auth.CredentialPolicy)
+	}
+	if config.Keyring != nil {
+		if len(config.Keyring.Pairs) == 0 {
+			return nil, fmt.Errorf("the keyring has no keys")
+		}
+		m.store = config.Keyring.CookieStore()
+	} else if config.SignedIDs == nil && config.Tokens == nil {
+		return nil, fmt.Errorf("a Keyring, SignedIDs or Tokens is required")
+	}
+	return m, nil
+}
+
+// DefaultKeyringLocation is where the cookie keys are stored unless
+// configured otherwise: session.key in $XDG_CONFIG_HOME or ~/.config.
+func DefaultKeyringLocation() string {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		configDir = path.Join(os.Getenv("HOME"), ".config")
+	}
+	return path.Join(configDir, "go-middleware-session-auth", "session.key")
+}
+
+// LoadKeyring reads the keyring at the given location, creating a new one
+// there if it doesn't exist yet.
+func LoadKeyring(keyfile string) (*Keyring, error) {
+	keyring, err := ReadKeyring(keyfile)
+	if os.IsNotExist(err) {
+		return RotateKeyfile(keyfile, 0)
+	}
+	return keyring, err
+}
+
+// ConfigFromEnv creates a Config with the keyring named by the environment:
+// it's read from the file named by $go_middleware_session_key_file, or made
+// from the key in $go_middleware_session_key, or loaded (and created if
+// necessary) from DefaultKeyringLocation.
+func ConfigFromEnv() (config Config, err error) {
+	if keyfile := os.Getenv("go_middleware_session_key_file"); keyfile != "" {
+		config.Keyring, err = ReadKeyring(keyfile)
+		if err != nil {
+			err = fmt.Errorf(`error reading file at "%s": %v`, keyfile, err)
+		}
+		return
+	}
+	if keyString := os.Getenv("go_middleware_session_key"); keyString != "" {
+		config.Keyring = &Keyring{Pairs: []KeyPair{{Hash: []byte(keyString)}}}
+		return
+	}
+	keyfile := DefaultKeyringLocation()
+	config.Keyring, err = LoadKeyring(keyfile)
+	if err != nil {
+		err = fmt.Errorf(
+			"couldn't find a session key or create one at the default "+
+				`location, "%s": %v`,
+			keyfile,
+			err,
+		)
+	}
+	return
+}
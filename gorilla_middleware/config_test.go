@@ -0,0 +1,78 @@
+package gorilla_middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+)
+
+func TestNew(t *testing.T) {
+	t.Run("without keys", func(t *testing.T) {
+		test := attest.New(t)
+		_, err := New(Config{})
+		test.NotNil(err, "got nil error creating a middleware without keys")
+	})
+	t.Run("with invalid cookie options", func(t *testing.T) {
+		test := attest.New(t)
+		keyring := test.EatError(NewKeyring()).(*Keyring)
+		_, err := New(Config{
+			Keyring: keyring,
+			Cookie:  auth.CookieOptions{HostPrefix: true, Domain: "example.com"},
+		})
+		test.NotNil(err, "got nil error with invalid cookie options")
+	})
+	t.Run("with a new keyring", func(t *testing.T) {
+		test := attest.New(t)
+		keyfile := path.Join(os.TempDir(), "go-middleware-session-auth.test.new")
+		defer os.Remove(keyfile)
+		keyring := test.EatError(LoadKeyring(keyfile)).(*Keyring)
+		_, err := os.Stat(keyfile)
+		test.Handle(err)
+		m := test.EatError(New(Config{Keyring: keyring})).(*Middleware)
+		test.NotNil(m.store, "middleware had no cookie store")
+		test.NotNil(m.LoginHandler, "middleware had no login handler")
+	})
+}
+
+func TestMiddlewareWithoutCookieStore(t *testing.T) {
+	storeLock.Lock()
+	saved := store
+	store = nil
+	storeLock.Unlock()
+	defer func() {
+		storeLock.Lock()
+		store = saved
+		storeLock.Unlock()
+	}()
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	t.Run("with signed IDs", func(t *testing.T) {
+		test := attest.New(t)
+		signer := test.EatError(auth.NewIDSigner(
+			[]byte("test session ID signing key, 32+ bytes"),
+		)).(*auth.IDSigner)
+		mw := &Middleware{SignedIDs: signer, LoginHandler: unauthorizedHandler}
+		rec := httptest.NewRecorder()
+		mw.SessionAuthentication()(next).ServeHTTP(
+			rec,
+			httptest.NewRequest(http.MethodGet, "/", nil),
+		)
+		test.Equals(http.StatusUnauthorized, rec.Code)
+	})
+	t.Run("misconfigured", func(t *testing.T) {
+		test := attest.New(t)
+		mw := new(Middleware)
+		rec := httptest.NewRecorder()
+		mw.SessionAuthentication()(next).ServeHTTP(
+			rec,
+			httptest.NewRequest(http.MethodGet, "/", nil),
+		)
+		test.Equals(http.StatusInternalServerError, rec.Code)
+		_, err := mw.getSession(httptest.NewRequest(http.MethodGet, "/", nil))
+		test.Equals(errNoStore, err)
+	})
+}
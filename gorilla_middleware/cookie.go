@@ -0,0 +1,116 @@
+package gorilla_middleware
+
+import (
+	"fmt"
+	"net/http"
+
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+	"github.com/gorilla/sessions"
+)
+
+// errNoSession is returned by currentSession when the request doesn't
+// reference a session at all.
+var errNoSession = fmt.Errorf("no session cookie")
+
+// sessionContextKey holds the session started by signing in during the
+// request, whose cookie is only in the response.
+type sessionContextKey struct{}
+
+// errNoStore is returned when a Middleware which needs a cookie store has
+// neither its own nor the package-level one.
+var errNoStore = fmt.Errorf(
+	"no cookie store; create the middleware with New, or call UseKeyring",
+)
+
+// getSession gets the session stored in this instance's cookie.
+func (m *Middleware) getSession(r *http.Request) (*sessions.Session, error) {
+	store := m.cookieStore()
+	if store == nil {
+		return nil, errNoStore
+	}
+	return store.Get(r, m.Cookie.CookieName())
+}
+
+// saveSession writes the session to the cookie with this instance's options.
+func (m *Middleware) saveSession(
+	w http.ResponseWriter, r *http.Request, session *sessions.Session,
+) error {
+	session.Options = m.Cookie.SessionsOptions()
+	return session.Save(r, w)
+}
+
+// currentSession gets the auth.Session the request's cookie or Bearer token
+// refers to. It doesn't check whether the session is still valid.
+func (m *Middleware) currentSession(r *http.Request) (auth.Session, error) {
+	if token, ok := r.Context().Value(sessionContextKey{}).(auth.Session); ok {
+		return token, nil
+	}
+	if header := auth.AuthenticatedHeaderFrom(r); header != nil &&
+		header.Scheme == auth.SchemeBearer {
+		return header.Session, nil
+	}
+	if m.SignedIDs != nil {
+		cookie, err := r.Cookie(m.Cookie.CookieName())
+		if err == http.ErrNoCookie {
+			return auth.Session{}, errNoSession
+		} else if err != nil {
+			return auth.Session{}, err
+		}
+		return m.SignedIDs.Parse(cookie.Value)
+	}
+	session, err := m.getSession(r)
+	if err != nil {
+		return auth.Session{}, err
+	}
+	if token, ok := sessionFrom(session.Values[UserAuthSessionKey]); ok {
+		return token, nil
+	}
+	return auth.Session{}, errNoSession
+}
+
+// setSession stores a reference to the given auth.Session in the response's
+// cookie.
+func (m *Middleware) setSession(
+	w http.ResponseWriter, r *http.Request, token auth.Session,
+) error {
+	if m.SignedIDs != nil {
+		http.SetCookie(w, m.Cookie.Cookie(m.SignedIDs.Sign(token)))
+		return nil
+	}
+	session, err := m.getSession(r)
+	if err != nil {
+		return err
+	}
+	session.Values[UserAuthSessionKey] = token
+	return m.saveSession(w, r, session)
+}
+
+// sessionFrom gets the auth.Session out of a session value, which is a pointer
+// after being decoded from a cookie.
+func sessionFrom(value interface{}) (auth.Session, bool) {
+	switch token := value.(type) {
+	case auth.Session:
+		return token, true
+	case *auth.Session:
+		if token != nil {
+			return *token, true
+		}
+	}
+	return auth.Session{}, false
+}
+
+// clearSession tells the browser to delete the session cookie.
+func (m *Middleware) clearSession(w http.ResponseWriter, r *http.Request) error {
+	if m.SignedIDs != nil || m.Tokens != nil {
+		http.SetCookie(w, m.Cookie.ExpiredCookie())
+		return nil
+	}
+	session, err := m.getSession(r)
+	if err != nil {
+		return err
+	}
+	delete(session.Values, UserAuthSessionKey)
+	session.Options = m.Cookie.SessionsOptions()
+	session.Options.MaxAge = -1
+	return session.Save(r, w)
+}
@@ -0,0 +1,58 @@
+package gorilla_middleware
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+)
+
+// CSRFToken gets the token which must accompany unsafe requests, for
+// embedding in forms or handing to scripts. For signed-in users in
+// synchronizer mode it's their session's token; otherwise it's the value of
+// the double-submit cookie, which is set on the response if necessary.
+func (m *Middleware) CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if m.CSRF == auth.CSRFSynchronizer && m.Tokens != nil {
+		// the token may have been renewed since the request was made
+		if claims := auth.ClaimsFrom(r); claims != nil {
+			return claims.CSRFToken, nil
+		}
+		if claims, err := m.currentClaims(r); err == nil {
+			return claims.CSRFToken, nil
+		}
+	} else if m.CSRF == auth.CSRFSynchronizer {
+		if token, err := m.currentSession(r); err == nil {
+			if metadata, exists := token.GetMetadata(); exists {
+				return metadata.CSRFToken, nil
+			}
+		}
+	}
+	return auth.EnsureCSRFCookie(w, r, m.Cookie)
+}
+
+// CSRFTemplateField renders a hidden form field holding the CSRF token, for
+// use in login and form templates. It must be called before the response
+// body is written, as it may need to set a cookie.
+func (m *Middleware) CSRFTemplateField(
+	w http.ResponseWriter, r *http.Request,
+) template.HTML {
+	token, err := m.CSRFToken(w, r)
+	if err != nil {
+		log.Printf("error getting CSRF token for %s: %v\n", r.URL.String(), err)
+		return ""
+	}
+	return auth.CSRFTemplateField(token)
+}
+
+// CSRFToken gets the CSRF token for the package-level middleware. See
+// Middleware.CSRFToken.
+func CSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	return defaultMiddleware.CSRFToken(w, r)
+}
+
+// CSRFTemplateField renders a hidden form field holding the package-level
+// middleware's CSRF token. See Middleware.CSRFTemplateField.
+func CSRFTemplateField(w http.ResponseWriter, r *http.Request) template.HTML {
+	return defaultMiddleware.CSRFTemplateField(w, r)
+}
@@ -0,0 +1,343 @@
+package gorilla_middleware
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// keyringHeader marks a keyring file, as opposed to a legacy file
+	// containing a single raw key.
+	keyringHeader = "go-middleware-session-auth keyring v1\n"
+	// 256 bits each
+	hashKeyLength  = 32
+	blockKeyLength = 32
+)
+
+var (
+	// storeLock guards swapping the cookie store after a key rotation
+	storeLock sync.RWMutex
+	// how frequently to check whether the keys are due for rotation
+	keyRotationCheckInterval = time.Hour
+	keyRotationQuitter       chan bool
+	keyRotationLock          sync.Mutex
+)
+
+// KeyPair is one generation of cookie keys. Hash authenticates cookies and
+// Block encrypts them; Block may be empty for keys carried over from a
+// single-key session.key file, in which case cookies are only authenticated.
+type KeyPair struct {
+	Hash, Block []byte
+	Created     time.Time
+	// Retires is when the pair stops being accepted. It's zero for the
+	// current pair.
+	Retires time.Time
+}
+
+// NewKeyPair generates a new random key pair.
+func NewKeyPair() (pair KeyPair, err error) {
+	pair.Hash = make([]byte, hashKeyLength)
+	pair.Block = make([]byte, blockKeyLength)
+	if _, err = io.ReadFull(rand.Reader, pair.Hash); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(rand.Reader, pair.Block); err != nil {
+		return
+	}
+	pair.Created = time.Now()
+	return
+}
+
+// Keyring holds the current cookie key pair, which signs and encrypts new
+// cookies, followed by older pairs which are still accepted until they
+// retire, so that rotating keys doesn't sign everyone out.
+type Keyring struct {
+	Pairs []KeyPair
+}
+
+// NewKeyring creates a keyring with a single new key pair.
+func NewKeyring() (*Keyring, error) {
+	pair, err := NewKeyPair()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a cookie key pair: %v", err)
+	}
+	return &Keyring{Pairs: []KeyPair{pair}}, nil
+}
+
+// ReadKeyring reads a keyring saved by Keyring.Save. Files which contain a
+// single raw key, as written by earlier versions, are read as a keyring
+// holding just that key.
+func ReadKeyring(keyfile string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(keyringHeader)) {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("key file %s is empty", keyfile)
+		}
+		return &Keyring{Pairs: []KeyPair{{Hash: data}}}, nil
+	}
+	keyring := new(Keyring)
+	err = gob.NewDecoder(
+		bytes.NewReader(data[len(keyringHeader):]),
+	).Decode(keyring)
+	if err != nil {
+		return nil, fmt.Errorf(`error parsing keyring at "%s": %v`, keyfile, err)
+	}
+	if len(keyring.Pairs) == 0 {
+		return nil, fmt.Errorf(`keyring at "%s" has no keys`, keyfile)
+	}
+	return keyring, nil
+}
+
+// Save the keyring to the given file, readable only by its owner. The file is
+// replaced atomically, so a running server never reads half a keyring.
+func (k *Keyring) Save(keyfile string) error {
+	var buf bytes.Buffer
+	buf.WriteString(keyringHeader)
+	if err := gob.NewEncoder(&buf).Encode(k); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(keyfile), 0700); err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(path.Dir(keyfile), ".session.key.")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err = temp.Write(buf.Bytes()); err != nil {
+		temp.Close()
+		return err
+	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), keyfile)
+}
+
+// Current is the pair new cookies are created with.
+func (k *Keyring) Current() KeyPair {
+	return k.Pairs[0]
+}
+
+// Rotate generates a new current key pair. The previous pairs are still
+// accepted for the grace period, which should be at least as long as cookies
+// last, and pairs whose grace period is over are dropped.
+func (k *Keyring) Rotate(grace time.Duration) error {
+	pair, err := NewKeyPair()
+	if err != nil {
+		return fmt.Errorf("failed to generate a cookie key pair: %v", err)
+	}
+	retires := time.Now().Add(grace)
+	for i := range k.Pairs {
+		if k.Pairs[i].Retires.IsZero() || k.Pairs[i].Retires.After(retires) {
+			k.Pairs[i].Retires = retires
+		}
+	}
+	k.Pairs = append([]KeyPair{pair}, k.Pairs...)
+	k.Prune()
+	return nil
+}
+
+// Prune drops retired key pairs, and returns the number dropped. The current
+// pair is never dropped.
+func (k *Keyring) Prune() (dropped int) {
+	kept := k.Pairs[:1]
+	for _, pair := range k.Pairs[1:] {
+		if !pair.Retires.IsZero() && pair.Retires.Before(time.Now()) {
+			dropped++
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	k.Pairs = kept
+	return
+}
+
+// keyPairs lists the keys in the order sessions.NewCookieStore expects
+func (k *Keyring) keyPairs() (pairs [][]byte) {
+	for _, pair := range k.Pairs {
+		if !pair.Retires.IsZero() && pair.Retires.Before(time.Now()) {
+			continue
+		}
+		pairs = append(pairs, pair.Hash, pair.Block)
+	}
+	return
+}
+
+// CookieStore creates a cookie store which signs with the current key pair and
+// accepts cookies signed with any unretired pair.
+func (k *Keyring) CookieStore() *sessions.CookieStore {
+	return sessions.NewCookieStore(k.keyPairs()...)
+}
+
+// UseKeyring replaces the cookie store used by the package with one based on
+// the given keyring. Instances created by New have their own cookie store; see
+// Middleware.UseKeyring.
+func UseKeyring(keyring *Keyring) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	store = keyring.CookieStore()
+}
+
+// UseKeyring replaces this instance's cookie store with one based on the given
+// keyring.
+func (m *Middleware) UseKeyring(keyring *Keyring) {
+	storeLock.Lock()
+	defer storeLock.Unlock()
+	m.store = keyring.CookieStore()
+}
+
+func cookieStore() *sessions.CookieStore {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	return store
+}
+
+// cookieStore gets this instance's cookie store, or the package-level one if
+// it doesn't have its own.
+func (m *Middleware) cookieStore() *sessions.CookieStore {
+	storeLock.RLock()
+	defer storeLock.RUnlock()
+	if m.store != nil {
+		return m.store
+	}
+	return store
+}
+
+// RotateKeyfile rotates the keyring saved at the given location in place,
+// creating it if it doesn't exist yet.
+func RotateKeyfile(keyfile string, grace time.Duration) (*Keyring, error) {
+	keyring, err := ReadKeyring(keyfile)
+	if os.IsNotExist(err) {
+		keyring, err = NewKeyring()
+		if err != nil {
+			return nil, err
+		}
+		return keyring, keyring.Save(keyfile)
+	} else if err != nil {
+		return nil, err
+	}
+	if err = keyring.Rotate(grace); err != nil {
+		return nil, err
+	}
+	return keyring, keyring.Save(keyfile)
+}
+
+// StartKeyRotation periodically re-reads the keyring at the given location,
+// rotates it once the current key pair is older than interval, keeping old
+// pairs for the grace period, and swaps in the resulting cookie store.
+// Rotations done by other processes, e.g. the update command, are picked up
+// the same way. This rotates the package-level cookie store; instances created
+// by New need Middleware.StartKeyRotation.
+func StartKeyRotation(keyfile string, interval, grace time.Duration) error {
+	return startKeyRotation(
+		&keyRotationQuitter, keyfile, interval, grace, UseKeyring,
+	)
+}
+
+// StopKeyRotation stops the rotation started by StartKeyRotation, if any.
+func StopKeyRotation() {
+	stopKeyRotation(&keyRotationQuitter)
+}
+
+// StartKeyRotation is like the package-level StartKeyRotation, but swaps in
+// this instance's cookie store.
+func (m *Middleware) StartKeyRotation(
+	keyfile string, interval, grace time.Duration,
+) error {
+	return startKeyRotation(
+		&m.keyRotationQuitter, keyfile, interval, grace, m.UseKeyring,
+	)
+}
+
+// StopKeyRotation stops the rotation started by this instance's
+// StartKeyRotation, if any.
+func (m *Middleware) StopKeyRotation() {
+	stopKeyRotation(&m.keyRotationQuitter)
+}
+
+func startKeyRotation(
+	quitter *chan bool,
+	keyfile string,
+	interval, grace time.Duration,
+	use func(*Keyring),
+) error {
+	keyRotationLock.Lock()
+	defer keyRotationLock.Unlock()
+	if *quitter != nil {
+		return fmt.Errorf("key rotation has already been started")
+	}
+	if err := checkKeyRotation(keyfile, interval, grace, use); err != nil {
+		return err
+	}
+	*quitter = make(chan bool)
+	go rotateKeys(keyfile, interval, grace, use, *quitter)
+	return nil
+}
+
+func stopKeyRotation(quitter *chan bool) {
+	keyRotationLock.Lock()
+	defer keyRotationLock.Unlock()
+	if *quitter != nil {
+		close(*quitter)
+		*quitter = nil
+	}
+}
+
+func rotateKeys(
+	keyfile string,
+	interval, grace time.Duration,
+	use func(*Keyring),
+	quit chan bool,
+) {
+	checkInterval := keyRotationCheckInterval
+	if interval/10 < checkInterval {
+		checkInterval = interval / 10
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for /*ever*/ {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			err := checkKeyRotation(keyfile, interval, grace, use)
+			if err != nil {
+				log.Printf("WARNING failed to rotate cookie keys: %v", err)
+			}
+		}
+	}
+}
+
+func checkKeyRotation(
+	keyfile string, interval, grace time.Duration, use func(*Keyring),
+) error {
+	keyring, err := ReadKeyring(keyfile)
+	if err != nil {
+		return err
+	}
+	if time.Since(keyring.Current().Created) >= interval {
+		if err = keyring.Rotate(grace); err != nil {
+			return err
+		}
+		if err = keyring.Save(keyfile); err != nil {
+			return err
+		}
+	}
+	use(keyring)
+	return nil
+}
@@ -0,0 +1,105 @@
+package gorilla_middleware
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+	"github.com/gorilla/securecookie"
+)
+
+func TestKeyring(t *testing.T) {
+	var (
+		test    = attest.New(t)
+		keyfile = path.Join(os.TempDir(), "go-middleware-session-auth.test.keys")
+	)
+	os.Remove(keyfile)
+	defer os.Remove(keyfile)
+	keyring := test.EatError(RotateKeyfile(keyfile, time.Hour)).(*Keyring)
+	test.Equals(1, len(keyring.Pairs))
+	oldCookie := test.EatError(securecookie.EncodeMulti(
+		SessionTokenCookie, "test value", keyring.CookieStore().Codecs...,
+	)).(string)
+	t.Run("rotation keeps old keys for the grace period", func(t *testing.T) {
+		test := attest.New(t)
+		keyring := test.EatError(RotateKeyfile(keyfile, time.Hour)).(*Keyring)
+		test.Equals(2, len(keyring.Pairs))
+		read := test.EatError(ReadKeyring(keyfile)).(*Keyring)
+		test.Equals(2, len(read.Pairs))
+		test.Attest(
+			bytes.Equal(keyring.Current().Hash, read.Current().Hash),
+			"the current key changed when it was read back",
+		)
+		var value string
+		test.Handle(securecookie.DecodeMulti(
+			SessionTokenCookie, oldCookie, &value, read.CookieStore().Codecs...,
+		))
+		test.Equals("test value", value)
+	})
+	t.Run("retired keys are dropped", func(t *testing.T) {
+		test := attest.New(t)
+		keyring := test.EatError(ReadKeyring(keyfile)).(*Keyring)
+		test.Handle(keyring.Rotate(-time.Second))
+		test.Equals(1, len(keyring.Pairs))
+		var value string
+		err := securecookie.DecodeMulti(
+			SessionTokenCookie, oldCookie, &value, keyring.CookieStore().Codecs...,
+		)
+		test.NotNil(err, "cookie signed by a retired key was accepted")
+	})
+	t.Run("legacy single-key file", func(t *testing.T) {
+		test := attest.New(t)
+		test.Handle(ioutil.WriteFile(keyfile, []byte("test session key"), 0600))
+		keyring := test.EatError(ReadKeyring(keyfile)).(*Keyring)
+		test.Equals(1, len(keyring.Pairs))
+		test.Equals("test session key", string(keyring.Current().Hash))
+	})
+}
+
+func TestMiddlewareKeyRotation(t *testing.T) {
+	var (
+		test    = attest.New(t)
+		keyfile = path.Join(os.TempDir(), "go-middleware-session-auth.test.mwkeys")
+	)
+	os.Remove(keyfile)
+	defer os.Remove(keyfile)
+	keyring := test.EatError(LoadKeyring(keyfile)).(*Keyring)
+	m := test.EatError(New(Config{Keyring: keyring})).(*Middleware)
+	defer m.StopKeyRotation()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, _ := m.getSession(req)
+	session.Values["test"] = "test value"
+	rec := httptest.NewRecorder()
+	test.Handle(m.saveSession(rec, req, session))
+	oldCookie := rec.Result().Cookies()[0]
+	readOldCookie := func() error {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(oldCookie)
+		_, err := m.getSession(req)
+		return err
+	}
+	test.Handle(readOldCookie())
+
+	t.Run("old keys are accepted for the grace period", func(t *testing.T) {
+		test := attest.New(t)
+		test.EatError(RotateKeyfile(keyfile, time.Hour))
+		test.Handle(m.StartKeyRotation(keyfile, time.Hour, time.Hour))
+		test.Handle(readOldCookie())
+	})
+	t.Run("retired keys are dropped", func(t *testing.T) {
+		test := attest.New(t)
+		m.StopKeyRotation()
+		test.EatError(RotateKeyfile(keyfile, -time.Second))
+		test.Handle(m.StartKeyRotation(keyfile, time.Hour, time.Hour))
+		test.NotNil(
+			readOldCookie(),
+			"an instance accepted a cookie signed by a retired key",
+		)
+	})
+}
@@ -0,0 +1,69 @@
+package gorilla_middleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+)
+
+func loggedOutHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *Middleware) logoutHandler() http.HandlerFunc {
+	if m.LogoutHandler != nil {
+		return m.LogoutHandler
+	}
+	return LogoutHandler
+}
+
+// Logout signs the user out: it deletes their session, or revokes their
+// signed token, clears the session cookie, and calls the LogoutHandler. Only
+// POST requests are accepted, so that links and images on other sites can't
+// sign users out, and they're checked for CSRF like any other unsafe
+// request. Mount it outside SessionAuthentication:
+//
+//	router.HandleFunc("/logout", mw.Logout).Methods(http.MethodPost)
+func (m *Middleware) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "%d %s", http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	var (
+		metadata *auth.SessionMetadata
+		end      func()
+	)
+	if m.Tokens != nil {
+		if claims, err := m.currentClaims(r); err == nil {
+			metadata = claims.Metadata()
+			end = func() { m.Tokens.Revoke(claims) }
+		}
+	} else if token, err := m.currentSession(r); err == nil {
+		if current, exists := token.GetMetadata(); exists {
+			metadata, end = current, token.Delete
+		}
+	}
+	// without a session there's nothing to protect, so just clear the cookie
+	if metadata != nil {
+		if err := auth.CheckCSRF(r, m.CSRF, m.Cookie, metadata); err != nil {
+			log.Printf("rejecting logout for %s: %v\n", metadata.User, err)
+			auth.CSRFFailed(w, r)
+			return
+		}
+		end()
+	}
+	if err := m.clearSession(w, r); err != nil {
+		log.Printf("error clearing session cookie: %v\n", err)
+	}
+	m.logoutHandler()(w, r)
+}
+
+// Logout signs the user out using the package-level settings. See
+// Middleware.Logout.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	defaultMiddleware.Logout(w, r)
+}
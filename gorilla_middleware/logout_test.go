@@ -0,0 +1,87 @@
+package gorilla_middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+)
+
+func TestLogout(t *testing.T) {
+	var (
+		test   = attest.New(t)
+		signer = test.EatError(auth.NewIDSigner(
+			[]byte("test session ID signing key, 32+ bytes"),
+		)).(*auth.IDSigner)
+		loggedOut bool
+		mw        = &Middleware{
+			SignedIDs:    signer,
+			LoginHandler: unauthorizedHandler,
+			LogoutHandler: func(w http.ResponseWriter, r *http.Request) {
+				loggedOut = true
+				http.Redirect(w, r, "/", http.StatusSeeOther)
+			},
+		}
+		handler = mw.sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		).ServeHTTP
+	)
+	rec, req := test.NewRecorder(fmt.Sprintf(
+		"/?user=%s&token=%s",
+		url.QueryEscape(testUsername),
+		url.QueryEscape(testPassword),
+	))
+	handler(rec, req)
+	cookie := rec.Result().Cookies()[0]
+	token := test.EatError(signer.Parse(cookie.Value)).(auth.Session)
+	metadata, _ := token.GetMetadata()
+	logout := func(method, csrf string) *httptest.ResponseRecorder {
+		loggedOut = false
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/logout", nil)
+		req.AddCookie(cookie)
+		req.Header.Set(auth.CSRFHeader, csrf)
+		mw.Logout(rec, req)
+		return rec
+	}
+	t.Run("the query parameter doesn't log out", func(t *testing.T) {
+		test := attest.New(t)
+		rec, req := test.NewRecorder("/?logout=true")
+		req.AddCookie(cookie)
+		handler(rec, req)
+		test.Attest(token.CurrentlyExists(), "?logout= still signs users out")
+	})
+	t.Run("GET", func(t *testing.T) {
+		test := attest.New(t)
+		rec := logout(http.MethodGet, metadata.CSRFToken)
+		test.Equals(http.StatusMethodNotAllowed, rec.Code)
+		test.Equals(http.MethodPost, rec.Header().Get("Allow"))
+		test.Attest(token.CurrentlyExists(), "a GET request signed the user out")
+	})
+	t.Run("without a CSRF token", func(t *testing.T) {
+		test := attest.New(t)
+		test.Equals(http.StatusForbidden, logout(http.MethodPost, "").Code)
+		test.Attest(token.CurrentlyExists(), "a forged request signed the user out")
+		test.Attest(!loggedOut, "the logout handler was called")
+	})
+	t.Run("POST", func(t *testing.T) {
+		test := attest.New(t)
+		rec := logout(http.MethodPost, metadata.CSRFToken)
+		test.Equals(http.StatusSeeOther, rec.Code)
+		test.Attest(loggedOut, "the logout handler wasn't called")
+		test.Attest(!token.CurrentlyExists(), "the session outlived logging out")
+		cleared := rec.Result().Cookies()
+		test.Equals(1, len(cleared))
+		test.Equals(-1, cleared[0].MaxAge)
+	})
+	t.Run("without a session", func(t *testing.T) {
+		test := attest.New(t)
+		rec := logout(http.MethodPost, "")
+		test.Equals(http.StatusSeeOther, rec.Code)
+		test.Attest(loggedOut, "the logout handler wasn't called")
+	})
+}
@@ -0,0 +1,148 @@
+package gorilla_middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+	"github.com/gorilla/mux"
+)
+
+type reauthContextKey struct{}
+
+// NeedsReauthentication reports whether the LoginHandler was called because
+// the route requires a more recent sign-in than the session's, rather than
+// because there's no session. The login page should then ask the signed-in
+// user for their password, and their two-factor code in the auth.TOTPField
+// field if they're enrolled, and submit them back to r.URL.
+func NeedsReauthentication(r *http.Request) bool {
+	needed, _ := r.Context().Value(reauthContextKey{}).(bool)
+	return needed
+}
+
+// requestAuthentication gets the metadata of whatever authenticated the
+// request, and a function which records that the user has just
+// reauthenticated by the given methods.
+func (m *Middleware) requestAuthentication(
+	w http.ResponseWriter, r *http.Request,
+) (metadata *auth.SessionMetadata, reauthenticated func(...string) error, ok bool) {
+	if claims := auth.ClaimsFrom(r); claims != nil {
+		return claims.Metadata(), func(methods ...string) error {
+			_, _, err := m.issueToken(w, claims.User, methods...)
+			return err
+		}, true
+	}
+	var (
+		token auth.Session
+		err   error
+	)
+	bearer := bearerToken(r)
+	if bearer != "" && m.Schemes.SchemesFor(r.URL.Path).Allows(auth.SchemeBearer) {
+		if m.SignedIDs != nil {
+			token, err = m.SignedIDs.Parse(bearer)
+		} else {
+			token, err = auth.ParseSessionID(bearer)
+		}
+	} else {
+		token, err = m.currentSession(r)
+	}
+	if err != nil {
+		return nil, nil, false
+	}
+	metadata, ok = token.Touch()
+	return metadata, func(methods ...string) error {
+		return token.Reauthenticate(methods...)
+	}, ok
+}
+
+// reauthenticate checks the credentials the signed-in user submitted to
+// confirm who they are. handled is true if a response has been written.
+func (m *Middleware) reauthenticate(
+	w http.ResponseWriter, r *http.Request,
+	metadata *auth.SessionMetadata, reauthenticated func(...string) error,
+) (handled bool) {
+	user, pass, err := m.credentials().Credentials(r)
+	if err != nil || user == "" {
+		return false
+	}
+	if user != metadata.User || !user.IsAuthenticatedBy(pass) {
+		log.Printf("reauthentication failed for %s\n", metadata.User)
+		return false
+	}
+	methods := []string{auth.AuthPassword}
+	if user.HasTOTP() {
+		if err = user.CheckSecondFactor(r.PostFormValue(auth.TOTPField)); err != nil {
+			log.Printf("reauthentication failed for %s: %v\n", user, err)
+			return false
+		}
+		methods = append(methods, auth.AuthOTP)
+	}
+	if err = reauthenticated(methods...); err != nil {
+		log.Printf("error reauthenticating %s: %v\n", user, err)
+		unauthorizedHandler(w, r)
+		return true
+	}
+	// send the user back to where they were going, without the credentials
+	// if they were in the query string
+	target := *r.URL
+	query := target.Query()
+	query.Del(auth.UserField)
+	query.Del(auth.TokenField)
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.RequestURI(), http.StatusSeeOther)
+	return true
+}
+
+// RequireRecentAuth returns a middleware which only lets requests through if
+// the user signed in or reauthenticated within maxAge. Otherwise the
+// LoginHandler is called, with NeedsReauthentication true, to ask for their
+// password; when it's submitted back to the same URL the user is redirected
+// to it. Use it after SessionAuthentication, on sensitive routes:
+//
+//	settings := router.PathPrefix("/settings/").Subrouter()
+//	settings.Use(mw.SessionAuthentication(), mw.RequireRecentAuth(5*time.Minute))
+//
+// Requests authenticated by Basic credentials were authenticated just now,
+// so they're let through; requests authenticated by API keys can't
+// reauthenticate, so they're forbidden.
+func (m *Middleware) RequireRecentAuth(maxAge time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if auth.APIKeyFrom(r) != nil {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "%d %s", http.StatusForbidden, http.StatusText(http.StatusForbidden))
+				return
+			}
+			if header := auth.AuthenticatedHeaderFrom(r); header != nil &&
+				header.Scheme == auth.SchemeBasic {
+				next.ServeHTTP(w, r)
+				return
+			}
+			metadata, reauthenticated, ok := m.requestAuthentication(w, r)
+			if !ok {
+				m.loginHandler()(w, r)
+				return
+			}
+			if time.Since(metadata.AuthenticatedAt) <= maxAge {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if m.reauthenticate(w, r, metadata, reauthenticated) {
+				return
+			}
+			m.loginHandler()(w, r.WithContext(
+				context.WithValue(r.Context(), reauthContextKey{}, true),
+			))
+		})
+	}
+}
+
+// RequireRecentAuth returns a middleware which requires the user to have
+// signed in within maxAge, using the package-level settings. See
+// Middleware.RequireRecentAuth.
+func RequireRecentAuth(maxAge time.Duration) mux.MiddlewareFunc {
+	return defaultMiddleware.RequireRecentAuth(maxAge)
+}
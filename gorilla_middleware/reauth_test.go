@@ -0,0 +1,99 @@
+package gorilla_middleware
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+)
+
+func TestRequireRecentAuth(t *testing.T) {
+	var (
+		test   = attest.New(t)
+		signer = test.EatError(auth.NewIDSigner(
+			[]byte("test session ID signing key, 32+ bytes"),
+		)).(*auth.IDSigner)
+		reauthRequested, nextHasBeenCalled bool
+		mw                                 = &Middleware{
+			SignedIDs: signer,
+			LoginHandler: func(w http.ResponseWriter, r *http.Request) {
+				reauthRequested = NeedsReauthentication(r)
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+		}
+		handler = mw.sessionAuthentication(mw.RequireRecentAuth(time.Minute)(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+			}),
+		)).ServeHTTP
+		credentials = fmt.Sprintf(
+			"user=%s&token=%s",
+			url.QueryEscape(testUsername),
+			url.QueryEscape(testPassword),
+		)
+	)
+	rec, req := test.NewRecorder("/settings?" + credentials)
+	handler(rec, req)
+	test.Attest(nextHasBeenCalled, `"next" was not called right after signing in`)
+	cookie := rec.Result().Cookies()[0]
+	token := test.EatError(signer.Parse(cookie.Value)).(auth.Session)
+	metadata, _ := token.GetMetadata()
+	test.Equals(1, len(metadata.AuthMethods))
+	test.Equals(auth.AuthPassword, metadata.AuthMethods[0])
+	visit := func(target string) *http.Response {
+		nextHasBeenCalled, reauthRequested = false, false
+		rec, req := test.NewRecorder(target)
+		req.AddCookie(cookie)
+		handler(rec, req)
+		return rec.Result()
+	}
+	visit("/settings?tab=password")
+	test.Attest(nextHasBeenCalled, `"next" was not called with a recent sign-in`)
+
+	metadata.AuthenticatedAt = time.Now().Add(-time.Hour)
+	visit("/settings?tab=password")
+	test.Attest(!nextHasBeenCalled, `"next" was called without a recent sign-in`)
+	test.Attest(reauthRequested, "the login handler wasn't asked to reauthenticate")
+
+	visit("/settings?tab=password&user=" + url.QueryEscape(testUsername) + "&token=wrong")
+	test.Attest(!nextHasBeenCalled, `"next" was called with the wrong password`)
+	test.Attest(reauthRequested, "the login handler wasn't asked to reauthenticate")
+
+	res := visit("/settings?tab=password&" + credentials)
+	test.Equals(http.StatusSeeOther, res.StatusCode)
+	test.Equals("/settings?tab=password", res.Header.Get("Location"))
+	visit("/settings?tab=password")
+	test.Attest(nextHasBeenCalled, `"next" was not called after reauthenticating`)
+	token.Delete()
+
+	t.Run("basic credentials", func(t *testing.T) {
+		test := attest.New(t)
+		mw := &Middleware{
+			SignedIDs:    signer,
+			LoginHandler: unauthorizedHandler,
+			Schemes:      &auth.SchemePolicy{Default: auth.AllSchemes},
+		}
+		recent := mw.RequireRecentAuth(time.Minute)(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+			}),
+		)
+		nextHasBeenCalled = false
+		rec, req := test.NewRecorder("/settings")
+		req.TLS = new(tls.ConnectionState)
+		req.SetBasicAuth(testUsername, testPassword)
+		mw.sessionAuthentication(recent).ServeHTTP(rec, req)
+		test.Attest(nextHasBeenCalled, `"next" was not called with Basic credentials`)
+		// a header which nothing has checked doesn't count
+		nextHasBeenCalled = false
+		rec, req = test.NewRecorder("/settings")
+		req.SetBasicAuth(testUsername, "wrong password")
+		recent.ServeHTTP(rec, req)
+		test.Attest(!nextHasBeenCalled, `"next" was called with unchecked Basic credentials`)
+	})
+}
@@ -0,0 +1,38 @@
+package gorilla_middleware
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+	"github.com/gorilla/mux"
+)
+
+// RequireScope returns a middleware which only lets requests authenticated by
+// an API key through if the key was issued with the given scope. Requests
+// authenticated any other way are let through, so use it after
+// SessionAuthentication:
+//
+//	api := router.PathPrefix("/api/").Subrouter()
+//	api.Use(mw.SessionAuthentication(), gorilla_middleware.RequireScope("read"))
+func RequireScope(scope string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if authenticated := auth.APIKeyFrom(r); authenticated != nil &&
+				!authenticated.Key.HasScope(scope) {
+				log.Printf(
+					"API key %s lacks the %s scope for %s %s\n",
+					authenticated.Key.ID,
+					scope,
+					r.Method,
+					r.URL.Path,
+				)
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "%d %s", http.StatusForbidden, http.StatusText(http.StatusForbidden))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
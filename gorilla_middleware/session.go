@@ -1,15 +1,10 @@
 package gorilla_middleware
 
 import (
-	"crypto/rand"
 	"encoding/gob"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"math/big"
 	"net/http"
-	"os"
-	"path"
 	"time"
 
 	auth "github.com/dscottboggs/go-middleware-session-auth"
@@ -18,167 +13,238 @@ import (
 )
 
 var (
-	store            *sessions.CookieStore
-	defaultConfigDir = path.Join(
-		os.Getenv("HOME"),
-		".config",
-		"go-middleware-session-auth",
-	)
-	defaultSessionKeyLocation = path.Join(defaultConfigDir, "session.key")
-	bigInteger                = big.NewInt(1<<63 - 1)
-	byteSize                  = big.NewInt(8)
+	// store is used by the package-level functions, and by instances which
+	// don't have their own. It's set by UseKeyring, and replaced by
+	// StartKeyRotation as the keys are rotated; until then it's nil.
+	store *sessions.CookieStore
 	// LoginHandler --
 	// requests are sent to the LoginHandler if authentication fails. By
-	// default, it redirects to /login
-	LoginHandler  http.HandlerFunc
-	LogoutHandler = &LoginHandler
+	// default, it responds "401 Unauthorized"
+	LoginHandler http.HandlerFunc = unauthorizedHandler
+	// LogoutHandler responds once Logout has signed the user out. By default,
+	// it responds "204 No Content"
+	LogoutHandler http.HandlerFunc = loggedOutHandler
+	// SecondFactorHandler is called when a user enrolled in two-factor
+	// authentication has entered their password, and when they enter a wrong
+	// code. It should ask for the code from their authenticator app, and
+	// POST it back in the auth.TOTPField form field. By default, it responds
+	// "401 Unauthorized"
+	SecondFactorHandler http.HandlerFunc = secondFactorRequiredHandler
 )
 
 const (
 	// SessionTokenCookie -- The key that the session is referenced by
-	SessionTokenCookie = "session_token"
+	SessionTokenCookie = auth.DefaultCookieName
 	// UserAuthSessionKey -- the key that the auth token is referenced by in the
 	// session
 	UserAuthSessionKey = "user_auth_sessionKey"
-	oneWeek            = time.Second * 86400 * 7
 )
 
 func init() {
 	gob.Register(&auth.Session{})
-	sessionKeyFile := os.Getenv("go_middleware_session_key_file")
-	var sessionKey []byte
-	if sessionKeyFile == "" {
-		keyString := os.Getenv("go_middleware_session_key")
-		if keyString == "" {
-			// try default loc.
-			key, err := ioutil.ReadFile(defaultSessionKeyLocation)
-			if os.IsNotExist(err) {
-				// check for config folder
-				if _, err = os.Stat(defaultSessionKeyLocation); os.IsNotExist(err) {
-					os.Mkdir(defaultConfigDir, os.ModeDir|os.FileMode(0755))
-				}
-				var keyFile *os.File
-				// write new key to the default location and use that
-				keyFile, err = os.Create(defaultSessionKeyLocation)
-				defer func() {
-					stat, statErr := os.Stat(defaultSessionKeyLocation)
-					closeErr := keyFile.Close()
-					if closeErr != nil || stat.Size() == 0 {
-						log.Fatalf("error: %v", closeErr)
-					}
-					if statErr != nil {
-						log.Fatalf("error: %v", statErr)
-					}
-					if stat.Size() == 0 {
-						log.Fatalf(
-							"error keyfile size is 0: %v",
-							defaultSessionKeyLocation,
-						)
-					}
-				}()
-				if err != nil {
-					log.Fatalf(
-						"couldn't find a session key or create one at the default "+
-							`location, "%s": %v`,
-						defaultSessionKeyLocation,
-						err,
-					)
-				}
-				var num *big.Int
-				for i := 0; i < 32; /* 256 bits */ i++ {
-					num, err = rand.Int(rand.Reader, byteSize)
-					if err != nil {
-						// this seriously needs to break everything if it
-						// doesn't work
-						log.Fatalf(
-							"failed to initialize random number generator: %v",
-							err,
-						)
-					}
-					if i >= len(sessionKey) {
-						sessionKey = append(sessionKey, byte(num.Int64()))
-					} else {
-						sessionKey[i] = byte(num.Int64())
-					}
-				}
-				_, err = keyFile.Write(sessionKey)
-				if err != nil {
-					log.Fatalf(
-						"couldn't find a session key or create one at the default "+
-							`location, "%s": %v`,
-						defaultSessionKeyLocation,
-						err,
-					)
-				}
-			} else if err != nil {
-				log.Fatalf(
-					`error reading file at "%s": %v`,
-					defaultSessionKeyLocation,
-					err,
-				)
-			} else {
-				copy(sessionKey, key)
+}
+
+func unauthorizedHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, "%d Unauthorized", http.StatusUnauthorized)
+}
+
+// Middleware is one instance of the session authentication middleware, with
+// its own settings. The zero value uses the package-level LoginHandler and
+// the default cookie options.
+type Middleware struct {
+	// LoginHandler is called when authentication fails. Defaults to the
+	// package-level LoginHandler.
+	LoginHandler http.HandlerFunc
+	// LogoutHandler responds once Logout has signed the user out. Defaults to
+	// the package-level LogoutHandler.
+	LogoutHandler http.HandlerFunc
+	// SecondFactorHandler asks for a two-factor code. Defaults to the
+	// package-level SecondFactorHandler.
+	SecondFactorHandler http.HandlerFunc
+	// Cookie configures the attributes of the session cookie.
+	Cookie auth.CookieOptions
+	// SignedIDs, if set, makes the cookie carry only the session's ID signed
+	// by this signer, rather than the session encrypted by the cookie store.
+	// This keeps the cookie small and means its validity doesn't depend on
+	// the cookie store's keys.
+	SignedIDs *auth.IDSigner
+	// CSRF selects how unsafe requests are protected from cross-site request
+	// forgery. Defaults to auth.CSRFSynchronizer.
+	CSRF auth.CSRFMode
+	// Credentials reads sign-in credentials from requests. If it's nil
+	// they're accepted from the query string or a form in any request, as
+	// with auth.LenientCredentials.
+	Credentials auth.CredentialExtractor
+	// Schemes chooses how requests to each route may be authenticated. If
+	// it's nil only session cookies are accepted. Basic credentials are held
+	// to Credentials if it's an *auth.CredentialPolicy, and otherwise only
+	// accepted over TLS.
+	Schemes *auth.SchemePolicy
+	// Tokens, if set, makes signing in issue a signed token (a JWT) instead
+	// of creating a session, and authenticates requests by verifying it, so
+	// nothing needs to be stored in or shared through AllSessions. Bearer
+	// headers carry these tokens too.
+	Tokens *auth.TokenSigner
+	// Roles, if set, gets the roles to put in a user's signed tokens.
+	Roles func(auth.Username) []string
+	// Binding, if set, binds sessions to attributes of the client which
+	// started them.
+	Binding *auth.BindingPolicy
+	// store is this instance's cookie store, if it was created by New or
+	// given a keyring with UseKeyring. It's guarded by storeLock.
+	store *sessions.CookieStore
+	// keyRotationQuitter stops the rotation started by StartKeyRotation. It's
+	// guarded by keyRotationLock.
+	keyRotationQuitter chan bool
+}
+
+// the instance used by the package-level functions
+var defaultMiddleware = new(Middleware)
+
+func (m *Middleware) loginHandler() http.HandlerFunc {
+	if m.LoginHandler != nil {
+		return m.LoginHandler
+	}
+	return LoginHandler
+}
+
+func (m *Middleware) credentials() auth.CredentialExtractor {
+	if m.Credentials != nil {
+		return m.Credentials
+	}
+	return auth.LenientCredentials
+}
+
+// credentialPolicy gets the policy Basic credentials are held to. If it's nil
+// they're only accepted over TLS.
+func (m *Middleware) credentialPolicy() *auth.CredentialPolicy {
+	policy, _ := m.Credentials.(*auth.CredentialPolicy)
+	return policy
+}
+
+// headerAuthentication authenticates the request by its Authorization header
+// if the route allows it. handled is true if a response has been written or
+// next has been called.
+func (m *Middleware) headerAuthentication(
+	w http.ResponseWriter, r *http.Request, next http.Handler,
+) (handled bool) {
+	schemes := m.Schemes.SchemesFor(r.URL.Path)
+	if schemes.Allows(auth.SchemeAPIKey) {
+		authenticated, ok, err := auth.AuthenticateAPIKey(r)
+		if err != nil {
+			log.Printf("rejecting %s %s: %v\n", r.Method, r.URL.Path, err)
+			auth.Challenge(w, schemes, err)
+			return true
+		}
+		if ok {
+			next.ServeHTTP(w, authenticated)
+			return true
+		}
+	}
+	if m.Tokens != nil && schemes.Allows(auth.SchemeBearer) {
+		if token := bearerToken(r); token != "" {
+			claims, err := m.Tokens.Verify(token)
+			if err != nil {
+				log.Printf("rejecting %s %s: %v\n", r.Method, r.URL.Path, err)
+				auth.Challenge(w, schemes, err)
+				return true
 			}
-		} else {
-			sessionKey = []byte(keyString)
+			next.ServeHTTP(w, auth.WithClaims(r, claims))
+			return true
+		}
+	}
+	if schemes.Allows(auth.SchemeBasic | auth.SchemeBearer) {
+		authenticated, scheme, err := auth.AuthenticateHeader(
+			r, schemes, m.SignedIDs, m.credentialPolicy(), m.Binding,
+		)
+		if err != nil {
+			log.Printf("rejecting %s %s: %v\n", r.Method, r.URL.Path, err)
+			auth.Challenge(w, schemes, err)
+			return true
 		}
-	} else {
-		var err error
-		sessionKey, err = ioutil.ReadFile(sessionKeyFile)
-		if err != nil && !os.IsNotExist(err) {
-			log.Fatalf(`error reading file at "%s": %v`, sessionKeyFile, err)
+		if scheme != 0 {
+			log.Printf(
+				"authenticated %s for %s %s\n",
+				auth.AuthenticatedHeaderFrom(authenticated).User,
+				r.Method,
+				r.URL.Path,
+			)
+			next.ServeHTTP(w, authenticated)
+			return true
 		}
 	}
-	store = sessions.NewCookieStore(sessionKey)
-	LoginHandler = http.HandlerFunc(
-		func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusUnauthorized)
-			fmt.Fprintf(w, "%d Unauthorized", http.StatusUnauthorized)
-		},
-	)
+	if !schemes.Allows(auth.SchemeCookie) {
+		auth.Challenge(w, schemes, nil)
+		return true
+	}
+	return false
 }
 
-func noSessionHandler(
+func (m *Middleware) noSessionHandler(
 	w http.ResponseWriter, r *http.Request, next http.Handler,
 ) {
-	signInHandler(
-		sessionAuthentication(next).ServeHTTP,
-		LoginHandler,
-	)(w, r)
+	// the session was only just created, so there's no need to check it
+	// again, and a signed ID cookie couldn't be read back from the request
+	login := m.loginHandler()
+	m.signInHandler(next.ServeHTTP, func(w http.ResponseWriter, r *http.Request) {
+		auth.RememberDestination(w, r, m.Cookie)
+		login(w, r)
+	})(w, r)
 }
 
 func sessionAuthentication(next http.Handler) http.Handler {
+	return defaultMiddleware.sessionAuthentication(next)
+}
+
+func (m *Middleware) sessionAuthentication(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Query().Get("logout") != "" {
-			deauthorize(w, r, next)
+		if m.headerAuthentication(w, r, next) {
+			return
+		}
+		if m.Tokens != nil {
+			m.tokenAuthentication(w, r, next)
 			return
 		}
-		session, err := store.Get(r, SessionTokenCookie)
+		tkn, err := m.currentSession(r)
 		if err != nil {
-			log.Printf("error getting cookie for %s: %v\n", r.URL.String(), err)
-			noSessionHandler(w, r, next)
+			if err != errNoSession {
+				log.Printf("error getting cookie for %s: %v\n", r.URL.String(), err)
+			}
+			m.noSessionHandler(w, r, next)
 			return
 		}
-		token := session.Values[UserAuthSessionKey]
-		if token != nil {
-			tkn := token.(auth.Session)
-			if metadata, exists := tkn.GetMetadata(); exists {
-				if metadata.Expiry.Unix() < time.Now().Unix() {
-					// session is due for expiry but hasn't been cleaned up yet
-					noSessionHandler(w, r, next)
-				} else if metadata.Expiry.Unix() < time.Now().Add(oneWeek).Unix() {
-					tkn, _ = auth.NewSession()
-					session.Values[UserAuthSessionKey] = tkn
-					session.Save(r, w)
-					next.ServeHTTP(w, r)
-					return
+		// Touch also rejects sessions which are due for expiry but haven't been
+		// cleaned up yet
+		if metadata, exists := tkn.Touch(); exists {
+			if err = m.Binding.Enforce(r, tkn, metadata); err != nil {
+				if m.Binding.OnMismatch == auth.ReauthenticateOnMismatch {
+					m.noSessionHandler(w, r, next)
 				} else {
-					next.ServeHTTP(w, r)
-					return
+					unauthorizedHandler(w, r)
 				}
+				return
+			}
+			if err = auth.CheckCSRF(r, m.CSRF, m.Cookie, metadata); err != nil {
+				log.Printf("rejecting %s %s: %v\n", r.Method, r.URL.Path, err)
+				auth.CSRFFailed(w, r)
+				return
+			}
+			if !metadata.Rotated &&
+				time.Until(metadata.Expiry) < auth.RenewalThreshold() {
+				if rotated, _, err := tkn.Rotate(); err != nil {
+					log.Printf("error renewing session for %s: %v\n", metadata.User, err)
+				} else if err = m.setSession(w, r, rotated); err != nil {
+					log.Printf("error renewing session for %s: %v\n", metadata.User, err)
+				}
+				next.ServeHTTP(w, r)
+				return
+			} else {
+				next.ServeHTTP(w, r)
+				return
 			}
 		}
-		noSessionHandler(w, r, next)
+		m.noSessionHandler(w, r, next)
 	})
 }
 
@@ -190,7 +256,7 @@ func sessionAuthentication(next http.Handler) http.Handler {
 // or
 //     // to simply return "401 Unauthorized"
 //     router.Use(gorilla_middleware.SessionAuthentication())
-// And that's it.
+// after setting up the cookie store with UseKeyring.
 func SessionAuthentication(login ...http.HandlerFunc) mux.MiddlewareFunc {
 	switch numLoginHandlers := len(login); numLoginHandlers {
 	case 0:
@@ -204,20 +270,46 @@ func SessionAuthentication(login ...http.HandlerFunc) mux.MiddlewareFunc {
 		)
 		LoginHandler = login[0]
 	}
+	return defaultMiddleware.SessionAuthentication()
+}
 
-	return mux.MiddlewareFunc(sessionAuthentication)
+// SessionAuthentication returns a middleware which handles sign-in and session
+// authentication on all endpoints using this instance's settings. Usage:
+//
+//	mw := &gorilla_middleware.Middleware{
+//	    LoginHandler: renderLoginPage,
+//	    Cookie: auth.CookieOptions{HostPrefix: true},
+//	}
+//	router.Use(mw.SessionAuthentication())
+//
+// If the middleware is misconfigured the error is logged and every request is
+// refused with "500 Internal Server Error"; create it with New to get the
+// error instead.
+func (m *Middleware) SessionAuthentication() mux.MiddlewareFunc {
+	if err := m.validate(); err != nil {
+		log.Printf("ERROR: refusing all requests: %v\n", err)
+		return mux.MiddlewareFunc(misconfigured)
+	}
+	return mux.MiddlewareFunc(m.sessionAuthentication)
 }
 
-func deauthorize(w http.ResponseWriter, r *http.Request, next http.Handler) {
-	session, err := store.Get(r, SessionTokenCookie)
-	if err != nil {
-		noSessionHandler(w, r, next)
+// validate checks the settings of a Middleware which wasn't created by New.
+func (m *Middleware) validate() error {
+	if err := m.Cookie.Validate(); err != nil {
+		return fmt.Errorf("invalid session cookie options: %v", err)
 	}
-	token := session.Values[UserAuthSessionKey]
-	if token == nil {
-		noSessionHandler(w, r, next)
+	if m.SignedIDs == nil && m.Tokens == nil && m.cookieStore() == nil {
+		return errNoStore
 	}
-	seshToken := token.(auth.Session)
-	seshToken.Delete()
-	(*LogoutHandler)(w, r)
+	return nil
+}
+
+func misconfigured(http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(
+			w,
+			http.StatusText(http.StatusInternalServerError),
+			http.StatusInternalServerError,
+		)
+	})
 }
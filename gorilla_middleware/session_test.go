@@ -1,11 +1,14 @@
 package gorilla_middleware
 
 import (
+	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/dscottboggs/attest"
 	auth "github.com/dscottboggs/go-middleware-session-auth"
@@ -191,7 +194,7 @@ func TestOneShotFullFlow(t *testing.T) {
 		test.Equals(http.StatusOK, res.StatusCode)
 		isAuthorized(t, res)
 		// expire the token
-		oldToken.ExpireIn(oneWeek - 1000)
+		oldToken.ExpireIn(auth.RenewalThreshold() - 1000)
 		// make the call again
 		newRec, newReq := test.NewRecorder()
 		newReq.AddCookie(oldSessionCookie)
@@ -204,7 +207,7 @@ func TestOneShotFullFlow(t *testing.T) {
 		newRes := newRec.Result()
 		test.Equals(http.StatusOK, newRes.StatusCode)
 		isAuthorized(t, newRes)
-		cookies := res.Cookies()
+		cookies := newRes.Cookies()
 		test.Equals(1, len(cookies))
 		newSesh, err := store.Get(newReq, SessionTokenCookie)
 		test.Handle(err)
@@ -215,3 +218,351 @@ func TestOneShotFullFlow(t *testing.T) {
 		test.NotEqual(oldSessionCookie.Value, cookies[0].Value)
 	})
 }
+
+func TestSignedIDCookies(t *testing.T) {
+	var (
+		test              = attest.New(t)
+		nextHasBeenCalled bool
+		signer            = test.EatError(auth.NewIDSigner(
+			[]byte("test session ID signing key, 32+ bytes"),
+		)).(*auth.IDSigner)
+		mw      = &Middleware{SignedIDs: signer}
+		handler = mw.sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+				w.Write(response)
+			}),
+		).ServeHTTP
+	)
+	rec, req := test.NewRecorder(fmt.Sprintf(
+		`/test?user=%s&token=%s`,
+		url.QueryEscape(testUsername),
+		url.QueryEscape(testPassword),
+	))
+	handler(rec, req)
+	test.Attest(nextHasBeenCalled, `"next" was not called after signing in`)
+	cookies := rec.Result().Cookies()
+	test.Equals(1, len(cookies))
+	token := test.EatError(signer.Parse(cookies[0].Value)).(auth.Session)
+	test.Attest(token.CurrentlyExists(), "cookie referred to an unknown session")
+	t.Run("with the cookie", func(t *testing.T) {
+		test := attest.New(t)
+		nextHasBeenCalled = false
+		rec, req := test.NewRecorder()
+		req.AddCookie(cookies[0])
+		handler(rec, req)
+		test.Attest(nextHasBeenCalled, `"next" was not called with the cookie`)
+	})
+	t.Run("after the session was deleted", func(t *testing.T) {
+		test := attest.New(t)
+		nextHasBeenCalled = false
+		token.Delete()
+		rec, req := test.NewRecorder()
+		req.AddCookie(cookies[0])
+		handler(rec, req)
+		test.Attest(!nextHasBeenCalled, `"next" was called for a deleted session`)
+	})
+}
+
+func TestCSRFProtection(t *testing.T) {
+	var (
+		nextHasBeenCalled bool
+		handler           = sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+			}),
+		).ServeHTTP
+	)
+	token, metadata := auth.NewSession()
+	defer token.Delete()
+	post := func(test *attest.Test, csrfToken string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/test", nil)
+		req.Header.Set(auth.CSRFHeader, csrfToken)
+		session, err := store.Get(req, SessionTokenCookie)
+		test.Handle(err)
+		session.Values[UserAuthSessionKey] = token
+		return req
+	}
+	t.Run("with the session's token", func(t *testing.T) {
+		test := attest.New(t)
+		nextHasBeenCalled = false
+		handler(httptest.NewRecorder(), post(&test, metadata.CSRFToken))
+		test.Attest(nextHasBeenCalled, `"next" was not called`)
+	})
+	t.Run("with the wrong token", func(t *testing.T) {
+		test := attest.New(t)
+		nextHasBeenCalled = false
+		rec := httptest.NewRecorder()
+		handler(rec, post(&test, "wrong token"))
+		test.Attest(!nextHasBeenCalled, `"next" was called`)
+		test.Equals(http.StatusForbidden, rec.Result().StatusCode)
+	})
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	var (
+		test              = attest.New(t)
+		nextHasBeenCalled bool
+		policy            = new(auth.SchemePolicy)
+		mw                = &Middleware{Schemes: policy}
+		authenticated     *auth.AuthenticatedHeader
+		handler           = mw.sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+				authenticated = auth.AuthenticatedHeaderFrom(r)
+			}),
+		).ServeHTTP
+	)
+	test.Handle(policy.Allow("/api/", auth.SchemeBasic|auth.SchemeBearer))
+	token, _ := auth.NewSessionFor(auth.Username(testUsername))
+	defer token.Delete()
+	serve := func(path, authorization string) *httptest.ResponseRecorder {
+		nextHasBeenCalled = false
+		authenticated = nil
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.TLS = new(tls.ConnectionState)
+		req.Header.Set("Authorization", authorization)
+		handler(rec, req)
+		return rec
+	}
+	basic := func(password string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(testUsername, password)
+		return req.Header.Get("Authorization")
+	}
+	t.Run("basic", func(t *testing.T) {
+		test := attest.New(t)
+		serve("/api/things", basic(testPassword))
+		test.Attest(nextHasBeenCalled, `"next" was not called`)
+		test.Equals(auth.Username(testUsername), authenticated.User)
+		rec := serve("/api/things", basic("wrong password"))
+		test.Attest(!nextHasBeenCalled, `"next" was called`)
+		test.Equals(http.StatusUnauthorized, rec.Code)
+		test.NotEqual("", rec.Header().Get("WWW-Authenticate"))
+	})
+	t.Run("basic over plain HTTP", func(t *testing.T) {
+		test := attest.New(t)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/things", nil)
+		req.SetBasicAuth(testUsername, testPassword)
+		nextHasBeenCalled = false
+		handler(rec, req)
+		test.Attest(!nextHasBeenCalled, `"next" was called`)
+		test.Equals(http.StatusBadRequest, rec.Code)
+	})
+	t.Run("bearer", func(t *testing.T) {
+		test := attest.New(t)
+		serve("/api/things", "Bearer "+token.ID())
+		test.Attest(nextHasBeenCalled, `"next" was not called`)
+		test.Equals(token, authenticated.Session)
+	})
+	t.Run("no header on a header-only route", func(t *testing.T) {
+		test := attest.New(t)
+		rec := serve("/api/things", "")
+		test.Attest(!nextHasBeenCalled, `"next" was called`)
+		test.Equals(http.StatusUnauthorized, rec.Code)
+	})
+	t.Run("header on a cookie-only route", func(t *testing.T) {
+		test := attest.New(t)
+		serve("/things", "Bearer "+token.ID())
+		test.Attest(!nextHasBeenCalled, `"next" was called`)
+	})
+}
+
+func TestSignedTokenMode(t *testing.T) {
+	var (
+		test              = attest.New(t)
+		nextHasBeenCalled bool
+		signer            = auth.NewTokenSigner(time.Hour)
+		mw                = &Middleware{
+			Tokens: signer,
+			Roles:  func(auth.Username) []string { return []string{"reader"} },
+		}
+		claims  *auth.Claims
+		handler = mw.sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+				claims = auth.ClaimsFrom(r)
+			}),
+		).ServeHTTP
+	)
+	test.Handle(signer.AddHMACKey("test", []byte("test token signing secret, 32+ bytes")))
+	sessionCount := len(auth.AllSessions)
+	rec, req := test.NewRecorder(fmt.Sprintf(
+		`/test?user=%s&token=%s`,
+		url.QueryEscape(testUsername),
+		url.QueryEscape(testPassword),
+	))
+	handler(rec, req)
+	test.Attest(nextHasBeenCalled, `"next" was not called after signing in`)
+	test.Equals(sessionCount, len(auth.AllSessions))
+	cookies := rec.Result().Cookies()
+	test.Equals(1, len(cookies))
+	t.Run("with the cookie", func(t *testing.T) {
+		test := attest.New(t)
+		nextHasBeenCalled = false
+		rec, req := test.NewRecorder()
+		req.AddCookie(cookies[0])
+		handler(rec, req)
+		test.Attest(nextHasBeenCalled, `"next" was not called`)
+		test.Equals(auth.Username(testUsername), claims.User)
+		test.Attest(claims.HasRole("reader"), "role was lost")
+	})
+	t.Run("after logging out", func(t *testing.T) {
+		test := attest.New(t)
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/logout", nil)
+		req.AddCookie(cookies[0])
+		req.Header.Set(auth.CSRFHeader, claims.CSRFToken)
+		mw.Logout(rec, req)
+		test.Equals(http.StatusNoContent, rec.Code)
+		nextHasBeenCalled = false
+		rec, req = test.NewRecorder()
+		req.AddCookie(cookies[0])
+		handler(rec, req)
+		test.Attest(!nextHasBeenCalled, `"next" was called with a revoked token`)
+	})
+}
+
+func TestSignedTokenRenewal(t *testing.T) {
+	const secret = "test token signing secret, 32+ bytes"
+	var (
+		test              = attest.New(t)
+		nextHasBeenCalled bool
+		// the default lifetime of an hour
+		signer = auth.NewTokenSigner(0)
+		// signs tokens with the same key which are already due for renewal
+		short   = auth.NewTokenSigner(20 * time.Minute)
+		mw      = &Middleware{Tokens: signer, LoginHandler: unauthorizedHandler}
+		handler = mw.sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+			}),
+		).ServeHTTP
+	)
+	test.Handle(signer.AddHMACKey("test", []byte(secret)))
+	test.Handle(short.AddHMACKey("test", []byte(secret)))
+	request := func(token string) *httptest.ResponseRecorder {
+		nextHasBeenCalled = false
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/test", nil)
+		req.AddCookie(mw.Cookie.Cookie(token))
+		handler(rec, req)
+		return rec
+	}
+	t.Run("renewal replaces the token", func(t *testing.T) {
+		test := attest.New(t)
+		token, _, err := short.Issue(testUsername)
+		test.Handle(err)
+		rec := request(token)
+		test.Attest(nextHasBeenCalled, `"next" was not called`)
+		test.Equals(1, len(rec.Result().Cookies()))
+		rec = request(token)
+		test.Attest(!nextHasBeenCalled, `"next" was called with a replaced token`)
+		test.Equals(http.StatusUnauthorized, rec.Code)
+	})
+	t.Run("not past the maximum lifetime", func(t *testing.T) {
+		test := attest.New(t)
+		defer auth.SetMaxLifetime(0)
+		auth.SetMaxLifetime(time.Hour)
+		token, _, err := short.Issue(testUsername)
+		test.Handle(err)
+		rec := request(token)
+		test.Attest(nextHasBeenCalled, `"next" was not called`)
+		test.Equals(0, len(rec.Result().Cookies()))
+	})
+}
+
+func TestSessionRenewal(t *testing.T) {
+	var (
+		test    = attest.New(t)
+		handler = sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		).ServeHTTP
+	)
+	token, _ := auth.NewSessionFor(auth.Username(testUsername))
+	defer token.Delete()
+	test.Handle(token.ExpireIn(24 * time.Hour))
+	req := httptest.NewRequest(http.MethodGet, "/test", nil)
+	session, err := store.Get(req, SessionTokenCookie)
+	test.Handle(err)
+	session.Values[UserAuthSessionKey] = token
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	test.Equals(1, len(rec.Result().Cookies()))
+	metadata, exists := token.GetMetadata()
+	test.Attest(exists, "the old session was deleted without a grace period")
+	test.Attest(metadata.Rotated, "the old session wasn't rotated")
+	test.Attest(
+		metadata.Expiry.Before(time.Now().Add(time.Minute)),
+		"the old session is still valid for %v",
+		time.Until(metadata.Expiry),
+	)
+}
+
+func TestSessionBinding(t *testing.T) {
+	var (
+		test              = attest.New(t)
+		nextHasBeenCalled bool
+		signer            = test.EatError(auth.NewIDSigner(
+			[]byte("test session ID signing key, 32+ bytes"),
+		)).(*auth.IDSigner)
+		policy = &auth.BindingPolicy{Bind: auth.BindUserAgent}
+		mw     = &Middleware{
+			SignedIDs: signer,
+			Binding:   policy,
+			Schemes:   &auth.SchemePolicy{Default: auth.AllSchemes},
+		}
+		handler = mw.sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+			}),
+		).ServeHTTP
+	)
+	signIn := func(test *attest.Test) *http.Cookie {
+		rec, req := test.NewRecorder(fmt.Sprintf(
+			`/test?user=%s&token=%s`,
+			url.QueryEscape(testUsername),
+			url.QueryEscape(testPassword),
+		))
+		req.Header.Set("User-Agent", "test binding agent")
+		handler(rec, req)
+		return rec.Result().Cookies()[0]
+	}
+	visit := func(test *attest.Test, cookie *http.Cookie, agent string) int {
+		nextHasBeenCalled = false
+		rec, req := test.NewRecorder()
+		req.AddCookie(cookie)
+		req.Header.Set("User-Agent", agent)
+		handler(rec, req)
+		return rec.Code
+	}
+	cookie := signIn(&test)
+	test.Equals(http.StatusOK, visit(&test, cookie, "test binding agent"))
+	test.Attest(nextHasBeenCalled, `"next" was not called from the bound client`)
+	test.Equals(http.StatusUnauthorized, visit(&test, cookie, "another agent"))
+	test.Attest(!nextHasBeenCalled, `"next" was called from another client`)
+	visit(&test, cookie, "test binding agent")
+	test.Attest(nextHasBeenCalled, "rejecting a mismatch signed the bound client out")
+
+	// a stolen cookie replayed as a Bearer token is held to the same binding
+	bearer := func(test *attest.Test, agent string) int {
+		nextHasBeenCalled = false
+		rec, req := test.NewRecorder()
+		req.Header.Set("Authorization", "Bearer "+cookie.Value)
+		req.Header.Set("User-Agent", agent)
+		handler(rec, req)
+		return rec.Code
+	}
+	test.Equals(http.StatusUnauthorized, bearer(&test, "another agent"))
+	test.Attest(!nextHasBeenCalled, `"next" was called for another client's Bearer token`)
+	test.Equals(http.StatusOK, bearer(&test, "test binding agent"))
+	test.Attest(nextHasBeenCalled, `"next" wasn't called for the bound client's Bearer token`)
+
+	policy.OnMismatch = auth.ReauthenticateOnMismatch
+	visit(&test, cookie, "another agent")
+	test.Attest(!nextHasBeenCalled, `"next" was called from another client`)
+	visit(&test, cookie, "test binding agent")
+	test.Attest(!nextHasBeenCalled, "the session survived a mismatch")
+}
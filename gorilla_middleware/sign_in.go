@@ -1,6 +1,7 @@
 package gorilla_middleware
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 
@@ -8,44 +9,150 @@ import (
 )
 
 func signInHandler(authorized, unauthorized http.HandlerFunc) http.HandlerFunc {
+	return defaultMiddleware.signInHandler(authorized, unauthorized)
+}
+
+func (m *Middleware) signInHandler(
+	authorized, unauthorized http.HandlerFunc,
+) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var (
-			user auth.Username
-			pass string
-		)
-		user = auth.Username(r.FormValue("user")) // r.FormValue accepts post
-		pass = r.FormValue("token")               // form or URL queries
-		if !user.IsAuthenticatedBy(pass) {
-			fmt.Printf("user %s failed to be authenticated with %s\n", user, pass)
-			unauthorized(w, r)
+		user, pass, err := m.credentials().Credentials(r)
+		if err != nil {
+			fmt.Printf("rejecting sign in from %s: %v\n", r.RemoteAddr, err)
+			auth.RejectCredentials(w, err)
 			return
 		}
-		session, err := store.Get(r, SessionTokenCookie)
-		if err != nil {
-			fmt.Printf(
-				"ERROR: user %s was successfully authenticated, but error %v "+
-					"occurred trying to get the session\n",
-				user,
-				err,
-			)
-			// TODO perhaps do something different here?
+		if user == "" {
+			if pending, _, ok := auth.PendingSecondFactor(r, m.Cookie); ok {
+				m.secondFactor(w, r, pending, authorized, unauthorized)
+				return
+			}
+		}
+		if user != "" && m.CSRF != auth.CSRFDisabled {
+			// there's no session yet, so check the double-submit cookie
+			if err := auth.CheckDoubleSubmit(r, m.Cookie); err != nil {
+				fmt.Printf("rejecting sign in for user %s: %v\n", user, err)
+				auth.CSRFFailed(w, r)
+				return
+			}
+		}
+		if !user.IsAuthenticatedBy(pass) {
+			fmt.Printf("user %s failed to be authenticated\n", user)
 			unauthorized(w, r)
 			return
 		}
-		token, _ := auth.NewSession()
-		session.Values[UserAuthSessionKey] = token
-		if err = session.Save(r, w); err != nil {
-			fmt.Printf(
-				"ERROR: user %s was successfully authenticated, but error %v "+
-					"occurred trying to get the session\n",
-				user,
-				err,
-			)
-			// TODO perhaps do something different here?
-			unauthorized(w, r)
+		if user.HasTOTP() {
+			if err = auth.BeginSecondFactor(w, r, user, m.Cookie); err != nil {
+				fmt.Printf("ERROR: couldn't start two-factor sign in for %s: %v\n", user, err)
+				unauthorized(w, r)
+				return
+			}
+			m.secondFactorHandler()(w, r)
 			return
 		}
-		session.Save(r, w)
-		authorized(w, r)
+		m.signIn(w, r, user, authorized, unauthorized)
 	})
 }
+
+// secondFactor checks the two-factor code submitted for a pending sign-in,
+// and signs the user in if it's correct.
+func (m *Middleware) secondFactor(
+	w http.ResponseWriter, r *http.Request, pending auth.Session,
+	authorized, unauthorized http.HandlerFunc,
+) {
+	code := r.PostFormValue(auth.TOTPField)
+	if code == "" {
+		m.secondFactorHandler()(w, r)
+		return
+	}
+	if m.CSRF != auth.CSRFDisabled {
+		if err := auth.CheckDoubleSubmit(r, m.Cookie); err != nil {
+			fmt.Printf("rejecting two-factor code from %s: %v\n", r.RemoteAddr, err)
+			auth.CSRFFailed(w, r)
+			return
+		}
+	}
+	user, err := pending.CompleteSecondFactor(code)
+	if err != nil {
+		fmt.Printf("rejecting two-factor code from %s: %v\n", r.RemoteAddr, err)
+		if pending.CurrentlyExists() {
+			m.secondFactorHandler()(w, r)
+		} else {
+			auth.EndSecondFactor(w, m.Cookie)
+			unauthorized(w, r)
+		}
+		return
+	}
+	auth.EndSecondFactor(w, m.Cookie)
+	m.signIn(w, r, user, authorized, unauthorized, auth.AuthPassword, auth.AuthOTP)
+}
+
+// signIn starts a session for a user who has just authenticated by the given
+// methods, and sends them on.
+func (m *Middleware) signIn(
+	w http.ResponseWriter, r *http.Request, user auth.Username,
+	authorized, unauthorized http.HandlerFunc, methods ...string,
+) {
+	r, err := m.startSession(w, r, user, methods...)
+	if auth.IsTooManySessions(err) {
+		fmt.Printf("rejecting sign in for user %s: %v\n", user, err)
+		auth.RejectCredentials(w, err)
+		return
+	} else if err != nil {
+		fmt.Printf(
+			"ERROR: user %s was successfully authenticated, but error %v "+
+				"occurred trying to get the session\n",
+			user,
+			err,
+		)
+		// TODO perhaps do something different here?
+		unauthorized(w, r)
+		return
+	}
+	// send the user on to wherever they were going when they were asked
+	// to sign in
+	if destination, ok := auth.TakeDestination(w, r, m.Cookie); ok &&
+		destination != r.URL.RequestURI() {
+		http.Redirect(w, r, destination, http.StatusSeeOther)
+		return
+	}
+	authorized(w, r)
+}
+
+// startSession signs the user in: with a signed token if the middleware has a
+// TokenSigner, otherwise with a new session. The user authenticated by the
+// given methods, or by password if there are none. It returns a copy of the
+// request which carries the new session or token, for the rest of its
+// handlers.
+func (m *Middleware) startSession(
+	w http.ResponseWriter, r *http.Request, user auth.Username, methods ...string,
+) (*http.Request, error) {
+	if m.Tokens != nil {
+		_, claims, err := m.issueToken(w, user, methods...)
+		if err != nil {
+			return r, err
+		}
+		return auth.WithClaims(r, claims), nil
+	}
+	token, _, err := auth.NewSessionForClient(user, r, methods...)
+	if err != nil {
+		return r, err
+	}
+	if err = m.setSession(w, r, token); err != nil {
+		token.Delete()
+		return r, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, token)), nil
+}
+
+func secondFactorRequiredHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusUnauthorized)
+	fmt.Fprintf(w, "%d Two-factor code required", http.StatusUnauthorized)
+}
+
+func (m *Middleware) secondFactorHandler() http.HandlerFunc {
+	if m.SecondFactorHandler != nil {
+		return m.SecondFactorHandler
+	}
+	return SecondFactorHandler
+}
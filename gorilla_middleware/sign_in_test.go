@@ -1,14 +1,21 @@
 package gorilla_middleware
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dscottboggs/attest"
 	auth "github.com/dscottboggs/go-middleware-session-auth"
@@ -133,3 +140,131 @@ func TestSignInHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestReturnToDestination(t *testing.T) {
+	var (
+		test              = attest.New(t)
+		nextHasBeenCalled bool
+		signer            = test.EatError(auth.NewIDSigner(
+			[]byte("test session ID signing key, 32+ bytes"),
+		)).(*auth.IDSigner)
+		mw      = &Middleware{SignedIDs: signer, LoginHandler: unauthorizedHandler}
+		handler = mw.sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+			}),
+		).ServeHTTP
+	)
+	rec, req := test.NewRecorder("/account?tab=keys")
+	req.Header.Set("Accept", "text/html")
+	handler(rec, req)
+	test.Attest(!nextHasBeenCalled, `"next" was called without signing in`)
+	test.Equals(http.StatusUnauthorized, rec.Code)
+	cookies := rec.Result().Cookies()
+	test.Equals(1, len(cookies))
+
+	rec, req = test.NewRecorder(fmt.Sprintf(
+		"/login?user=%s&token=%s",
+		url.QueryEscape(testUsername),
+		url.QueryEscape(testPassword),
+	))
+	req.AddCookie(cookies[0])
+	handler(rec, req)
+	test.Attest(!nextHasBeenCalled, `"next" was called instead of redirecting`)
+	test.Equals(http.StatusSeeOther, rec.Code)
+	test.Equals("/account?tab=keys", rec.Header().Get("Location"))
+}
+
+// totpCode computes the code an authenticator app would show for the
+// base32-encoded secret, the given number of time steps from now.
+func totpCode(secret string, steps int64) string {
+	key, _ := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], uint64(time.Now().Unix()/30+steps))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:])&0x7fffffff)%1000000)
+}
+
+func TestSecondFactor(t *testing.T) {
+	const password = "test second factor password"
+	var (
+		test                             = attest.New(t)
+		twoFactorUser                    = auth.Username("test second factor user")
+		nextHasBeenCalled, codeRequested bool
+		mw                               = &Middleware{
+			CSRF:         auth.CSRFDisabled,
+			LoginHandler: unauthorizedHandler,
+			SecondFactorHandler: func(w http.ResponseWriter, r *http.Request) {
+				codeRequested = true
+				w.WriteHeader(http.StatusUnauthorized)
+			},
+		}
+		handler = mw.sessionAuthentication(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				nextHasBeenCalled = true
+			}),
+		).ServeHTTP
+	)
+	auth.EncryptTOTPSecretsWith(auth.StaticKey("test TOTP key"))
+	defer auth.EncryptTOTPSecretsWith(nil)
+	test.Handle(auth.CreateNewUser(string(twoFactorUser), password))
+	defer twoFactorUser.Delete(password)
+	enrollment, err := twoFactorUser.EnrollTOTP("test")
+	test.Handle(err)
+	test.Handle(twoFactorUser.ConfirmTOTP(totpCode(enrollment.Secret, 0)))
+
+	rec, req := test.NewRecorder(fmt.Sprintf(
+		"/page?user=%s&token=%s",
+		url.QueryEscape(string(twoFactorUser)),
+		url.QueryEscape(password),
+	))
+	handler(rec, req)
+	test.Attest(!nextHasBeenCalled, `"next" was called before the code was entered`)
+	test.Attest(codeRequested, "the code wasn't asked for")
+	cookies := rec.Result().Cookies()
+	test.Equals(1, len(cookies))
+	test.Equals(auth.SecondFactorCookieName, cookies[0].Name)
+	pending := cookies[0]
+
+	submit := func(code string) *http.Response {
+		nextHasBeenCalled, codeRequested = false, false
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(
+			http.MethodPost,
+			"/page",
+			strings.NewReader(url.Values{auth.TOTPField: {code}}.Encode()),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(pending)
+		handler(rec, req)
+		return rec.Result()
+	}
+	wrong := "000000"
+	if totpCode(enrollment.Secret, 1) == wrong {
+		wrong = "000001"
+	}
+	submit(wrong)
+	test.Attest(!nextHasBeenCalled, `"next" was called with the wrong code`)
+	test.Attest(codeRequested, "the code wasn't asked for again")
+
+	// the code from the current time step was used to confirm the enrollment
+	res := submit(totpCode(enrollment.Secret, 1))
+	test.Attest(nextHasBeenCalled, `"next" wasn't called with the right code`)
+	var session *http.Cookie
+	for _, cookie := range res.Cookies() {
+		switch cookie.Name {
+		case auth.SecondFactorCookieName:
+			test.Attest(cookie.MaxAge < 0, "the pending sign-in cookie wasn't cleared")
+		case mw.Cookie.CookieName():
+			session = cookie
+		}
+	}
+	test.NotNil(session, "no session cookie was set")
+
+	submit(totpCode(enrollment.Secret, 1))
+	test.Attest(!nextHasBeenCalled, `"next" was called for a finished sign-in`)
+	test.Attest(!codeRequested, "a code was asked for a finished sign-in")
+}
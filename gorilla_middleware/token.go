@@ -0,0 +1,114 @@
+package gorilla_middleware
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	auth "github.com/dscottboggs/go-middleware-session-auth"
+)
+
+// roles gets the roles to put in a new token for the user.
+func (m *Middleware) roles(user auth.Username) []string {
+	if m.Roles == nil {
+		return nil
+	}
+	return m.Roles(user)
+}
+
+// issueToken signs a new token for the user and sets it as the cookie. The
+// user authenticated by the given methods, or by password if there are none.
+func (m *Middleware) issueToken(
+	w http.ResponseWriter, user auth.Username, methods ...string,
+) (string, auth.Claims, error) {
+	if len(methods) == 0 {
+		methods = []string{auth.AuthPassword}
+	}
+	token, claims, err := m.Tokens.IssueAuthenticatedBy(user, methods, m.roles(user)...)
+	if err != nil {
+		return "", claims, err
+	}
+	http.SetCookie(w, m.Cookie.Cookie(token))
+	return token, claims, nil
+}
+
+// renewToken signs a replacement for the given token, sets it as the cookie,
+// and revokes the given token, so that it can't be renewed again.
+func (m *Middleware) renewToken(
+	w http.ResponseWriter, previous auth.Claims,
+) (auth.Claims, error) {
+	token, claims, err := m.Tokens.Renew(previous, m.roles(previous.User)...)
+	if err != nil {
+		return previous, err
+	}
+	http.SetCookie(w, m.Cookie.Cookie(token))
+	m.Tokens.Revoke(previous)
+	return claims, nil
+}
+
+// dueForRenewal reports whether the token should be replaced: when it has
+// less than half its lifetime left, unless its replacement would outlast the
+// maximum lifetime after the user signed in (see auth.SetMaxLifetime), in
+// which case it's left to expire like a session would.
+func (m *Middleware) dueForRenewal(claims auth.Claims) bool {
+	ttl := m.Tokens.EffectiveTTL()
+	if time.Until(claims.Expiry()) >= ttl/2 {
+		return false
+	}
+	if limit := auth.MaxLifetime(); limit > 0 && claims.AuthTime != 0 {
+		signedIn := time.Unix(claims.AuthTime, 0)
+		return time.Now().Add(ttl).Before(signedIn.Add(limit))
+	}
+	return true
+}
+
+// currentClaims verifies the token in the request's cookie.
+func (m *Middleware) currentClaims(r *http.Request) (auth.Claims, error) {
+	cookie, err := r.Cookie(m.Cookie.CookieName())
+	if err == http.ErrNoCookie {
+		return auth.Claims{}, errNoSession
+	} else if err != nil {
+		return auth.Claims{}, err
+	}
+	return m.Tokens.Verify(cookie.Value)
+}
+
+// bearerToken gets the token from an "Authorization: Bearer" header, if any.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > len("Bearer ") && strings.EqualFold(header[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(header[len("Bearer "):])
+	}
+	return ""
+}
+
+// tokenAuthentication authenticates the request by the signed token in its
+// cookie, without looking anything up in AllSessions.
+func (m *Middleware) tokenAuthentication(
+	w http.ResponseWriter, r *http.Request, next http.Handler,
+) {
+	claims, err := m.currentClaims(r)
+	if err != nil {
+		if err != errNoSession {
+			log.Printf("rejecting token for %s: %v\n", r.URL.String(), err)
+		}
+		m.noSessionHandler(w, r, next)
+		return
+	}
+	if err = auth.CheckCSRF(r, m.CSRF, m.Cookie, claims.Metadata()); err != nil {
+		log.Printf("rejecting %s %s: %v\n", r.Method, r.URL.Path, err)
+		auth.CSRFFailed(w, r)
+		return
+	}
+	if m.dueForRenewal(claims) {
+		// reissue the token rather than sign the user out mid-visit; the old
+		// one expires soon anyway
+		if renewed, err := m.renewToken(w, claims); err == nil {
+			claims = renewed
+		} else {
+			log.Printf("error renewing token for %s: %v\n", claims.User, err)
+		}
+	}
+	next.ServeHTTP(w, auth.WithClaims(r, claims))
+}
@@ -3,7 +3,6 @@ package auth
 import (
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"regexp"
@@ -45,7 +44,7 @@ var unauthenticated []*regexp.Regexp
 
 // IsUnauthenticatedEndpoint compares the given route to each of the
 // permissively-configured endpoints. If an enpdoint matches one of these
-// expressions, it will be allowed regardless of the BasicAuth header.
+// expressions, it will be allowed without a session or Authorization header.
 func IsUnauthenticatedEndpoint(route string) bool {
 	for _, uRte := range unauthenticated {
 		if uRte.MatchString(route) {
@@ -57,44 +56,71 @@ func IsUnauthenticatedEndpoint(route string) bool {
 
 func init() {
 	AllUsers = make(map[Username]*Token)
+}
+
+// ConfigureFromEnv sets ConfigLocation and the user file encryption key from
+// the environment. ConfigLocation is read from the file named by
+// $go_middleware_session_keys_file, or taken from $go_middleware_session_keys,
+// or defaults to auth.tokens in the config directory. The encryption key is
+// read from the file named by $go_middleware_session_users_key_file, or taken
+// from $go_middleware_session_users_key, and likewise the key TOTP secrets
+// are encrypted with from $go_middleware_session_totp_key_file or
+// $go_middleware_session_totp_key. Importing the package doesn't read the
+// environment or the filesystem; call this to opt in.
+func ConfigureFromEnv() error {
+	location, err := configLocationFromEnv()
+	if err != nil {
+		return err
+	}
+	ConfigLocation = location
 	wordListLocation = path.Join(ConfigLocation, "..", "wordlist.txt")
-	config_location_file := os.Getenv("go_middleware_session_keys_file")
-	if config_location_file != "" {
-		cfg_loc_bytes, err := ioutil.ReadFile(config_location_file)
+	if keyFile := os.Getenv("go_middleware_session_users_key_file"); keyFile != "" {
+		EncryptUserFileWith(KeyFile(keyFile))
+	} else if os.Getenv("go_middleware_session_users_key") != "" {
+		EncryptUserFileWith(EnvKey("go_middleware_session_users_key"))
+	}
+	if keyFile := os.Getenv("go_middleware_session_totp_key_file"); keyFile != "" {
+		EncryptTOTPSecretsWith(KeyFile(keyFile))
+	} else if os.Getenv("go_middleware_session_totp_key") != "" {
+		EncryptTOTPSecretsWith(EnvKey("go_middleware_session_totp_key"))
+	}
+	return nil
+}
+
+func configLocationFromEnv() (string, error) {
+	configLocationFile := os.Getenv("go_middleware_session_keys_file")
+	if configLocationFile != "" {
+		cfgLocBytes, err := ioutil.ReadFile(configLocationFile)
 		if err != nil {
-			log.Fatalf(
+			return "", fmt.Errorf(
 				"go_middleware_session_keys_file environment variable "+
 					`specified (as "%s"), but error "%v" when trying to read it`,
-				config_location_file,
+				configLocationFile,
 				err,
 			)
 		}
-		ConfigLocation = strings.TrimSpace(string(cfg_loc_bytes))
-		return
+		return strings.TrimSpace(string(cfgLocBytes)), nil
 	}
-	ConfigLocation := os.Getenv("go_middleware_session_keys")
-	if ConfigLocation == "" {
-		ConfigLocation = path.Join(
-			configDir(),
-			"auth.tokens",
-		)
+	if location := os.Getenv("go_middleware_session_keys"); location != "" {
+		return location, nil
 	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, "auth.tokens"), nil
 }
 
-func configDir() string {
-	configDirectory := os.Getenv("XGD_CONFIG_HOME")
-	if configDirectory != "" {
-		return configDirectory
-	}
-	homedir := os.Getenv("HOME")
-	if homedir == "" {
-		log.Fatal("Couldn't find home directory!")
-	}
-	return path.Join(
-		homedir,
-		".config",
-		"go-middleware-session-auth",
-	)
+func configDir() (string, error) {
+	configDirectory := os.Getenv("XDG_CONFIG_HOME")
+	if configDirectory == "" {
+		homedir := os.Getenv("HOME")
+		if homedir == "" {
+			return "", fmt.Errorf("Couldn't find home directory!")
+		}
+		configDirectory = path.Join(homedir, ".config")
+	}
+	return path.Join(configDirectory, "go-middleware-session-auth"), nil
 }
 
 // FirstRun Initializes the global varirables, creates a new user, then syncs
@@ -4,6 +4,7 @@ import (
 	"crypto/rand"
 	"encoding/gob"
 	"fmt"
+	"html/template"
 	"log"
 	"math/big"
 	"net/http"
@@ -16,7 +17,7 @@ import (
 
 const (
 	// SessionTokenCookie -- The key that the session is referenced by
-	SessionTokenCookie = "session_token"
+	SessionTokenCookie = auth.DefaultCookieName
 	// UserAuthSessionKey -- the key that the auth token is referenced by in the
 	// session
 	UserAuthSessionKey = "user_auth_session_key"
@@ -33,8 +34,16 @@ var (
 	sessionStore              *sessions.CookieStore
 )
 
+func init() {
+	gob.Register(&auth.Session{})
+}
+
 type signIn struct {
 	unauthorizedHandler http.HandlerFunc
+	secondFactorHandler http.HandlerFunc
+	cookie              auth.CookieOptions
+	csrf                auth.CSRFMode
+	credentials         auth.CredentialExtractor
 }
 
 func (this *signIn) ServeHTTP(
@@ -45,18 +54,83 @@ func (this *signIn) ServeHTTP(
 			"session store has not been set up. Call one of the " +
 				"{Key,Keyfile,ForceNewKeyfile}Session() initializer functions")
 	}
-	var (
-		user auth.Username
-		pass string
-	)
-	user = auth.Username(r.FormValue("user")) // r.FormValue accepts post
-	pass = r.FormValue("token")               // form or URL queries
+	user, pass, err := this.credentials.Credentials(r)
+	if err != nil {
+		fmt.Printf("rejecting sign in from %s: %v\n", r.RemoteAddr, err)
+		auth.RejectCredentials(w, err)
+		return
+	}
+	if user == "" {
+		if pending, _, ok := auth.PendingSecondFactor(r, this.cookie); ok {
+			this.secondFactor(w, r, next, pending)
+			return
+		}
+	}
+	if user != "" && this.csrf != auth.CSRFDisabled {
+		// there's no session yet, so check the double-submit cookie
+		if err := auth.CheckDoubleSubmit(r, this.cookie); err != nil {
+			fmt.Printf("rejecting sign in for user %s: %v\n", user, err)
+			auth.CSRFFailed(w, r)
+			return
+		}
+	}
 	if !user.IsAuthenticatedBy(pass) {
-		fmt.Printf("user %s failed to be authenticated with %s\n", user, pass)
+		fmt.Printf("user %s failed to be authenticated\n", user)
 		this.unauthorizedHandler(w, r)
 		return
 	}
-	session, err := sessionStore.Get(r, SessionTokenCookie)
+	if user.HasTOTP() {
+		if err = auth.BeginSecondFactor(w, r, user, this.cookie); err != nil {
+			fmt.Printf("ERROR: couldn't start two-factor sign in for %s: %v\n", user, err)
+			this.unauthorizedHandler(w, r)
+			return
+		}
+		this.secondFactorHandler(w, r)
+		return
+	}
+	this.startSession(w, r, next, user)
+}
+
+// secondFactor checks the two-factor code submitted for a pending sign-in,
+// and signs the user in if it's correct.
+func (this *signIn) secondFactor(
+	w http.ResponseWriter, r *http.Request, next http.HandlerFunc,
+	pending auth.Session,
+) {
+	code := r.PostFormValue(auth.TOTPField)
+	if code == "" {
+		this.secondFactorHandler(w, r)
+		return
+	}
+	if this.csrf != auth.CSRFDisabled {
+		if err := auth.CheckDoubleSubmit(r, this.cookie); err != nil {
+			fmt.Printf("rejecting two-factor code from %s: %v\n", r.RemoteAddr, err)
+			auth.CSRFFailed(w, r)
+			return
+		}
+	}
+	user, err := pending.CompleteSecondFactor(code)
+	if err != nil {
+		fmt.Printf("rejecting two-factor code from %s: %v\n", r.RemoteAddr, err)
+		if pending.CurrentlyExists() {
+			this.secondFactorHandler(w, r)
+		} else {
+			auth.EndSecondFactor(w, this.cookie)
+			this.unauthorizedHandler(w, r)
+		}
+		return
+	}
+	auth.EndSecondFactor(w, this.cookie)
+	this.startSession(w, r, next, user, auth.AuthPassword, auth.AuthOTP)
+}
+
+// startSession signs in a user who has just authenticated by the given
+// methods.
+func (this *signIn) startSession(
+	w http.ResponseWriter, r *http.Request, next http.HandlerFunc,
+	user auth.Username, methods ...string,
+) {
+	session, err := sessionStore.Get(r, this.cookie.CookieName())
 	if err != nil {
 		fmt.Printf(
 			"ERROR: user %s was successfully authenticated, but error %v "+
@@ -68,7 +142,14 @@ func (this *signIn) ServeHTTP(
 		this.unauthorizedHandler(w, r)
 		return
 	}
-	session.Values[UserAuthSessionKey] = auth.NewSession()
+	token, _, err := auth.NewSessionForClient(user, r, methods...)
+	if err != nil {
+		fmt.Printf("rejecting sign in for user %s: %v\n", user, err)
+		auth.RejectCredentials(w, err)
+		return
+	}
+	session.Values[UserAuthSessionKey] = token
+	session.Options = this.cookie.SessionsOptions()
 	if err = session.Save(r, w); err != nil {
 		fmt.Printf(
 			"ERROR: user %s was successfully authenticated, but error %v "+
@@ -80,7 +161,6 @@ func (this *signIn) ServeHTTP(
 		this.unauthorizedHandler(w, r)
 		return
 	}
-	session.Save(r, w)
 	next(w, r)
 }
 
@@ -120,13 +200,85 @@ func (this *sessionSettingsChainer) WithSpecifiedKey(
 	return &handlerSettingsChainer{}
 }
 
-type handlerSettingsChainer struct{}
+type handlerSettingsChainer struct {
+	cookie       auth.CookieOptions
+	csrf         auth.CSRFMode
+	credentials  auth.CredentialExtractor
+	secondFactor http.HandlerFunc
+}
+
+// WithCookieOptions sets the attributes of the session cookie set on sign-in.
+// Use the same options for the Session middleware.
+func (this *handlerSettingsChainer) WithCookieOptions(
+	options auth.CookieOptions,
+) *handlerSettingsChainer {
+	if err := options.Validate(); err != nil {
+		log.Fatalf("invalid session cookie options: %v", err)
+	}
+	this.cookie = options
+	return this
+}
+
+// WithCSRF selects how sign-in requests are protected from cross-site request
+// forgery. Whatever the mode, sign-in requests which carry credentials or a
+// two-factor code are checked against the double-submit cookie unless it's
+// auth.CSRFDisabled.
+func (this *handlerSettingsChainer) WithCSRF(
+	mode auth.CSRFMode,
+) *handlerSettingsChainer {
+	this.csrf = mode
+	return this
+}
+
+// WithCredentialPolicy controls how credentials may be submitted. Without
+// it they're accepted from the query string or a form in any request.
+func (this *handlerSettingsChainer) WithCredentialPolicy(
+	policy auth.CredentialPolicy,
+) *handlerSettingsChainer {
+	this.credentials = &policy
+	return this
+}
+
+// WithCredentials sets how credentials are read from sign-in requests, for
+// example with custom field names:
+//
+//	WithCredentials(auth.FormCredentials{UserField: "email", TokenField: "password"})
+func (this *handlerSettingsChainer) WithCredentials(
+	extractor auth.CredentialExtractor,
+) *handlerSettingsChainer {
+	this.credentials = extractor
+	return this
+}
+
+// WithSecondFactor sets the handler which asks users enrolled in two-factor
+// authentication for the code from their authenticator app, after they've
+// entered their password and when they enter a wrong code. It should POST the
+// code back to the sign-in route in the auth.TOTPField form field. Without
+// it, the unauthorized handler is called.
+func (this *handlerSettingsChainer) WithSecondFactor(
+	handler http.HandlerFunc,
+) *handlerSettingsChainer {
+	this.secondFactor = handler
+	return this
+}
 
 func (this *handlerSettingsChainer) WhenUnauthorized(
 	unauthorized http.HandlerFunc,
 ) *signIn {
+	credentials := this.credentials
+	if credentials == nil {
+		credentials = auth.LenientCredentials
+	}
+	secondFactor := this.secondFactor
+	if secondFactor == nil {
+		secondFactor = unauthorized
+	}
 	return &signIn{
 		unauthorizedHandler: unauthorized,
+		secondFactorHandler: secondFactor,
+		cookie:              this.cookie,
+		csrf:                this.csrf,
+		credentials:         credentials,
 	}
 }
 
@@ -136,6 +288,21 @@ func NewSignIn() *sessionSettingsChainer {
 
 type Session struct {
 	LoginHandler http.HandlerFunc
+	// Cookie configures the session cookie; it must match the options given
+	// to the sign-in middleware.
+	Cookie auth.CookieOptions
+	// CSRF selects how unsafe requests are protected from cross-site request
+	// forgery. Defaults to auth.CSRFSynchronizer.
+	CSRF auth.CSRFMode
+	// Schemes chooses how requests to each route may be authenticated. If
+	// it's nil only session cookies are accepted.
+	Schemes *auth.SchemePolicy
+	// Credentials holds Basic credentials to a policy. If it's nil they're
+	// only accepted over TLS.
+	Credentials *auth.CredentialPolicy
+	// Binding, if set, binds sessions to attributes of the client which
+	// started them.
+	Binding *auth.BindingPolicy
 }
 
 func SessionAuth(login http.HandlerFunc) *Session {
@@ -150,7 +317,38 @@ func (this *Session) ServeHTTP(
 			"session store has not been set up. Call one of the " +
 				"{Key,Keyfile,ForceNewKeyfile}Session() initializer functions")
 	}
-	session, err := sessionStore.Get(r, SessionTokenCookie)
+	schemes := this.Schemes.SchemesFor(r.URL.Path)
+	if schemes.Allows(auth.SchemeAPIKey) {
+		authenticated, ok, err := auth.AuthenticateAPIKey(r)
+		if err != nil {
+			log.Printf("rejecting %s %s: %v\n", r.Method, r.URL.Path, err)
+			auth.Challenge(w, schemes, err)
+			return
+		}
+		if ok {
+			next(w, authenticated)
+			return
+		}
+	}
+	if schemes.Allows(auth.SchemeBasic | auth.SchemeBearer) {
+		authenticated, scheme, err := auth.AuthenticateHeader(
+			r, schemes, nil, this.Credentials, this.Binding,
+		)
+		if err != nil {
+			log.Printf("rejecting %s %s: %v\n", r.Method, r.URL.Path, err)
+			auth.Challenge(w, schemes, err)
+			return
+		}
+		if scheme != 0 {
+			next(w, authenticated)
+			return
+		}
+	}
+	if !schemes.Allows(auth.SchemeCookie) {
+		auth.Challenge(w, schemes, nil)
+		return
+	}
+	session, err := sessionStore.Get(r, this.Cookie.CookieName())
 	if err != nil {
 		log.Printf(
 			"error getting cookie for %s: %v\n",
@@ -160,15 +358,128 @@ func (this *Session) ServeHTTP(
 		this.LoginHandler(w, r)
 		return
 	}
-	token := session.Values[UserAuthSessionKey]
-	if token != nil && auth.HasSession(token.(string)) {
-		next(w, r)
-		return
+	if token, ok := sessionFrom(session.Values[UserAuthSessionKey]); ok {
+		if metadata, exists := token.Touch(); exists {
+			if err = this.Binding.Enforce(r, token, metadata); err != nil {
+				if this.Binding.OnMismatch == auth.ReauthenticateOnMismatch {
+					this.LoginHandler(w, r)
+				} else {
+					w.WriteHeader(http.StatusUnauthorized)
+					fmt.Fprintf(w, "%d Unauthorized", http.StatusUnauthorized)
+				}
+				return
+			}
+			if err = auth.CheckCSRF(r, this.CSRF, this.Cookie, metadata); err != nil {
+				log.Printf("rejecting %s %s: %v\n", r.Method, r.URL.Path, err)
+				auth.CSRFFailed(w, r)
+				return
+			}
+			next(w, r)
+			return
+		}
 	}
 	log.Printf("authentication unsuccessful for '%s'\n", r.URL.RawPath)
 	this.LoginHandler(w, r)
 }
 
+// CSRFToken gets the token which must accompany unsafe requests, for
+// embedding in forms or handing to scripts. For signed-in users in
+// synchronizer mode it's their session's token; otherwise it's the value of
+// the double-submit cookie, which is set on the response if necessary.
+func (this *Session) CSRFToken(
+	w http.ResponseWriter, r *http.Request,
+) (string, error) {
+	if this.CSRF == auth.CSRFSynchronizer && sessionStore != nil {
+		session, err := sessionStore.Get(r, this.Cookie.CookieName())
+		if err == nil {
+			token, ok := sessionFrom(session.Values[UserAuthSessionKey])
+			if metadata, exists := token.GetMetadata(); ok && exists {
+				return metadata.CSRFToken, nil
+			}
+		}
+	}
+	return auth.EnsureCSRFCookie(w, r, this.Cookie)
+}
+
+// CSRFTemplateField renders a hidden form field holding the CSRF token, for
+// use in login and form templates.
+func (this *Session) CSRFTemplateField(
+	w http.ResponseWriter, r *http.Request,
+) template.HTML {
+	token, err := this.CSRFToken(w, r)
+	if err != nil {
+		log.Printf("error getting CSRF token for %s: %v\n", r.URL.String(), err)
+		return ""
+	}
+	return auth.CSRFTemplateField(token)
+}
+
+// Logout is a handler which signs the user out: it deletes their session,
+// clears the session cookie and calls LoggedOut. Only POST requests are
+// accepted, so that links and images on other sites can't sign users out, and
+// they're checked for CSRF like any other unsafe request. Its Cookie and CSRF
+// must match the session middleware's.
+type Logout struct {
+	Cookie auth.CookieOptions
+	CSRF   auth.CSRFMode
+	// LoggedOut responds once the user is signed out. By default it responds
+	// "204 No Content".
+	LoggedOut http.HandlerFunc
+}
+
+func (this *Logout) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "%d %s", http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	if sessionStore == nil {
+		log.Fatal(
+			"session store has not been set up. Call one of the " +
+				"{Key,Keyfile,ForceNewKeyfile}Session() initializer functions")
+	}
+	session, err := sessionStore.Get(r, this.Cookie.CookieName())
+	if err == nil {
+		if token, ok := sessionFrom(session.Values[UserAuthSessionKey]); ok {
+			// without a session there's nothing to protect
+			if metadata, exists := token.GetMetadata(); exists {
+				if err = auth.CheckCSRF(r, this.CSRF, this.Cookie, metadata); err != nil {
+					log.Printf("rejecting logout for %s: %v\n", metadata.User, err)
+					auth.CSRFFailed(w, r)
+					return
+				}
+				token.Delete()
+			}
+		}
+		delete(session.Values, UserAuthSessionKey)
+		session.Options = this.Cookie.SessionsOptions()
+		session.Options.MaxAge = -1
+		if err = session.Save(r, w); err != nil {
+			log.Printf("error clearing session cookie: %v\n", err)
+		}
+	}
+	if this.LoggedOut != nil {
+		this.LoggedOut(w, r)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sessionFrom gets the auth.Session out of a session value, which is a pointer
+// after being decoded from a cookie.
+func sessionFrom(value interface{}) (auth.Session, bool) {
+	switch token := value.(type) {
+	case auth.Session:
+		return token, true
+	case *auth.Session:
+		if token != nil {
+			return *token, true
+		}
+	}
+	return auth.Session{}, false
+}
+
 func readKeyFrom(keyfile string) ([][]byte, error) {
 	keys := make([][]byte, 1)
 	file, err := os.Open(keyfile)
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
@@ -142,6 +143,25 @@ func TestSignIn(t *testing.T) {
 				test.Equals(response[i], b)
 			}
 		})
+		st.Run("POST without credentials", func(st *testing.T) {
+			test := attest.New(st)
+			unAuthorizedCallbackCalled = false
+			authorizedCallbackCalled = false
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "/login", nil)
+			NewSignIn().
+				WithSpecifiedKey(key).
+				WithCSRF(auth.CSRFSynchronizer).
+				WhenUnauthorized(unAuthorizedCallback).
+				ServeHTTP(rec, req, authorizedCallback)
+			if authorizedCallbackCalled {
+				test.Error(`the "authorized" callback was called`)
+			}
+			if !unAuthorizedCallbackCalled {
+				test.Error(`the "unauthorized" callback was not called.`)
+			}
+			test.Equals(http.StatusOK, rec.Result().StatusCode)
+		})
 
 	})
 }
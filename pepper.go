@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"fmt"
+	"log"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var (
+	// peppers maps each pepper version to its secret. Version 0 is reserved
+	// for "no pepper".
+	peppers     = make(map[uint8][]byte)
+	peppersLock sync.RWMutex
+	// the version new tokens are created with
+	currentPepper uint8
+)
+
+// AddPepper registers a server-side secret which is mixed into password hashes
+// as an HMAC-SHA512 of the password before it's run through the KDF. Peppers
+// must be stored separately from the user file, so that the user file alone
+// isn't enough to brute-force passwords offline. Each Token records the
+// version it was hashed with, so old versions must stay registered until no
+// tokens use them anymore.
+func AddPepper(version uint8, secret []byte) error {
+	if version == 0 {
+		return fmt.Errorf("pepper version 0 is reserved for unpeppered tokens")
+	}
+	if len(secret) == 0 {
+		return fmt.Errorf("empty pepper for version %d", version)
+	}
+	peppersLock.Lock()
+	defer peppersLock.Unlock()
+	peppers[version] = append([]byte(nil), secret...)
+	return nil
+}
+
+// UsePepper sets the pepper version that new and changed passwords are hashed
+// with. Tokens hashed with another version are re-hashed with this one the
+// next time their user signs in, so peppers can be rotated gradually. Version
+// 0 turns peppering off.
+func UsePepper(version uint8) error {
+	peppersLock.Lock()
+	defer peppersLock.Unlock()
+	if _, ok := peppers[version]; version != 0 && !ok {
+		return fmt.Errorf("pepper version %d has not been added", version)
+	}
+	currentPepper = version
+	return nil
+}
+
+// RemovePepper forgets the pepper with the given version. It refuses to
+// remove the version new passwords are hashed with, or one which any user's
+// password, API keys or recovery codes are still hashed with; call UsePepper
+// to move off it and wait for those users to sign in again first.
+func RemovePepper(version uint8) error {
+	if user, ok := pepperInUse(version); ok {
+		return fmt.Errorf(
+			"not removing pepper version %d; %s's secrets are still hashed with it",
+			version,
+			user,
+		)
+	}
+	peppersLock.Lock()
+	defer peppersLock.Unlock()
+	if currentPepper == version {
+		return fmt.Errorf(
+			"not removing pepper version %d; it's the current version",
+			version,
+		)
+	}
+	delete(peppers, version)
+	return nil
+}
+
+// pepperInUse finds a user with a secret hashed with the given pepper version.
+func pepperInUse(version uint8) (Username, bool) {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	for name, token := range AllUsers {
+		if token.PepperVersion == version {
+			return name, true
+		}
+		for _, key := range token.APIKeys {
+			if key.PepperVersion == version {
+				return name, true
+			}
+		}
+		if len(token.RecoveryCodes.Hashes) > 0 &&
+			token.RecoveryCodes.PepperVersion == version {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func currentPepperVersion() uint8 {
+	peppersLock.RLock()
+	defer peppersLock.RUnlock()
+	return currentPepper
+}
+
+// hashSecret runs the secret through the pepper with the given version, if
+// any, and then the KDF.
+func hashSecret(
+	secret []byte, s salt, pepperVersion uint8,
+) (hash [KeyLength]byte, err error) {
+	if pepperVersion != 0 {
+		peppersLock.RLock()
+		pepper, ok := peppers[pepperVersion]
+		peppersLock.RUnlock()
+		if !ok {
+			err = fmt.Errorf("pepper version %d is not configured", pepperVersion)
+			return
+		}
+		mac := hmac.New(sha512.New, pepper)
+		mac.Write(secret)
+		secret = mac.Sum(nil)
+	}
+	copy(hash[:], pbkdf2.Key(secret, s[:], Iterations, KeyLength, sha512.New))
+	return
+}
+
+// repepper re-hashes the user's token with the current pepper if it was
+// hashed with another one. It's called after the password has been verified.
+func (u *Username) repepper(password string, token *Token) {
+	if token.PepperVersion == currentPepperVersion() {
+		return
+	}
+	newToken, err := NewAuthToken([]byte(password))
+	if err != nil {
+		log.Printf("error re-hashing token for %s with the current pepper: %v", *u, err)
+		return
+	}
+	if err = u.replaceSecret(newToken); err != nil {
+		log.Printf("error re-hashing token for %s with the current pepper: %v", *u, err)
+		return
+	}
+	if err = SyncAllUsers(); err != nil {
+		log.Printf("error saving re-hashed token for %s: %v", *u, err)
+	}
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestPepper(t *testing.T) {
+	const password = "test pepper user's password"
+	var (
+		test = attest.New(t)
+		user = Username("test pepper user")
+	)
+	defer func() {
+		peppersLock.Lock()
+		peppers = make(map[uint8][]byte)
+		currentPepper = 0
+		peppersLock.Unlock()
+	}()
+	AllUsers = make(UserCollection)
+	test.Handle(CreateNewUser(string(user), password))
+	test.Equals(uint8(0), lookupUser(user).PepperVersion)
+	test.NotNil(UsePepper(1), "got nil error using a pepper which wasn't added")
+	test.NotNil(AddPepper(0, []byte("x")), "got nil error adding version 0")
+	test.Handle(AddPepper(1, []byte("test pepper v1")))
+	test.Handle(UsePepper(1))
+	t.Run("unpeppered token is re-hashed on sign in", func(t *testing.T) {
+		test := attest.New(t)
+		test.Attest(user.IsAuthenticatedBy(password), "user failed authentication")
+		test.Equals(uint8(1), lookupUser(user).PepperVersion)
+		test.Attest(
+			user.IsAuthenticatedBy(password),
+			"user failed authentication after re-hashing",
+		)
+		test.Attest(
+			!user.IsAuthenticatedBy("wrong password"),
+			"user was authenticated by the wrong password",
+		)
+	})
+	t.Run("rotation", func(t *testing.T) {
+		test := attest.New(t)
+		test.Handle(AddPepper(2, []byte("test pepper v2")))
+		test.Handle(UsePepper(2))
+		test.Attest(user.IsAuthenticatedBy(password), "user failed authentication")
+		test.Equals(uint8(2), lookupUser(user).PepperVersion)
+		test.Handle(RemovePepper(1))
+		test.Attest(
+			user.IsAuthenticatedBy(password),
+			"user failed authentication after the old pepper was removed",
+		)
+	})
+	t.Run("removing a pepper in use", func(t *testing.T) {
+		test := attest.New(t)
+		test.NotNil(RemovePepper(2), "removed the current pepper")
+		test.Handle(UsePepper(0))
+		test.NotNil(
+			RemovePepper(2),
+			"removed a pepper a user's token is still hashed with",
+		)
+		test.Equals(uint8(2), lookupUser(user).PepperVersion)
+	})
+	t.Run("missing pepper", func(t *testing.T) {
+		test := attest.New(t)
+		peppersLock.Lock()
+		delete(peppers, 2)
+		peppersLock.Unlock()
+		test.Attest(
+			!user.IsAuthenticatedBy(password),
+			"user was authenticated without their pepper",
+		)
+	})
+}
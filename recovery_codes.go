@@ -0,0 +1,173 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// the number of recovery codes a user is given
+	recoveryCodeCount = 10
+	// the number of characters in a recovery code, not counting the dash
+	// in the middle: 50 bits
+	recoveryCodeLength = 10
+	// recoveryCodeAlphabet leaves out characters which are easily mistaken
+	// for each other
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+)
+
+// RecoveryCodes are one-time codes which a user enrolled in two-factor
+// authentication can enter instead of a code from their authenticator app,
+// e.g. when they've lost it. Only their hashes are stored; the codes are
+// shown once, when they're generated.
+type RecoveryCodes struct {
+	// the codes are hashed with the same salt, so that a code can be checked
+	// against all of them with one run of the KDF
+	Salt          salt
+	PepperVersion uint8
+	// Hashes of the codes which haven't been used yet.
+	Hashes    [][KeyLength]byte
+	Generated time.Time
+}
+
+// newRecoveryCodes generates a set of codes and their hashes.
+func newRecoveryCodes() (codes []string, hashed RecoveryCodes, err error) {
+	if err = hashed.Salt.Randomize(); err != nil {
+		return
+	}
+	hashed.PepperVersion = currentPepperVersion()
+	hashed.Generated = time.Now()
+	for i := 0; i < recoveryCodeCount; i++ {
+		var code []byte
+		if code, err = randomRecoveryCode(); err != nil {
+			return
+		}
+		var hash [KeyLength]byte
+		hash, err = hashSecret(code, hashed.Salt, hashed.PepperVersion)
+		if err != nil {
+			return
+		}
+		hashed.Hashes = append(hashed.Hashes, hash)
+		half := recoveryCodeLength / 2
+		codes = append(codes, string(code[:half])+"-"+string(code[half:]))
+	}
+	return
+}
+
+// randomRecoveryCode picks recoveryCodeLength characters uniformly from
+// recoveryCodeAlphabet. 256 isn't a multiple of the alphabet's length, so
+// random bytes at or above the largest multiple are thrown away rather than
+// wrapped around, which would make the first few characters more likely.
+func randomRecoveryCode() ([]byte, error) {
+	limit := 256 - 256%len(recoveryCodeAlphabet)
+	code := make([]byte, 0, recoveryCodeLength)
+	random := make([]byte, recoveryCodeLength)
+	for len(code) < recoveryCodeLength {
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+		for _, b := range random {
+			if int(b) < limit && len(code) < recoveryCodeLength {
+				code = append(code, recoveryCodeAlphabet[int(b)%len(recoveryCodeAlphabet)])
+			}
+		}
+	}
+	return code, nil
+}
+
+// normalizeRecoveryCode ignores the case, spaces and dashes of a code as it
+// was typed.
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(
+		strings.ToLower(strings.TrimSpace(code)),
+	)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes with a new set,
+// which is returned. The returned codes are the only copy; they can't be
+// recovered later. The user must have enrolled in two-factor authentication.
+func (u *Username) RegenerateRecoveryCodes() ([]string, error) {
+	codes, hashed, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = updateUser(*u, func(token *Token) error {
+		if len(token.TOTP.Sealed) == 0 {
+			return fmt.Errorf("%s is not enrolled in two-factor authentication", *u)
+		}
+		token.RecoveryCodes = hashed
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = SyncAllUsers(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RecoveryCodesLeft counts the user's unused recovery codes.
+func (u *Username) RecoveryCodesLeft() int {
+	token := lookupUser(*u)
+	if token == nil {
+		return 0
+	}
+	return len(token.RecoveryCodes.Hashes)
+}
+
+// UseRecoveryCode checks a recovery code and, if it's one of the user's
+// unused codes, uses it up. The error for any other code satisfies
+// IsInvalidTOTPCode.
+func (u *Username) UseRecoveryCode(code string) error {
+	token := lookupUser(*u)
+	if token == nil {
+		return NoSuchUser(u)
+	}
+	if !token.TOTP.Confirmed {
+		return fmt.Errorf("%s hasn't confirmed two-factor authentication", *u)
+	}
+	hashed := token.RecoveryCodes
+	hash, err := hashSecret([]byte(normalizeRecoveryCode(code)), hashed.Salt, hashed.PepperVersion)
+	if err != nil {
+		return err
+	}
+	var left int
+	err = updateUser(*u, func(token *Token) error {
+		if token.RecoveryCodes.Salt != hashed.Salt {
+			// the codes were regenerated in the meantime
+			return InvalidTOTPCode(u)
+		}
+		for index, stored := range token.RecoveryCodes.Hashes {
+			if subtle.ConstantTimeCompare(hash[:], stored[:]) == 1 {
+				// the slice may be shared with the previous token
+				remaining := make([][KeyLength]byte, 0, len(token.RecoveryCodes.Hashes)-1)
+				remaining = append(remaining, token.RecoveryCodes.Hashes[:index]...)
+				remaining = append(remaining, token.RecoveryCodes.Hashes[index+1:]...)
+				token.RecoveryCodes.Hashes = remaining
+				left = len(remaining)
+				return nil
+			}
+		}
+		return InvalidTOTPCode(u)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("%s used a recovery code; %d are left\n", *u, left)
+	return SyncAllUsers()
+}
+
+// VerifySecondFactor checks a code from the user's authenticator app, or
+// else one of their recovery codes, which is then used up. Errors for wrong
+// codes satisfy IsInvalidTOTPCode.
+func (u *Username) VerifySecondFactor(code string) error {
+	if err := u.VerifyTOTP(code); err == nil || !IsInvalidTOTPCode(err) {
+		return err
+	}
+	return u.UseRecoveryCode(code)
+}
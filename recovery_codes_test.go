@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestRecoveryCodes(t *testing.T) {
+	const password = "test recovery code user's password"
+	var (
+		test = attest.New(t)
+		user = Username("test recovery code user")
+		now  = time.Unix(1700000000, 0)
+	)
+	AllUsers = make(UserCollection)
+	test.Handle(CreateNewUser(string(user), password))
+	totpNow = func() time.Time { return now }
+	defer func() { totpNow = time.Now }()
+	EncryptTOTPSecretsWith(StaticKey("test TOTP key"))
+	defer EncryptTOTPSecretsWith(nil)
+
+	_, err := user.RegenerateRecoveryCodes()
+	test.NotNil(err, "recovery codes were generated for a user without two factors")
+	enrollment, err := user.EnrollTOTP("test")
+	test.Handle(err)
+	codes := enrollment.RecoveryCodes
+	test.Equals(recoveryCodeCount, len(codes))
+	test.Equals(recoveryCodeCount, user.RecoveryCodesLeft())
+	for _, hash := range lookupUser(user).RecoveryCodes.Hashes {
+		test.Attest(
+			!bytes.Contains(hash[:], []byte(normalizeRecoveryCode(codes[0]))),
+			"a recovery code was stored in plain text",
+		)
+	}
+	test.NotNil(
+		user.UseRecoveryCode(codes[0]),
+		"a recovery code was used before the enrollment was confirmed",
+	)
+	secret := test.EatError(totpEncoding.DecodeString(enrollment.Secret)).([]byte)
+	test.Handle(user.ConfirmTOTP(totpCode(secret, uint64(now.Unix())/totpPeriod)))
+
+	// codes are accepted however they're typed, but only once
+	test.Handle(user.VerifySecondFactor(" " + strings.ToUpper(codes[0]) + " "))
+	test.Equals(recoveryCodeCount-1, user.RecoveryCodesLeft())
+	test.Attest(
+		IsInvalidTOTPCode(user.VerifySecondFactor(codes[0])),
+		"a recovery code was accepted twice",
+	)
+	test.Attest(
+		IsInvalidTOTPCode(user.VerifySecondFactor("aaaaa-aaaaa")),
+		"a made up recovery code was accepted",
+	)
+
+	t.Run("signing in", func(t *testing.T) {
+		test := attest.New(t)
+		pending, _, err := NewPendingSession(user, httptest.NewRequest("POST", "/", nil))
+		test.Handle(err)
+		signedIn, err := pending.CompleteSecondFactor(strings.Replace(codes[1], "-", "", 1))
+		test.Handle(err)
+		test.Equals(user, signedIn)
+		test.Equals(recoveryCodeCount-2, user.RecoveryCodesLeft())
+	})
+	t.Run("regenerating", func(t *testing.T) {
+		test := attest.New(t)
+		newCodes, err := user.RegenerateRecoveryCodes()
+		test.Handle(err)
+		test.Equals(recoveryCodeCount, user.RecoveryCodesLeft())
+		test.Attest(
+			IsInvalidTOTPCode(user.VerifySecondFactor(codes[2])),
+			"a replaced recovery code was accepted",
+		)
+		test.Handle(user.VerifySecondFactor(newCodes[0]))
+	})
+	t.Run("reset", func(t *testing.T) {
+		test := attest.New(t)
+		test.Handle(user.ResetTOTP())
+		test.Equals(0, user.RecoveryCodesLeft())
+	})
+	t.Run("characters", func(t *testing.T) {
+		test := attest.New(t)
+		counts := make(map[byte]int)
+		for i := 0; i < 1000; i++ {
+			code, err := randomRecoveryCode()
+			test.Handle(err)
+			test.Equals(recoveryCodeLength, len(code))
+			for _, c := range code {
+				counts[c]++
+			}
+		}
+		test.Equals(len(recoveryCodeAlphabet), len(counts))
+		for c := range counts {
+			test.Attest(
+				strings.IndexByte(recoveryCodeAlphabet, c) >= 0,
+				"%q isn't in the recovery code alphabet", c,
+			)
+		}
+	})
+}
@@ -0,0 +1,325 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// how long access sessions created by NewAccessSessionFor last
+	accessExpiryDelay = 15 * time.Minute
+	// how long a refresh token family lasts without being used
+	refreshExpiryDelay = 30 * 24 * time.Hour
+	// refreshFamilies maps each family's ID to the family
+	refreshFamilies = make(map[string]*refreshFamily)
+	refreshLock     sync.Mutex
+)
+
+// refreshFamily is the chain of refresh tokens descended from one sign-in.
+// Only the latest token may be used; presenting an earlier one means it was
+// stolen, so the whole family is revoked.
+type refreshFamily struct {
+	user Username
+	// authenticatedAt and methods are when and how the user signed in, which
+	// the access sessions and tokens issued to the family keep
+	authenticatedAt time.Time
+	methods         []string
+	current         [sha256.Size]byte
+	used            map[[sha256.Size]byte]bool
+	// sessions are the access sessions issued to the family
+	sessions []Session
+	// tokens are the signed access tokens issued to the family
+	tokens []issuedToken
+	expiry time.Time
+}
+
+// issuedToken is a signed access token and the signer to revoke it with.
+type issuedToken struct {
+	signer *TokenSigner
+	claims Claims
+}
+
+type refreshTokenReused struct{ error }
+
+// IsRefreshTokenReused returns true if an error was returned because a
+// refresh token which had already been used was presented again.
+func IsRefreshTokenReused(err error) bool {
+	_, ok := err.(refreshTokenReused)
+	return ok
+}
+
+// SetRefreshExpiry sets how long access sessions created by
+// NewAccessSessionFor last, and how long a refresh token lasts without being
+// used.
+func SetRefreshExpiry(access, refresh time.Duration) {
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+	accessExpiryDelay = access
+	refreshExpiryDelay = refresh
+}
+
+// rotate sets a new current secret for the family and returns the token to
+// hand to the client. refreshLock must be held.
+func (f *refreshFamily) rotate(id string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	if f.used == nil {
+		f.used = make(map[[sha256.Size]byte]bool)
+	} else {
+		f.used[f.current] = true
+	}
+	f.current = sha256.Sum256(secret)
+	f.expiry = time.Now().Add(refreshExpiryDelay)
+	return id + "." + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// revoke deletes the family and the access sessions and tokens issued to it.
+// refreshLock must be held.
+func (f *refreshFamily) revoke(id string) {
+	for _, s := range f.sessions {
+		s.Delete()
+	}
+	for _, t := range f.tokens {
+		t.signer.Revoke(t.claims)
+	}
+	delete(refreshFamilies, id)
+}
+
+// NewRefreshToken starts a new refresh token family for the user, who
+// authenticated at the given time by the given methods. The access sessions
+// and tokens issued to the family keep them, so that refreshing doesn't count
+// as signing in again. The token is only stored hashed.
+func NewRefreshToken(
+	user Username, authenticatedAt time.Time, methods []string,
+) (string, error) {
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(random)
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+	family := &refreshFamily{
+		user:            user,
+		authenticatedAt: authenticatedAt,
+		methods:         append([]string(nil), methods...),
+	}
+	token, err := family.rotate(id)
+	if err != nil {
+		return "", err
+	}
+	refreshFamilies[id] = family
+	return token, nil
+}
+
+func parseRefreshToken(token string) (id string, hash [sha256.Size]byte, ok bool) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return
+	}
+	secret, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil {
+		return
+	}
+	return token[:dot], sha256.Sum256(secret), true
+}
+
+// RotateRefreshToken exchanges a refresh token for the next one in its
+// family. If the token has already been used, the whole family is revoked,
+// along with the access sessions and tokens issued to it, and the error
+// satisfies IsRefreshTokenReused.
+func RotateRefreshToken(token string) (user Username, next string, err error) {
+	id, hash, ok := parseRefreshToken(token)
+	if !ok {
+		return "", "", fmt.Errorf("malformed refresh token")
+	}
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+	family := refreshFamilies[id]
+	if family == nil {
+		return "", "", fmt.Errorf("unknown or revoked refresh token")
+	}
+	if family.used[hash] {
+		log.Printf(
+			"WARNING refresh token for %s was reused; revoking all of its "+
+				"sessions",
+			family.user,
+		)
+		family.revoke(id)
+		return "", "", refreshTokenReused{
+			fmt.Errorf("refresh token was already used"),
+		}
+	}
+	if hash != family.current {
+		return "", "", fmt.Errorf("invalid refresh token")
+	}
+	if family.expiry.Before(time.Now()) {
+		family.revoke(id)
+		return "", "", fmt.Errorf("refresh token expired")
+	}
+	next, err = family.rotate(id)
+	return family.user, next, err
+}
+
+// NewAccessSessionFor creates a short-lived access session for the user the
+// refresh token belongs to. It's revoked along with the token's family. The
+// token must be the family's current one.
+func NewAccessSessionFor(refresh string) (Session, *SessionMetadata, error) {
+	id, hash, ok := parseRefreshToken(refresh)
+	if !ok {
+		return Session{}, nil, fmt.Errorf("malformed refresh token")
+	}
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+	family := refreshFamilies[id]
+	if family == nil || family.current != hash {
+		return Session{}, nil, fmt.Errorf("unknown or revoked refresh token")
+	}
+	access, metadata, err := newSession(&SessionMetadata{
+		User:            family.user,
+		AuthenticatedAt: family.authenticatedAt,
+		AuthMethods:     append([]string(nil), family.methods...),
+	})
+	if err != nil {
+		return Session{}, nil, err
+	}
+	access.ExpireIn(accessExpiryDelay)
+	// forget the sessions which have expired since
+	live := family.sessions[:0]
+	for _, s := range family.sessions {
+		if s.CurrentlyExists() {
+			live = append(live, s)
+		}
+	}
+	family.sessions = append(live, access)
+	return access, metadata, nil
+}
+
+// NewAccessTokenFor signs a short-lived token with the given roles for the
+// user the refresh token belongs to. It's revoked along with the token's
+// family. The token must be the family's current one.
+func NewAccessTokenFor(
+	refresh string, signer *TokenSigner, roles ...string,
+) (string, Claims, error) {
+	id, hash, ok := parseRefreshToken(refresh)
+	if !ok {
+		return "", Claims{}, fmt.Errorf("malformed refresh token")
+	}
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+	family := refreshFamilies[id]
+	if family == nil || family.current != hash {
+		return "", Claims{}, fmt.Errorf("unknown or revoked refresh token")
+	}
+	signedIn := Claims{User: family.user, AuthMethods: family.methods}
+	if !family.authenticatedAt.IsZero() {
+		signedIn.AuthTime = family.authenticatedAt.Unix()
+	}
+	token, claims, err := signer.Renew(signedIn, roles...)
+	if err != nil {
+		return "", claims, err
+	}
+	// forget the tokens which have expired since
+	now := time.Now()
+	live := family.tokens[:0]
+	for _, t := range family.tokens {
+		if t.claims.Expiry().After(now) {
+			live = append(live, t)
+		}
+	}
+	family.tokens = append(live, issuedToken{signer, claims})
+	return token, claims, nil
+}
+
+// RevokeRefreshToken revokes the token's family and the access sessions and
+// tokens issued to it, for signing out.
+func RevokeRefreshToken(token string) {
+	id, hash, ok := parseRefreshToken(token)
+	if !ok {
+		return
+	}
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+	if family := refreshFamilies[id]; family != nil &&
+		(family.current == hash || family.used[hash]) {
+		family.revoke(id)
+	}
+}
+
+// RevokeRefreshTokenIssuing revokes the family which issued the given access
+// session, and everything else issued to it, for signing out when the client
+// only presents the access session.
+func RevokeRefreshTokenIssuing(access Session) {
+	revokeRefreshFamilies(func(family *refreshFamily) bool {
+		for _, s := range family.sessions {
+			if s == access {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// RevokeRefreshTokenIssuingClaims is like RevokeRefreshTokenIssuing, for a
+// signed access token.
+func RevokeRefreshTokenIssuingClaims(access Claims) {
+	revokeRefreshFamilies(func(family *refreshFamily) bool {
+		for _, t := range family.tokens {
+			if t.claims.ID == access.ID {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// revokeRefreshFamilies revokes the families which match.
+func revokeRefreshFamilies(match func(*refreshFamily) bool) {
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+	for id, family := range refreshFamilies {
+		if match(family) {
+			family.revoke(id)
+		}
+	}
+}
+
+// revokeRefreshTokensFor revokes the user's refresh token families, except
+// those which issued one of the sessions to keep.
+func revokeRefreshTokensFor(user Username, keep map[Session]bool) {
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+families:
+	for id, family := range refreshFamilies {
+		if family.user != user {
+			continue
+		}
+		for _, s := range family.sessions {
+			if keep[s] {
+				continue families
+			}
+		}
+		family.revoke(id)
+	}
+}
+
+// sweepRefreshTokens forgets the families which have expired.
+func sweepRefreshTokens() {
+	refreshLock.Lock()
+	defer refreshLock.Unlock()
+	now := time.Now()
+	for id, family := range refreshFamilies {
+		if family.expiry.Before(now) {
+			delete(refreshFamilies, id)
+		}
+	}
+}
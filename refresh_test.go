@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestRefreshTokens(t *testing.T) {
+	var (
+		test = attest.New(t)
+		user = Username("test refresh user")
+	)
+	first, err := NewRefreshToken(user, time.Now(), []string{AuthPassword})
+	test.Handle(err)
+	access, metadata, err := NewAccessSessionFor(first)
+	test.Handle(err)
+	test.Equals(user, metadata.User)
+	test.Attest(
+		metadata.Expiry.Before(time.Now().Add(DefaultExpiry())),
+		"the access session isn't short-lived",
+	)
+	owner, second, err := RotateRefreshToken(first)
+	test.Handle(err)
+	test.Equals(user, owner)
+	test.NotEqual(first, second)
+	_, _, err = NewAccessSessionFor(first)
+	test.NotNil(err, "created an access session with a used refresh token")
+	rotatedAccess, _, err := NewAccessSessionFor(second)
+	test.Handle(err)
+	t.Run("reuse revokes the family", func(t *testing.T) {
+		test := attest.New(t)
+		_, _, err := RotateRefreshToken(first)
+		test.Attest(IsRefreshTokenReused(err), "reuse wasn't detected: %v", err)
+		test.Attest(!access.CurrentlyExists(), "the first access session survived")
+		test.Attest(!rotatedAccess.CurrentlyExists(), "the second access session survived")
+		_, _, err = RotateRefreshToken(second)
+		test.NotNil(err, "the latest refresh token survived")
+	})
+	t.Run("revoke", func(t *testing.T) {
+		test := attest.New(t)
+		token, err := NewRefreshToken(user, time.Now(), []string{AuthPassword})
+		test.Handle(err)
+		access, _, err := NewAccessSessionFor(token)
+		test.Handle(err)
+		RevokeRefreshToken(token)
+		test.Attest(!access.CurrentlyExists(), "the access session survived")
+		_, _, err = RotateRefreshToken(token)
+		test.NotNil(err, "a revoked refresh token was accepted")
+	})
+	t.Run("revoke by access session or token", func(t *testing.T) {
+		test := attest.New(t)
+		token, err := NewRefreshToken(user, time.Now(), []string{AuthPassword})
+		test.Handle(err)
+		access, _, err := NewAccessSessionFor(token)
+		test.Handle(err)
+		RevokeRefreshTokenIssuing(access)
+		test.Attest(!access.CurrentlyExists(), "the access session survived")
+		_, _, err = RotateRefreshToken(token)
+		test.NotNil(err, "the refresh token survived its access session")
+
+		signer := NewTokenSigner(time.Minute)
+		test.Handle(signer.AddHMACKey(
+			"test",
+			[]byte("test token signing secret, 32+ bytes"),
+		))
+		token, err = NewRefreshToken(user, time.Now(), []string{AuthPassword})
+		test.Handle(err)
+		_, claims, err := NewAccessTokenFor(token, signer)
+		test.Handle(err)
+		RevokeRefreshTokenIssuingClaims(claims)
+		_, _, err = RotateRefreshToken(token)
+		test.NotNil(err, "the refresh token survived its access token")
+	})
+	t.Run("signed tokens are revoked with the family", func(t *testing.T) {
+		test := attest.New(t)
+		signer := NewTokenSigner(time.Minute)
+		test.Handle(signer.AddHMACKey(
+			"test",
+			[]byte("test token signing secret, 32+ bytes"),
+		))
+		first, err := NewRefreshToken(user, time.Now(), []string{AuthPassword})
+		test.Handle(err)
+		token, claims, err := NewAccessTokenFor(first, signer, "reader")
+		test.Handle(err)
+		test.Equals(user, claims.User)
+		_, err = signer.Verify(token)
+		test.Handle(err)
+		_, _, err = RotateRefreshToken(first)
+		test.Handle(err)
+		_, _, err = RotateRefreshToken(first)
+		test.Attest(IsRefreshTokenReused(err), "reuse wasn't detected: %v", err)
+		_, err = signer.Verify(token)
+		test.NotNil(err, "a token issued to a revoked family was accepted")
+	})
+	t.Run("keeps the sign-in time and methods", func(t *testing.T) {
+		test := attest.New(t)
+		signer := NewTokenSigner(time.Minute)
+		test.Handle(signer.AddHMACKey(
+			"test",
+			[]byte("test token signing secret, 32+ bytes"),
+		))
+		signedIn := time.Now().Add(-time.Hour).Truncate(time.Second)
+		first, err := NewRefreshToken(
+			user, signedIn, []string{AuthPassword, AuthOTP},
+		)
+		test.Handle(err)
+		_, second, err := RotateRefreshToken(first)
+		test.Handle(err)
+		access, metadata, err := NewAccessSessionFor(second)
+		test.Handle(err)
+		defer access.Delete()
+		test.Attest(
+			metadata.AuthenticatedAt.Equal(signedIn),
+			"the access session was authenticated at %v, not %v",
+			metadata.AuthenticatedAt,
+			signedIn,
+		)
+		test.Attest(
+			hasMethod(metadata.AuthMethods, AuthOTP),
+			"the access session lost the otp method",
+		)
+		_, claims, err := NewAccessTokenFor(second, signer)
+		test.Handle(err)
+		test.Equals(signedIn.Unix(), claims.AuthTime)
+		test.Attest(
+			hasMethod(claims.AuthMethods, AuthOTP),
+			"the access token lost the otp method",
+		)
+	})
+}
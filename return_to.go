@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// ReturnToCookieName is the name of the cookie which remembers where a
+	// user was going when they were asked to sign in.
+	ReturnToCookieName = "return_to"
+	// how long the destination is remembered: 10 minutes
+	returnToMaxAge = 10 * 60
+)
+
+// returnToCookieOptions derives the return-to cookie's attributes from the
+// session cookie's.
+func returnToCookieOptions(session CookieOptions) CookieOptions {
+	options := session
+	options.Name = ReturnToCookieName
+	options.MaxAge = returnToMaxAge
+	return options
+}
+
+// IsLocalRedirect reports whether target is a path on this site, which is
+// safe to redirect to. Anything which a browser could take to another host,
+// like "//evil.example" or "/\evil.example", isn't.
+func IsLocalRedirect(target string) bool {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") ||
+		strings.ContainsAny(target, "\\\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(target)
+	return err == nil && u.Scheme == "" && u.Host == "" && u.User == nil
+}
+
+// RememberDestination sets a short-lived cookie holding the URL of a request
+// which is being sent to the login page, so that the user can be redirected
+// back to it after signing in. Only GET requests for pages (ones which
+// accept text/html) are remembered, so that requests for images and scripts
+// don't overwrite the destination. Credentials in the query string are left
+// out.
+func RememberDestination(w http.ResponseWriter, r *http.Request, session CookieOptions) {
+	if r.Method != http.MethodGet ||
+		!strings.Contains(r.Header.Get("Accept"), "text/html") {
+		return
+	}
+	target := *r.URL
+	query := target.Query()
+	query.Del(UserField)
+	query.Del(TokenField)
+	target.RawQuery = query.Encode()
+	destination := target.RequestURI()
+	if !IsLocalRedirect(destination) {
+		return
+	}
+	http.SetCookie(w, returnToCookieOptions(session).Cookie(
+		base64.RawURLEncoding.EncodeToString([]byte(destination)),
+	))
+}
+
+// TakeDestination gets the destination remembered by RememberDestination, if
+// there is one and it's a local path, and clears the cookie.
+func TakeDestination(
+	w http.ResponseWriter, r *http.Request, session CookieOptions,
+) (string, bool) {
+	options := returnToCookieOptions(session)
+	cookie, err := r.Cookie(options.CookieName())
+	if err != nil {
+		return "", false
+	}
+	http.SetCookie(w, options.ExpiredCookie())
+	destination, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || !IsLocalRedirect(string(destination)) {
+		return "", false
+	}
+	return string(destination), true
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestIsLocalRedirect(t *testing.T) {
+	test := attest.New(t)
+	for _, target := range []string{"/", "/account", "/search?q=a%2Fb#results"} {
+		test.Attest(IsLocalRedirect(target), "%q wasn't considered local", target)
+	}
+	for _, target := range []string{
+		"",
+		"account",
+		"//evil.example/",
+		"/\\evil.example",
+		"https://evil.example/",
+		"javascript:alert(1)",
+		"/\r\nLocation: https://evil.example/",
+	} {
+		test.Attest(!IsLocalRedirect(target), "%q was considered local", target)
+	}
+}
+
+func TestRememberDestination(t *testing.T) {
+	var (
+		test    = attest.New(t)
+		options CookieOptions
+	)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/account?tab=keys&user=someone&token=secret", nil)
+	req.Header.Set("Accept", "text/html,*/*")
+	RememberDestination(rec, req, options)
+	cookies := rec.Result().Cookies()
+	test.Equals(1, len(cookies))
+	test.Equals(ReturnToCookieName, cookies[0].Name)
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/login", nil)
+	req.AddCookie(cookies[0])
+	destination, ok := TakeDestination(rec, req, options)
+	test.Attest(ok, "the destination wasn't remembered")
+	test.Equals("/account?tab=keys", destination)
+	test.Equals(-1, rec.Result().Cookies()[0].MaxAge)
+
+	t.Run("not a page", func(t *testing.T) {
+		test := attest.New(t)
+		rec := httptest.NewRecorder()
+		RememberDestination(rec, httptest.NewRequest("GET", "/favicon.ico", nil), options)
+		test.Equals(0, len(rec.Result().Cookies()))
+	})
+	t.Run("tampered", func(t *testing.T) {
+		test := attest.New(t)
+		cookie := returnToCookieOptions(options).Cookie("Ly9ldmlsLmV4YW1wbGUv") // "//evil.example/"
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.AddCookie(cookie)
+		_, ok := TakeDestination(httptest.NewRecorder(), req, options)
+		test.Attest(!ok, "redirected off-site")
+	})
+}
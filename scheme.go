@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// AuthScheme is a set of ways a request may be authenticated.
+type AuthScheme uint8
+
+const (
+	// SchemeCookie authenticates requests with a session cookie, and signs
+	// users in with credentials submitted to any endpoint.
+	SchemeCookie AuthScheme = 1 << iota
+	// SchemeBasic authenticates each request with an
+	// "Authorization: Basic" header, checked with IsAuthenticatedBy. Browsers
+	// remember these credentials and send them with cross-site requests, so
+	// only allow it on routes used by non-browser clients. Users enrolled in
+	// two-factor authentication can't use it.
+	SchemeBasic
+	// SchemeBearer authenticates each request with an
+	// "Authorization: Bearer <session ID>" header.
+	SchemeBearer
+	// SchemeAPIKey authenticates each request with an API key in the
+	// X-API-Key header. See CreateAPIKey.
+	SchemeAPIKey
+	// HeaderSchemes are the schemes which authenticate each request by a
+	// header.
+	HeaderSchemes = SchemeBasic | SchemeBearer | SchemeAPIKey
+	// AllSchemes allows any scheme.
+	AllSchemes = SchemeCookie | HeaderSchemes
+)
+
+// Allows reports whether any of the given schemes are in the set.
+func (s AuthScheme) Allows(schemes AuthScheme) bool {
+	return s&schemes != 0
+}
+
+// challenge is the value of the WWW-Authenticate header sent when a request
+// isn't authenticated by any of the header schemes in the set.
+func (s AuthScheme) challenge() string {
+	var challenges []string
+	if s.Allows(SchemeBasic) {
+		challenges = append(challenges, `Basic realm="restricted", charset="UTF-8"`)
+	}
+	if s.Allows(SchemeBearer) {
+		challenges = append(challenges, `Bearer realm="restricted"`)
+	}
+	return strings.Join(challenges, ", ")
+}
+
+type routeSchemes struct {
+	route   *regexp.Regexp
+	schemes AuthScheme
+}
+
+// SchemePolicy chooses which schemes may authenticate a request by its path.
+// A nil or zero policy only allows SchemeCookie.
+type SchemePolicy struct {
+	// Default is allowed on routes which don't match any pattern. Zero means
+	// SchemeCookie.
+	Default AuthScheme
+	routes  []routeSchemes
+}
+
+// Allow sets the schemes allowed on routes starting with the given regular
+// expression. Patterns are tried in the order they were added.
+func (p *SchemePolicy) Allow(route string, schemes AuthScheme) error {
+	exp, err := regexp.Compile("^" + route)
+	if err != nil {
+		return fmt.Errorf("Error parsing regular expression /%s/: %v", route, err)
+	}
+	p.routes = append(p.routes, routeSchemes{exp, schemes})
+	return nil
+}
+
+// SchemesFor gets the schemes allowed on the given route.
+func (p *SchemePolicy) SchemesFor(route string) AuthScheme {
+	if p == nil {
+		return SchemeCookie
+	}
+	for _, r := range p.routes {
+		if r.route.MatchString(route) {
+			return r.schemes
+		}
+	}
+	if p.Default == 0 {
+		return SchemeCookie
+	}
+	return p.Default
+}
+
+// Any gets every scheme allowed on some route.
+func (p *SchemePolicy) Any() AuthScheme {
+	if p == nil {
+		return SchemeCookie
+	}
+	schemes := p.SchemesFor("")
+	for _, r := range p.routes {
+		schemes |= r.schemes
+	}
+	return schemes
+}
+
+// BearerToken gets the token a client sends to authenticate with the given
+// session: its ID, signed if signer isn't nil.
+func BearerToken(token Session, signer *IDSigner) string {
+	if signer != nil {
+		return signer.Sign(token)
+	}
+	return token.ID()
+}
+
+type headerContextKey struct{}
+
+// AuthenticatedHeader is stored in the context of requests authenticated by
+// an Authorization header.
+type AuthenticatedHeader struct {
+	User   Username
+	Scheme AuthScheme
+	// Session is the session a Bearer token refers to. It's zero for Basic
+	// credentials.
+	Session Session
+}
+
+// AuthenticatedHeaderFrom gets the Authorization header which authenticated
+// the request, or nil if it wasn't authenticated by one.
+func AuthenticatedHeaderFrom(r *http.Request) *AuthenticatedHeader {
+	authenticated, _ := r.Context().Value(headerContextKey{}).(*AuthenticatedHeader)
+	return authenticated
+}
+
+// AuthenticateHeader authenticates the request by its Authorization header,
+// if it has one with any of the given schemes. If it does, the returned
+// request carries the user in its context; see AuthenticatedHeaderFrom. If it
+// doesn't, the request is returned as it was, scheme is zero and err is nil.
+// If the header doesn't authenticate anyone, err satisfies
+// IsCredentialsRejected with the status 401 Unauthorized, or 400 Bad Request
+// if Basic credentials were sent in a way the policy doesn't allow. A nil
+// policy only accepts them over TLS. Bearer tokens are parsed with signer if
+// it isn't nil, and their sessions are held to binding like cookies are.
+func AuthenticateHeader(
+	r *http.Request,
+	schemes AuthScheme,
+	signer *IDSigner,
+	policy *CredentialPolicy,
+	binding *BindingPolicy,
+) (authenticated *http.Request, scheme AuthScheme, err error) {
+	header := r.Header.Get("Authorization")
+	space := strings.IndexByte(header, ' ')
+	if space < 0 {
+		return r, 0, nil
+	}
+	if policy == nil {
+		policy = new(CredentialPolicy)
+	}
+	var found AuthenticatedHeader
+	switch kind, value := header[:space], strings.TrimSpace(header[space+1:]); {
+	case schemes.Allows(SchemeBasic) && strings.EqualFold(kind, "Basic"):
+		scheme = SchemeBasic
+		user, pass, err := BasicAuthCredentials{Policy: policy}.Credentials(r)
+		if err != nil {
+			return r, scheme, err
+		}
+		// there's nowhere to put a two-factor code. This is checked first so
+		// that Basic, which has no attempt limit, can't be used to guess the
+		// passwords of users who have one.
+		if user.HasTOTP() {
+			return r, scheme, CredentialsRejected(
+				http.StatusUnauthorized,
+				"two-factor authentication is required; sign in instead",
+			)
+		}
+		if user == "" || !user.IsAuthenticatedBy(pass) {
+			return r, scheme, CredentialsRejected(
+				http.StatusUnauthorized,
+				"incorrect username or password",
+			)
+		}
+		found.User = user
+	case schemes.Allows(SchemeBearer) && strings.EqualFold(kind, "Bearer"):
+		scheme = SchemeBearer
+		var token Session
+		if signer != nil {
+			token, err = signer.Parse(value)
+		} else {
+			token, err = ParseSessionID(value)
+		}
+		if err != nil {
+			return r, scheme, CredentialsRejected(http.StatusUnauthorized, err.Error())
+		}
+		metadata, exists := token.Touch()
+		if !exists {
+			return r, scheme, CredentialsRejected(
+				http.StatusUnauthorized,
+				"unknown or expired session",
+			)
+		}
+		if err = binding.Enforce(r, token, metadata); err != nil {
+			return r, scheme, CredentialsRejected(http.StatusUnauthorized, err.Error())
+		}
+		found.User = metadata.User
+		found.Session = token
+	default:
+		return r, 0, nil
+	}
+	found.Scheme = scheme
+	ctx := context.WithValue(r.Context(), headerContextKey{}, &found)
+	return r.WithContext(ctx), scheme, nil
+}
+
+// Challenge responds to a request which wasn't authenticated by any of the
+// given header schemes with the error's status and a WWW-Authenticate header.
+func Challenge(w http.ResponseWriter, schemes AuthScheme, err error) {
+	status := http.StatusUnauthorized
+	if err != nil {
+		status = StatusOf(err)
+	}
+	if challenge := schemes.challenge(); challenge != "" {
+		w.Header().Set("WWW-Authenticate", challenge)
+	}
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "%d %s", status, http.StatusText(status))
+}
@@ -0,0 +1,106 @@
+package auth
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestSchemePolicy(t *testing.T) {
+	test := attest.New(t)
+	var unset *SchemePolicy
+	test.Equals(SchemeCookie, unset.SchemesFor("/api/things"))
+	policy := &SchemePolicy{}
+	test.Handle(policy.Allow("/api/", SchemeBasic|SchemeBearer))
+	test.Handle(policy.Allow("/", AllSchemes))
+	test.Equals(SchemeBasic|SchemeBearer, policy.SchemesFor("/api/things"))
+	test.Equals(AllSchemes, policy.SchemesFor("/"))
+	test.Equals(SchemeCookie, policy.SchemesFor("elsewhere"))
+	test.Attest(policy.Any().Allows(SchemeBearer), "bearer wasn't allowed anywhere")
+	test.NotNil(policy.Allow("(", SchemeBasic), "got nil error for an invalid pattern")
+}
+
+func TestAuthenticateHeader(t *testing.T) {
+	const password = "test header user's password"
+	var (
+		test = attest.New(t)
+		user = Username("test header user")
+	)
+	AllUsers = make(UserCollection)
+	test.Handle(CreateNewUser(string(user), password))
+	t.Run("no header", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		authenticated, scheme, err := AuthenticateHeader(req, AllSchemes, nil, nil, nil)
+		test.Handle(err)
+		test.Equals(AuthScheme(0), scheme)
+		test.Attest(
+			AuthenticatedHeaderFrom(authenticated) == nil,
+			"an unauthenticated request had a user in its context",
+		)
+	})
+	t.Run("basic", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(string(user), password)
+		_, _, err := AuthenticateHeader(req, SchemeBasic, nil, nil, nil)
+		test.Equals(http.StatusBadRequest, StatusOf(err))
+		req.TLS = new(tls.ConnectionState)
+		authenticated, scheme, err := AuthenticateHeader(req, SchemeBasic, nil, nil, nil)
+		test.Handle(err)
+		test.Equals(SchemeBasic, scheme)
+		test.Equals(user, AuthenticatedHeaderFrom(authenticated).User)
+		req.SetBasicAuth(string(user), "wrong password")
+		_, _, err = AuthenticateHeader(req, SchemeBasic, nil, nil, nil)
+		test.Equals(http.StatusUnauthorized, StatusOf(err))
+		_, scheme, err = AuthenticateHeader(req, SchemeBearer, nil, nil, nil)
+		test.Handle(err)
+		test.Equals(AuthScheme(0), scheme)
+	})
+	t.Run("bearer", func(t *testing.T) {
+		test := attest.New(t)
+		signer := test.EatError(NewIDSigner(
+			[]byte("test session ID signing key, 32+ bytes"),
+		)).(*IDSigner)
+		token, _ := NewSessionFor(user)
+		defer token.Delete()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+BearerToken(token, signer))
+		authenticated, scheme, err := AuthenticateHeader(req, SchemeBearer, signer, nil, nil)
+		test.Handle(err)
+		test.Equals(SchemeBearer, scheme)
+		found := AuthenticatedHeaderFrom(authenticated)
+		test.Equals(user, found.User)
+		test.Equals(token, found.Session)
+		req.Header.Set("Authorization", "Bearer "+token.ID())
+		_, _, err = AuthenticateHeader(req, SchemeBearer, signer, nil, nil)
+		test.Attest(IsCredentialsRejected(err), "an unsigned ID was accepted")
+		token.Delete()
+		req.Header.Set("Authorization", "Bearer "+BearerToken(token, signer))
+		_, _, err = AuthenticateHeader(req, SchemeBearer, signer, nil, nil)
+		test.Equals(http.StatusUnauthorized, StatusOf(err))
+	})
+	t.Run("basic with two factors", func(t *testing.T) {
+		test := attest.New(t)
+		EncryptTOTPSecretsWith(StaticKey("test TOTP key"))
+		defer EncryptTOTPSecretsWith(nil)
+		enrollment, err := user.EnrollTOTP("test")
+		test.Handle(err)
+		defer user.ResetTOTP()
+		secret := test.EatError(totpEncoding.DecodeString(enrollment.Secret)).([]byte)
+		test.Handle(user.ConfirmTOTP(totpCode(secret, uint64(time.Now().Unix())/totpPeriod)))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.TLS = new(tls.ConnectionState)
+		req.SetBasicAuth(string(user), password)
+		_, _, right := AuthenticateHeader(req, SchemeBasic, nil, nil, nil)
+		test.Equals(http.StatusUnauthorized, StatusOf(right))
+		req.SetBasicAuth(string(user), "wrong password")
+		_, _, wrong := AuthenticateHeader(req, SchemeBasic, nil, nil, nil)
+		// the response mustn't show whether the password was right
+		test.Equals(right.Error(), wrong.Error())
+	})
+}
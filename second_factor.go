@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	// TOTPField is the form field two-factor codes, or recovery codes, are
+	// submitted in.
+	TOTPField = "totp"
+	// SecondFactorCookieName is the name of the cookie which holds a pending
+	// sign-in while the user enters their two-factor code.
+	SecondFactorCookieName = "second_factor"
+	// how long the user has to enter their code: 5 minutes
+	pendingSecondFactorMaxAge = 5 * 60
+	pendingSecondFactorExpiry = pendingSecondFactorMaxAge * time.Second
+	// how many wrong codes a user may enter before their pending sign-ins
+	// are cancelled, and they have to wait for pendingSecondFactorExpiry to
+	// try again
+	maxSecondFactorAttempts = 5
+)
+
+// secondFactorFailures counts each user's wrong codes across all of their
+// pending sign-ins, so that starting a new one doesn't reset the count. It's
+// guarded by sessionsLock.
+var secondFactorFailures = make(map[Username]*secondFactorFailure)
+
+type secondFactorFailure struct {
+	count int
+	last  time.Time
+}
+
+// reserveSecondFactorAttempt counts an attempt at the user's code before it's
+// checked, so that parallel requests can't get more guesses in than they're
+// allowed, and reports whether it may go ahead. sessionsLock must be held.
+func reserveSecondFactorAttempt(user Username) bool {
+	now := time.Now()
+	failures := secondFactorFailures[user]
+	if failures == nil || now.Sub(failures.last) > pendingSecondFactorExpiry {
+		failures = new(secondFactorFailure)
+		secondFactorFailures[user] = failures
+	}
+	if failures.count >= maxSecondFactorAttempts {
+		return false
+	}
+	failures.count++
+	failures.last = now
+	return true
+}
+
+// CheckSecondFactor checks a two-factor code, or recovery code, which the
+// user entered outside a pending sign-in, e.g. to reauthenticate. Wrong codes
+// count towards the same limit as CompleteSecondFactor's, so that it can't be
+// used to get more guesses in. Errors for wrong codes satisfy
+// IsInvalidTOTPCode.
+func (u *Username) CheckSecondFactor(code string) error {
+	sessionsLock.Lock()
+	allowed := reserveSecondFactorAttempt(*u)
+	sessionsLock.Unlock()
+	if !allowed {
+		return fmt.Errorf(
+			"too many wrong two-factor codes for %s; try again later",
+			*u,
+		)
+	}
+	if err := u.VerifySecondFactor(code); err != nil {
+		return err
+	}
+	sessionsLock.Lock()
+	delete(secondFactorFailures, *u)
+	sessionsLock.Unlock()
+	return nil
+}
+
+// secondFactorCookieOptions derives the pending sign-in cookie's attributes
+// from the session cookie's.
+func secondFactorCookieOptions(session CookieOptions) CookieOptions {
+	options := session
+	options.Name = SecondFactorCookieName
+	options.MaxAge = pendingSecondFactorMaxAge
+	return options
+}
+
+// NewPendingSession starts a sign-in for a user who has entered their
+// password but still has to enter a two-factor code. The session can't be
+// used to authenticate requests (Touch doesn't find it); it expires after 5
+// minutes unless CompleteSecondFactor succeeds. After 5 wrong codes across
+// all of a user's pending sign-ins, they're cancelled, and the user has to
+// wait 5 minutes to try again.
+func NewPendingSession(user Username, r *http.Request) (Session, *SessionMetadata, error) {
+	return newSession(&SessionMetadata{
+		User:                user,
+		UserAgent:           r.UserAgent(),
+		RemoteAddr:          r.RemoteAddr,
+		PendingSecondFactor: true,
+	})
+}
+
+// BeginSecondFactor starts a pending sign-in for the user, and sets a cookie
+// so that the code can be submitted in a later request. See
+// PendingSecondFactor.
+func BeginSecondFactor(
+	w http.ResponseWriter, r *http.Request, user Username, session CookieOptions,
+) error {
+	token, _, err := NewPendingSession(user, r)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, secondFactorCookieOptions(session).Cookie(token.ID()))
+	return nil
+}
+
+// PendingSecondFactor gets the pending sign-in started by BeginSecondFactor,
+// if the request has one which hasn't expired.
+func PendingSecondFactor(
+	r *http.Request, session CookieOptions,
+) (Session, *SessionMetadata, bool) {
+	cookie, err := r.Cookie(secondFactorCookieOptions(session).CookieName())
+	if err != nil {
+		return nullSession, nil, false
+	}
+	token, err := ParseSessionID(cookie.Value)
+	if err != nil {
+		return nullSession, nil, false
+	}
+	sessionsLock.RLock()
+	defer sessionsLock.RUnlock()
+	metadata := AllSessions[token]
+	if metadata == nil || !metadata.PendingSecondFactor ||
+		metadata.expiredAt(time.Now()) {
+		return nullSession, nil, false
+	}
+	return token, metadata, true
+}
+
+// EndSecondFactor clears the pending sign-in cookie.
+func EndSecondFactor(w http.ResponseWriter, session CookieOptions) {
+	http.SetCookie(w, secondFactorCookieOptions(session).ExpiredCookie())
+}
+
+// CompleteSecondFactor checks the code for a pending sign-in, which may be a
+// recovery code (see VerifySecondFactor). If it's correct the pending
+// session is deleted and its user is returned, who can then be given a real
+// session with the AuthPassword and AuthOTP methods. Errors for wrong codes
+// satisfy IsInvalidTOTPCode; after too many the pending sign-in is
+// cancelled.
+func (s *Session) CompleteSecondFactor(code string) (Username, error) {
+	sessionsLock.Lock()
+	metadata := AllSessions[*s]
+	if metadata == nil || !metadata.PendingSecondFactor ||
+		metadata.expiredAt(time.Now()) {
+		sessionsLock.Unlock()
+		return "", fmt.Errorf("no sign-in is waiting for a two-factor code")
+	}
+	user := metadata.User
+	if !reserveSecondFactorAttempt(user) {
+		s.delete()
+		sessionsLock.Unlock()
+		return "", fmt.Errorf(
+			"too many wrong two-factor codes for %s; try again later",
+			user,
+		)
+	}
+	sessionsLock.Unlock()
+	err := user.VerifySecondFactor(code)
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if err != nil {
+		if failures := secondFactorFailures[user]; failures != nil &&
+			failures.count >= maxSecondFactorAttempts {
+			s.delete()
+		}
+		return "", err
+	}
+	delete(secondFactorFailures, user)
+	s.delete()
+	return user, nil
+}
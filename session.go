@@ -6,10 +6,15 @@ import (
 	"fmt"
 	"log"
 	"math/big"
+	"net/http"
+	"sync"
 	"time"
 )
 
 const (
+	// AuthPassword is the authentication method reference (see RFC 8176)
+	// for signing in with a password.
+	AuthPassword = "pwd"
 	// 128 bits
 	SessionKeyLength = 1 << 7
 	// one week in seconds
@@ -21,10 +26,23 @@ const (
 var (
 	// the default amount of time until a token expires: 30 days
 	expiryDelay = 24 * 30 * time.Hour
+	// how long a session may go unused before it expires, or 0 for no limit
+	idleTimeout time.Duration
+	// how long a session may last however often it's renewed, or 0 for no
+	// limit
+	maxLifetime time.Duration
+	// how close to expiry a session has to be for the middleware to renew it
+	renewalThreshold = oneWeek
 	// a big.Int representing the maximum number that can fit in an uint8
 	byteSize = big.NewInt(byteSizeConst)
 	// AllSessions stores each valid token
-	AllSessions map[Session]*SessionMetadata
+	AllSessions  map[Session]*SessionMetadata
+	sessionsLock sync.RWMutex
+	// userSessions indexes the sessions in AllSessions by user
+	userSessions = make(map[Username]map[Session]bool)
+	// how long a rotated session keeps working, for requests which were
+	// already in flight with it
+	rotationGrace = 30 * time.Second
 	// nullSession is found when the session doesn't exist
 	nullSession Session
 	// how frequently to sweep for expired tokens
@@ -37,7 +55,100 @@ var (
 type Session [SessionKeyLength]byte
 
 type SessionMetadata struct {
+	// User is who signed in to create the session, if anyone.
+	User   Username
 	Expiry time.Time
+	// CSRFToken must accompany unsafe requests made with this session. See
+	// CheckCSRF.
+	CSRFToken string
+	// Rotated is set once the session has been replaced by Rotate. It only
+	// works until its grace period is over, and can't be rotated again.
+	Rotated bool
+	// Created is when the user signed in. Rotated sessions keep it, so the
+	// maximum lifetime applies across renewals.
+	Created time.Time
+	// LastSeen is roughly when the session was last used. It's only updated
+	// when it's out of date by a minute, or a tenth of the idle timeout if
+	// that's shorter, to save writes.
+	LastSeen time.Time
+	// UserAgent and RemoteAddr describe the client which signed in, so that
+	// users can tell their sessions apart. See NewSessionForClient.
+	UserAgent  string
+	RemoteAddr string
+	// ChannelBinding identifies the TLS connection the session was started
+	// on, for BindTLSChannel.
+	ChannelBinding string
+	// AuthenticatedAt is when the user last proved who they are for this
+	// session, by signing in or by Reauthenticate. Renewing the session
+	// doesn't change it.
+	AuthenticatedAt time.Time
+	// AuthMethods lists how the user proved it, as RFC 8176 authentication
+	// method references like AuthPassword.
+	AuthMethods []string
+	// PendingSecondFactor is set on sessions which are waiting for the user
+	// to enter a two-factor code. They don't authenticate anything. See
+	// NewPendingSession.
+	PendingSecondFactor bool
+	// limited is set on sessions which count towards the user's session
+	// limit
+	limited bool
+}
+
+// expiredAt reports whether the session has passed its expiry, its idle
+// timeout or its maximum lifetime at the given time.
+func (m *SessionMetadata) expiredAt(now time.Time) bool {
+	switch {
+	case m.Expiry.Before(now):
+		return true
+	case idleTimeout > 0 && !m.LastSeen.IsZero() && now.Sub(m.LastSeen) > idleTimeout:
+		return true
+	case maxLifetime > 0 && !m.Created.IsZero() && now.Sub(m.Created) > maxLifetime:
+		return true
+	}
+	return false
+}
+
+// expiryFrom gets the expiry of a session renewed at the given time, which
+// is the default delay away unless that's past the session's maximum
+// lifetime.
+func (m *SessionMetadata) expiryFrom(now time.Time) time.Time {
+	expiry := now.Add(expiryDelay)
+	if maxLifetime > 0 && !m.Created.IsZero() {
+		if limit := m.Created.Add(maxLifetime); limit.Before(expiry) {
+			return limit
+		}
+	}
+	return expiry
+}
+
+// SetIdleTimeout sets how long a session may go unused before it expires. 0
+// turns the idle timeout off.
+func SetIdleTimeout(timeout time.Duration) {
+	idleTimeout = timeout
+}
+
+// SetMaxLifetime sets how long a session may last after the user signed in,
+// however often it's renewed. 0 means there's no limit.
+func SetMaxLifetime(lifetime time.Duration) {
+	maxLifetime = lifetime
+}
+
+// MaxLifetime gets how long a session may last after the user signed in, or 0
+// if there's no limit.
+func MaxLifetime() time.Duration {
+	return maxLifetime
+}
+
+// SetRenewalThreshold sets how close to expiry a session has to be before the
+// middleware renews it. Defaults to a week.
+func SetRenewalThreshold(threshold time.Duration) {
+	renewalThreshold = threshold
+}
+
+// RenewalThreshold gets how close to expiry a session has to be before the
+// middleware renews it.
+func RenewalThreshold() time.Duration {
+	return renewalThreshold
 }
 
 func init() {
@@ -50,13 +161,49 @@ func (s *Session) GetMetadata() (sesh *SessionMetadata, found bool) {
 	if (*s) == nullSession {
 		return
 	}
+	sessionsLock.RLock()
 	sesh = AllSessions[*s]
+	sessionsLock.RUnlock()
 	if sesh != nil && sesh.Expiry.Unix() > 0 {
 		found = true
 	}
 	return
 }
 
+// Touch gets the session's metadata if it's still valid: not past its
+// expiry, its idle timeout or its maximum lifetime. It records that the
+// session was used, which is what keeps it from idling out.
+func (s *Session) Touch() (*SessionMetadata, bool) {
+	if *s == nullSession {
+		return nil, false
+	}
+	now := time.Now()
+	sessionsLock.RLock()
+	metadata := AllSessions[*s]
+	valid := metadata != nil && !metadata.PendingSecondFactor &&
+		!metadata.expiredAt(now)
+	stale := valid && now.Sub(metadata.LastSeen) > touchInterval()
+	sessionsLock.RUnlock()
+	if !valid {
+		return nil, false
+	}
+	if stale {
+		sessionsLock.Lock()
+		metadata.LastSeen = now
+		sessionsLock.Unlock()
+	}
+	return metadata, true
+}
+
+// touchInterval gets how out of date LastSeen may get before Touch updates
+// it.
+func touchInterval() time.Duration {
+	if idleTimeout > 0 && idleTimeout/10 < time.Minute {
+		return idleTimeout / 10
+	}
+	return time.Minute
+}
+
 func (s *Session) CurrentlyExists() (found bool) {
 	_, found = s.GetMetadata()
 	return
@@ -64,16 +211,40 @@ func (s *Session) CurrentlyExists() (found bool) {
 
 // Delete the given token from the list of allowed sessions.
 func (s *Session) Delete() {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	s.delete()
+}
+
+// delete the session and its entry in userSessions. sessionsLock must be
+// held.
+func (s *Session) delete() {
+	if metadata := AllSessions[*s]; metadata != nil {
+		if sessions := userSessions[metadata.User]; sessions != nil {
+			delete(sessions, *s)
+			if len(sessions) == 0 {
+				delete(userSessions, metadata.User)
+			}
+		}
+	}
 	delete(AllSessions, *s)
 }
 
-func (s *Session) ExpireIn(duration time.Duration) error {
-	sesh, ok := s.GetMetadata()
-	if !ok {
-		return fmt.Errorf("Session not found")
+// insert stores the session's metadata and indexes it by user.
+// sessionsLock must be held.
+func (s *Session) insert(metadata *SessionMetadata) {
+	AllSessions[*s] = metadata
+	if metadata.User == "" {
+		return
 	}
-	sesh.Expiry = time.Now().Add(duration)
-	return nil
+	if userSessions[metadata.User] == nil {
+		userSessions[metadata.User] = make(map[Session]bool)
+	}
+	userSessions[metadata.User][*s] = true
+}
+
+func (s *Session) ExpireIn(duration time.Duration) error {
+	return s.ExpireAt(time.Now().Add(duration))
 }
 
 func (s *Session) ExpireAt(t time.Time) error {
@@ -81,36 +252,158 @@ func (s *Session) ExpireAt(t time.Time) error {
 	if !ok {
 		return fmt.Errorf("Session not found")
 	}
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
 	sesh.Expiry = t
 	return nil
 }
 
+// SetRotationGrace sets how long a session keeps working after it's been
+// replaced by Rotate.
+func SetRotationGrace(grace time.Duration) {
+	rotationGrace = grace
+}
+
+// Rotate replaces the session with a new one belonging to the same user and
+// with the same CSRF token, which expires after the default delay. The old
+// session keeps working for a short grace period (see SetRotationGrace), so
+// that concurrent requests which still carry it don't fail.
+func (s *Session) Rotate() (Session, *SessionMetadata, error) {
+	replacement := randomSession()
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	old := AllSessions[*s]
+	if old == nil {
+		return nullSession, nil, fmt.Errorf("Session not found")
+	}
+	if old.Rotated {
+		return nullSession, nil, fmt.Errorf("Session has already been rotated")
+	}
+	for AllSessions[replacement] != nil {
+		replacement = randomSession()
+	}
+	metadata := *old
+	metadata.Expiry = old.expiryFrom(time.Now())
+	replacement.insert(&metadata)
+	retiring := *old
+	retiring.Rotated = true
+	if grace := time.Now().Add(rotationGrace); grace.Before(retiring.Expiry) {
+		retiring.Expiry = grace
+	}
+	AllSessions[*s] = &retiring
+	return replacement, &metadata, nil
+}
+
 func SetDefaultExpiry(t time.Duration) {
 	expiryDelay = t
 }
 
+// NewSessionFor returns a new random token belonging to the given user.
+func NewSessionFor(user Username) (Session, *SessionMetadata) {
+	token, metadata, _ := newSession(&SessionMetadata{User: user})
+	return token, metadata
+}
+
+// NewSessionForClient signs the user in with a new random token, noting the
+// client's attributes, which it may be bound to (see BindingPolicy), and the
+// methods the user authenticated with, which default to AuthPassword. Unlike
+// NewSessionFor, it enforces the session limit (see SetSessionLimit), so it
+// may return an error satisfying IsTooManySessions. Users enrolled in
+// two-factor authentication must have entered a code (AuthOTP), or the error
+// satisfies IsSecondFactorRequired; see NewPendingSession.
+func NewSessionForClient(
+	user Username, r *http.Request, methods ...string,
+) (Session, *SessionMetadata, error) {
+	if len(methods) == 0 {
+		methods = []string{AuthPassword}
+	}
+	if user.HasTOTP() && !hasMethod(methods, AuthOTP) {
+		return nullSession, nil, SecondFactorRequired(user)
+	}
+	return newSession(&SessionMetadata{
+		User:           user,
+		UserAgent:      r.UserAgent(),
+		RemoteAddr:     r.RemoteAddr,
+		ChannelBinding: channelBinding(r),
+		AuthMethods:    append([]string(nil), methods...),
+		limited:        true,
+	})
+}
+
+func hasMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Reauthenticate records that the user has just proved who they are again,
+// by the given methods, for routes which require a recent sign-in.
+func (s *Session) Reauthenticate(methods ...string) error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	metadata := AllSessions[*s]
+	if metadata == nil {
+		return fmt.Errorf("Session not found")
+	}
+	metadata.AuthenticatedAt = time.Now()
+	metadata.AuthMethods = methods
+	return nil
+}
+
 // NewSession returns a new random token.
 func NewSession() (Session, *SessionMetadata) {
+	token, metadata, _ := newSession(new(SessionMetadata))
+	return token, metadata
+}
+
+// newSession stores the metadata under a new random token, filling in its
+// times and CSRF token. If the session is limited, it makes room for it first.
+func newSession(metadata *SessionMetadata) (Session, *SessionMetadata, error) {
 	var (
-		token    Session
-		temp     *big.Int
-		err      error
-		metadata = &SessionMetadata{
-			Expiry: time.Now().Add(expiryDelay),
-		}
+		token = randomSession()
+		err   error
+		now   = time.Now()
 	)
+	metadata.Created, metadata.LastSeen = now, now
+	if len(metadata.AuthMethods) > 0 && metadata.AuthenticatedAt.IsZero() {
+		metadata.AuthenticatedAt = now
+	}
+	if metadata.PendingSecondFactor {
+		metadata.Expiry = now.Add(pendingSecondFactorExpiry)
+	} else {
+		metadata.Expiry = metadata.expiryFrom(now)
+	}
+	metadata.CSRFToken, err = NewCSRFToken()
+	if err != nil {
+		log.Fatal(err)
+	}
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if metadata.limited {
+		if err = makeRoomFor(metadata.User); err != nil {
+			return nullSession, nil, err
+		}
+	}
+	for AllSessions[token] != nil {
+		token = randomSession()
+	}
+	token.insert(metadata)
+	return token, metadata, nil
+}
+
+// randomSession generates a random token.
+func randomSession() (token Session) {
 	for i := 0; i < SessionKeyLength; i++ {
-		temp, err = rand.Int(rand.Reader, byteSize)
+		temp, err := rand.Int(rand.Reader, byteSize)
 		if err != nil {
 			log.Fatalf("error reading from random number generator! %v", err)
 		}
 		token[i] = byte(temp.Int64())
 	}
-	if token.CurrentlyExists() {
-		token, metadata = NewSession()
-	}
-	AllSessions[token] = metadata
-	return token, metadata
+	return
 }
 
 // SetCleanupInterval sets how frequently to sweep for expired tokens
@@ -140,6 +433,11 @@ func doSweep() {
 		sweepDelay,
 	)
 	defer cancel()
+	var (
+		expired []Session
+		now     = time.Now()
+	)
+	sessionsLock.RLock()
 	for sesh, metadata := range AllSessions {
 		select {
 		case <-ctx.Done():
@@ -150,11 +448,16 @@ func doSweep() {
 				sweepDelay/time.Second,
 			)
 		default:
-			if metadata.Expiry.Unix() < time.Now().Unix() {
-				sesh.Delete()
+			if metadata.expiredAt(now) {
+				expired = append(expired, sesh)
 			}
 		}
 	}
+	sessionsLock.RUnlock()
+	for _, sesh := range expired {
+		sesh.Delete()
+	}
+	sweepRefreshTokens()
 }
 
 func incrementSleepDelay() {
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const (
+	// the number of bytes of HMAC-SHA256 kept in a signed session ID. 128
+	// bits is plenty for a tag which can't be checked offline.
+	sessionIDTagLength = 16
+	// MinIDSigningKeyLength is the shortest key NewIDSigner accepts.
+	MinIDSigningKeyLength = 32
+)
+
+var sessionIDEncoding = base64.RawURLEncoding
+
+// ID encodes the session as a URL-safe string.
+func (s Session) ID() string {
+	return sessionIDEncoding.EncodeToString(s[:])
+}
+
+// ParseSessionID decodes a string created by Session.ID. It doesn't check
+// whether the session exists.
+func ParseSessionID(id string) (s Session, err error) {
+	raw, err := sessionIDEncoding.DecodeString(id)
+	if err != nil {
+		return s, fmt.Errorf("invalid session ID: %v", err)
+	}
+	if len(raw) != SessionKeyLength {
+		return s, fmt.Errorf(
+			"invalid session ID: got %d bytes, expected %d",
+			len(raw),
+			SessionKeyLength,
+		)
+	}
+	copy(s[:], raw)
+	return s, nil
+}
+
+// IDSigner signs session IDs so that they can be handed to clients directly,
+// e.g. in a cookie, instead of inside an encrypted cookie. The server still
+// looks the session up in AllSessions, so deleting it revokes it no matter
+// what key signed it.
+type IDSigner struct {
+	// keys[0] signs; all of them verify.
+	keys [][]byte
+}
+
+// NewIDSigner creates an IDSigner which signs with the given key, and also
+// accepts IDs signed with any of the old keys, so that the key can be rotated
+// without signing everyone out.
+func NewIDSigner(key []byte, oldKeys ...[]byte) (*IDSigner, error) {
+	signer := new(IDSigner)
+	for _, k := range append([][]byte{key}, oldKeys...) {
+		if len(k) < MinIDSigningKeyLength {
+			return nil, fmt.Errorf(
+				"session ID signing keys must be at least %d bytes, got %d",
+				MinIDSigningKeyLength,
+				len(k),
+			)
+		}
+		signer.keys = append(signer.keys, append([]byte(nil), k...))
+	}
+	return signer, nil
+}
+
+func idTag(key []byte, id string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)[:sessionIDTagLength]
+}
+
+// Sign returns the session's ID followed by a signature.
+func (signer *IDSigner) Sign(s Session) string {
+	id := s.ID()
+	return id + "." + sessionIDEncoding.EncodeToString(idTag(signer.keys[0], id))
+}
+
+// Parse checks the signature on a string created by Sign and returns the
+// session it refers to. It doesn't check whether the session exists.
+func (signer *IDSigner) Parse(signed string) (s Session, err error) {
+	dot := strings.LastIndexByte(signed, '.')
+	if dot < 0 {
+		return s, fmt.Errorf("session ID isn't signed")
+	}
+	id, encodedTag := signed[:dot], signed[dot+1:]
+	tag, err := sessionIDEncoding.DecodeString(encodedTag)
+	if err != nil {
+		return s, fmt.Errorf("invalid session ID signature: %v", err)
+	}
+	for _, key := range signer.keys {
+		if hmac.Equal(tag, idTag(key, id)) {
+			return ParseSessionID(id)
+		}
+	}
+	return s, fmt.Errorf("session ID signature doesn't match")
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestSignedSessionIDs(t *testing.T) {
+	var (
+		test        = attest.New(t)
+		key         = bytes.Repeat([]byte("k"), MinIDSigningKeyLength)
+		oldKey      = bytes.Repeat([]byte("o"), MinIDSigningKeyLength)
+		token, _    = NewSession()
+		signer, _   = NewIDSigner(key, oldKey)
+		oldSigner   = test.EatError(NewIDSigner(oldKey)).(*IDSigner)
+		otherKey    = bytes.Repeat([]byte("x"), MinIDSigningKeyLength)
+		other       = test.EatError(NewIDSigner(otherKey)).(*IDSigner)
+		signed      = signer.Sign(token)
+		parsed, err = signer.Parse(signed)
+	)
+	defer token.Delete()
+	test.Handle(err)
+	test.Equals(token, parsed)
+	parsed, err = signer.Parse(oldSigner.Sign(token))
+	test.Handle(err)
+	test.Equals(token, parsed)
+	_, err = signer.Parse(other.Sign(token))
+	test.NotNil(err, "accepted an ID signed by an unknown key")
+	_, err = signer.Parse(token.ID())
+	test.NotNil(err, "accepted an unsigned ID")
+	tampered := []byte(signed)
+	tampered[0] ^= 1
+	_, err = signer.Parse(string(tampered))
+	test.NotNil(err, "accepted a tampered ID")
+	_, err = NewIDSigner([]byte("short"))
+	test.NotNil(err, "accepted a short key")
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"sort"
+	"time"
+)
+
+// SessionLimitStrategy decides what happens when a user who already holds as
+// many sessions as they're allowed signs in again.
+type SessionLimitStrategy int
+
+const (
+	// RejectNewSession refuses the new sign-in with an error satisfying
+	// IsTooManySessions.
+	RejectNewSession SessionLimitStrategy = iota
+	// EvictLeastRecentlyUsed signs the user out of the session they used
+	// longest ago to make room.
+	EvictLeastRecentlyUsed
+	// EvictOldest signs the user out of the session they started longest ago
+	// to make room.
+	EvictOldest
+)
+
+var (
+	// the most sessions each user may hold at once, or 0 for no limit
+	sessionLimit int
+	// limits for particular users, overriding sessionLimit
+	userSessionLimits    = make(map[Username]int)
+	sessionLimitStrategy SessionLimitStrategy
+)
+
+// SetSessionLimit sets how many sessions each user may hold at once, and what
+// to do when they sign in again once they have that many. 0 means there's no
+// limit. Only sign-ins are limited (see NewSessionForClient), not sessions
+// created with NewSessionFor or by refresh tokens, and not signed tokens,
+// which aren't stored.
+func SetSessionLimit(limit int, strategy SessionLimitStrategy) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	sessionLimit = limit
+	sessionLimitStrategy = strategy
+}
+
+// SetSessionLimitFor overrides the session limit for one user. 0 means
+// they're unlimited; a negative limit removes the override.
+func SetSessionLimitFor(user Username, limit int) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if limit < 0 {
+		delete(userSessionLimits, user)
+	} else {
+		userSessionLimits[user] = limit
+	}
+}
+
+// limitFor gets the session limit for the user. sessionsLock must be held.
+func limitFor(user Username) int {
+	if limit, ok := userSessionLimits[user]; ok {
+		return limit
+	}
+	return sessionLimit
+}
+
+// makeRoomFor enforces the user's session limit before they get another
+// session, evicting sessions or returning an error according to the
+// strategy. sessionsLock must be held.
+func makeRoomFor(user Username) error {
+	limit := limitFor(user)
+	if limit <= 0 || user == "" {
+		return nil
+	}
+	var (
+		live []Session
+		now  = time.Now()
+	)
+	for token := range userSessions[user] {
+		metadata := AllSessions[token]
+		if metadata != nil && metadata.limited && !metadata.Rotated &&
+			!metadata.expiredAt(now) {
+			live = append(live, token)
+		}
+	}
+	if len(live) < limit {
+		return nil
+	}
+	if sessionLimitStrategy == RejectNewSession {
+		return TooManySessions(user, limit)
+	}
+	sort.Slice(live, func(i, j int) bool {
+		a, b := AllSessions[live[i]], AllSessions[live[j]]
+		if sessionLimitStrategy == EvictOldest {
+			return a.Created.Before(b.Created)
+		}
+		return a.LastSeen.Before(b.LastSeen)
+	})
+	for _, token := range live[:len(live)-limit+1] {
+		token.delete()
+	}
+	return nil
+}
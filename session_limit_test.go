@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestSessionLimit(t *testing.T) {
+	var (
+		test = attest.New(t)
+		user = Username("test session limit user")
+		req  = httptest.NewRequest("GET", "/", nil)
+	)
+	defer SetSessionLimit(0, RejectNewSession)
+	defer user.RevokeSessions()
+	signIn := func() Session {
+		token, _, err := NewSessionForClient(user, req)
+		test.Handle(err)
+		return token
+	}
+	t.Run("reject", func(t *testing.T) {
+		test := attest.New(t)
+		SetSessionLimit(2, RejectNewSession)
+		first, second := signIn(), signIn()
+		// sessions which weren't created by signing in don't count
+		unlimited, _ := NewSessionFor(user)
+		_, _, err := NewSessionForClient(user, req)
+		test.Attest(IsTooManySessions(err), "expected a TooManySessions error, got %v", err)
+		test.Equals(403, StatusOf(err))
+		first.Delete()
+		third := signIn()
+		for _, s := range []Session{second, third, unlimited} {
+			s.Delete()
+		}
+	})
+	t.Run("evict least recently used", func(t *testing.T) {
+		test := attest.New(t)
+		SetSessionLimit(2, EvictLeastRecentlyUsed)
+		first, second := signIn(), signIn()
+		metadata, _ := first.GetMetadata()
+		metadata.LastSeen = time.Now().Add(time.Hour)
+		third := signIn()
+		test.Attest(first.CurrentlyExists(), "the most recently used session was evicted")
+		test.Attest(!second.CurrentlyExists(), "the least recently used session wasn't evicted")
+		test.Attest(third.CurrentlyExists(), "the new session wasn't created")
+		first.Delete()
+		third.Delete()
+	})
+	t.Run("evict oldest", func(t *testing.T) {
+		test := attest.New(t)
+		SetSessionLimit(2, EvictOldest)
+		first, second := signIn(), signIn()
+		metadata, _ := first.GetMetadata()
+		metadata.LastSeen = time.Now().Add(time.Hour)
+		third := signIn()
+		test.Attest(!first.CurrentlyExists(), "the oldest session wasn't evicted")
+		test.Attest(second.CurrentlyExists(), "a newer session was evicted")
+		second.Delete()
+		third.Delete()
+	})
+	t.Run("per user", func(t *testing.T) {
+		test := attest.New(t)
+		SetSessionLimit(1, RejectNewSession)
+		SetSessionLimitFor(user, 0)
+		defer SetSessionLimitFor(user, -1)
+		signIn()
+		signIn()
+		test.Equals(2, len(user.Sessions()))
+		user.RevokeSessions()
+	})
+}
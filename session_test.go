@@ -125,3 +125,75 @@ func TestDeletion(t *testing.T) {
 		t.Errorf("token exists")
 	}
 }
+
+func TestRotation(t *testing.T) {
+	test := attest.New(t)
+	defer SetRotationGrace(rotationGrace)
+	SetRotationGrace(time.Second)
+	SetCleanupInterval(500 * time.Millisecond)
+	token, metadata := NewSessionFor("test rotation user")
+	token.ExpireIn(time.Hour)
+	rotated, rotatedMetadata, err := token.Rotate()
+	test.Handle(err)
+	test.NotEqual(token, rotated)
+	test.Equals(metadata.User, rotatedMetadata.User)
+	test.Equals(metadata.CSRFToken, rotatedMetadata.CSRFToken)
+	test.DiffersByLessThan(
+		int64(2),
+		time.Now().Add(expiryDelay).Unix(),
+		rotatedMetadata.Expiry.Unix(),
+	)
+	old, exists := token.GetMetadata()
+	test.Attest(exists, "the old session didn't last through the grace period")
+	test.Attest(old.Rotated, "the old session wasn't marked as rotated")
+	_, _, err = token.Rotate()
+	test.NotNil(err, "rotated a session twice")
+	time.Sleep(2500 * time.Millisecond)
+	test.Attest(!token.CurrentlyExists(), "the old session outlived the grace period")
+	test.Attest(rotated.CurrentlyExists(), "the new session expired")
+	rotated.Delete()
+}
+
+func TestIdleTimeout(t *testing.T) {
+	test := attest.New(t)
+	defer SetIdleTimeout(0)
+	SetIdleTimeout(time.Second)
+	token, _ := NewSessionFor("test idle user")
+	defer token.Delete()
+	for i := 0; i < 3; i++ {
+		time.Sleep(600 * time.Millisecond)
+		_, ok := token.Touch()
+		test.Attest(ok, "an active session idled out after %d touches", i)
+	}
+	time.Sleep(1200 * time.Millisecond)
+	_, ok := token.Touch()
+	test.Attest(!ok, "an idle session was still accepted")
+}
+
+func TestMaxLifetime(t *testing.T) {
+	test := attest.New(t)
+	defer SetMaxLifetime(0)
+	SetMaxLifetime(time.Hour)
+	token, metadata := NewSessionFor("test lifetime user")
+	defer token.Delete()
+	test.DiffersByLessThan(
+		int64(2),
+		time.Now().Add(time.Hour).Unix(),
+		metadata.Expiry.Unix(),
+	)
+	// pretend the user signed in long ago; renewing mustn't extend the
+	// session past its lifetime
+	metadata.Created = time.Now().Add(-time.Hour + time.Minute)
+	rotated, rotatedMetadata, err := token.Rotate()
+	test.Handle(err)
+	defer rotated.Delete()
+	test.Equals(metadata.Created, rotatedMetadata.Created)
+	test.DiffersByLessThan(
+		int64(2),
+		time.Now().Add(time.Minute).Unix(),
+		rotatedMetadata.Expiry.Unix(),
+	)
+	rotatedMetadata.Created = time.Now().Add(-2 * time.Hour)
+	_, ok := rotated.Touch()
+	test.Attest(!ok, "a session was accepted past its maximum lifetime")
+}
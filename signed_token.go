@@ -0,0 +1,382 @@
+package auth
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AlgHS256 signs tokens with HMAC-SHA256 and a shared secret.
+	AlgHS256 = "HS256"
+	// AlgEdDSA signs tokens with Ed25519, so that services which only verify
+	// tokens don't need to hold the signing key.
+	AlgEdDSA = "EdDSA"
+	// MinTokenSecretLength is the shortest HS256 secret AddHMACKey accepts.
+	MinTokenSecretLength = 32
+)
+
+var jwtEncoding = base64.RawURLEncoding
+
+// Claims are carried by a signed token. They're encoded as a JWT payload.
+type Claims struct {
+	User  Username `json:"sub"`
+	Roles []string `json:"roles,omitempty"`
+	// ID identifies the token so that it can be revoked.
+	ID       string `json:"jti"`
+	Issuer   string `json:"iss,omitempty"`
+	IssuedAt int64  `json:"iat"`
+	Expires  int64  `json:"exp"`
+	// CSRFToken must accompany unsafe requests made with this token, like
+	// SessionMetadata.CSRFToken.
+	CSRFToken string `json:"csrf,omitempty"`
+	// AuthTime is when the user signed in, which renewing the token doesn't
+	// change, and AuthMethods is how, as in SessionMetadata.
+	AuthTime    int64    `json:"auth_time,omitempty"`
+	AuthMethods []string `json:"amr,omitempty"`
+}
+
+// HasRole reports whether the token was issued with the given role.
+func (c *Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Expiry gets when the token expires.
+func (c *Claims) Expiry() time.Time {
+	return time.Unix(c.Expires, 0)
+}
+
+// Metadata describes the token as SessionMetadata, for CheckCSRF.
+func (c *Claims) Metadata() *SessionMetadata {
+	metadata := &SessionMetadata{
+		User:        c.User,
+		Expiry:      c.Expiry(),
+		CSRFToken:   c.CSRFToken,
+		AuthMethods: c.AuthMethods,
+	}
+	if c.AuthTime != 0 {
+		metadata.AuthenticatedAt = time.Unix(c.AuthTime, 0)
+	}
+	return metadata
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+}
+
+type tokenKey struct {
+	alg     string
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+// TokenSigner issues and verifies signed, expiring tokens (JWTs), as an
+// alternative to sessions stored in AllSessions. Verifying a token doesn't
+// need any shared state except the keys, so it suits services which can't
+// share a session store. Each key has an ID which is sent in the token's
+// "kid" header, so keys can be rotated: add the new key, UseKey it, and
+// remove the old one once the tokens it signed have expired.
+type TokenSigner struct {
+	// TTL is how long issued tokens last. Defaults to an hour.
+	TTL time.Duration
+	// Issuer is put in the "iss" claim, and required of verified tokens if
+	// it's set.
+	Issuer string
+
+	lock    sync.RWMutex
+	keys    map[string]tokenKey
+	current string
+	// revoked maps the IDs of revoked tokens to when they expire anyway.
+	revoked map[string]time.Time
+}
+
+// NewTokenSigner creates a TokenSigner whose tokens last for ttl. It can't
+// sign or verify anything until a key is added.
+func NewTokenSigner(ttl time.Duration) *TokenSigner {
+	return &TokenSigner{
+		TTL:     ttl,
+		keys:    make(map[string]tokenKey),
+		revoked: make(map[string]time.Time),
+	}
+}
+
+func (s *TokenSigner) addKey(kid string, key tokenKey) error {
+	if kid == "" {
+		return fmt.Errorf("empty key ID")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.keys == nil {
+		s.keys = make(map[string]tokenKey)
+	}
+	s.keys[kid] = key
+	if s.current == "" && (key.secret != nil || key.private != nil) {
+		s.current = kid
+	}
+	return nil
+}
+
+// AddHMACKey adds an HS256 secret with the given ID. The first signing key
+// added is used to sign new tokens until UseKey is called.
+func (s *TokenSigner) AddHMACKey(kid string, secret []byte) error {
+	if len(secret) < MinTokenSecretLength {
+		return fmt.Errorf(
+			"token secret %s is %d bytes; at least %d are required",
+			kid,
+			len(secret),
+			MinTokenSecretLength,
+		)
+	}
+	return s.addKey(kid, tokenKey{alg: AlgHS256, secret: append([]byte(nil), secret...)})
+}
+
+// AddEd25519Key adds an EdDSA signing key with the given ID.
+func (s *TokenSigner) AddEd25519Key(kid string, private ed25519.PrivateKey) error {
+	if len(private) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid Ed25519 private key %s", kid)
+	}
+	return s.addKey(kid, tokenKey{
+		alg:     AlgEdDSA,
+		private: private,
+		public:  private.Public().(ed25519.PublicKey),
+	})
+}
+
+// AddEd25519VerifyKey adds an EdDSA public key with the given ID, which can
+// verify tokens but not sign them.
+func (s *TokenSigner) AddEd25519VerifyKey(kid string, public ed25519.PublicKey) error {
+	if len(public) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid Ed25519 public key %s", kid)
+	}
+	return s.addKey(kid, tokenKey{alg: AlgEdDSA, public: public})
+}
+
+// UseKey sets the key new tokens are signed with.
+func (s *TokenSigner) UseKey(kid string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key, ok := s.keys[kid]
+	if !ok {
+		return fmt.Errorf("token key %s has not been added", kid)
+	}
+	if key.secret == nil && key.private == nil {
+		return fmt.Errorf("token key %s can only verify tokens", kid)
+	}
+	s.current = kid
+	return nil
+}
+
+// RemoveKey forgets the key with the given ID. Tokens signed with it are no
+// longer accepted.
+func (s *TokenSigner) RemoveKey(kid string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.keys, kid)
+	if s.current == kid {
+		s.current = ""
+	}
+}
+
+// EffectiveTTL gets how long issued tokens last: TTL, or an hour if it isn't
+// set.
+func (s *TokenSigner) EffectiveTTL() time.Duration {
+	if s.TTL <= 0 {
+		return time.Hour
+	}
+	return s.TTL
+}
+
+func (key *tokenKey) sign(input []byte) []byte {
+	if key.alg == AlgEdDSA {
+		return ed25519.Sign(key.private, input)
+	}
+	mac := hmac.New(sha256.New, key.secret)
+	mac.Write(input)
+	return mac.Sum(nil)
+}
+
+func (key *tokenKey) verify(input, signature []byte) bool {
+	if key.alg == AlgEdDSA {
+		return ed25519.Verify(key.public, input, signature)
+	}
+	return hmac.Equal(key.sign(input), signature)
+}
+
+// Issue signs a new token for the user with the given roles, for when they've
+// just signed in with a password.
+func (s *TokenSigner) Issue(user Username, roles ...string) (string, Claims, error) {
+	return s.IssueAuthenticatedBy(user, []string{AuthPassword}, roles...)
+}
+
+// IssueAuthenticatedBy signs a new token for the user with the given roles,
+// for when they've just signed in by the given methods, e.g. AuthPassword
+// and AuthOTP.
+func (s *TokenSigner) IssueAuthenticatedBy(
+	user Username, methods []string, roles ...string,
+) (string, Claims, error) {
+	return s.issue(Claims{
+		User:        user,
+		Roles:       roles,
+		AuthTime:    time.Now().Unix(),
+		AuthMethods: append([]string(nil), methods...),
+	})
+}
+
+// Renew signs a new token to replace the given one, with the given roles. It
+// keeps the time and methods the user signed in with.
+func (s *TokenSigner) Renew(previous Claims, roles ...string) (string, Claims, error) {
+	return s.issue(Claims{
+		User:        previous.User,
+		Roles:       roles,
+		AuthTime:    previous.AuthTime,
+		AuthMethods: previous.AuthMethods,
+	})
+}
+
+// issue fills in the rest of the claims and signs them.
+func (s *TokenSigner) issue(claims Claims) (string, Claims, error) {
+	var (
+		now    = time.Now()
+		random = make([]byte, 16)
+	)
+	if _, err := rand.Read(random); err != nil {
+		return "", claims, err
+	}
+	csrfToken, err := NewCSRFToken()
+	if err != nil {
+		return "", claims, err
+	}
+	claims.ID = hex.EncodeToString(random)
+	claims.Issuer = s.Issuer
+	claims.IssuedAt = now.Unix()
+	claims.Expires = now.Add(s.EffectiveTTL()).Unix()
+	claims.CSRFToken = csrfToken
+	s.lock.RLock()
+	kid := s.current
+	key, ok := s.keys[kid]
+	s.lock.RUnlock()
+	if !ok {
+		return "", claims, fmt.Errorf("no token signing key has been added")
+	}
+	header, err := json.Marshal(jwtHeader{Alg: key.alg, Typ: "JWT", Kid: kid})
+	if err != nil {
+		return "", claims, err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", claims, err
+	}
+	input := jwtEncoding.EncodeToString(header) + "." +
+		jwtEncoding.EncodeToString(payload)
+	return input + "." + jwtEncoding.EncodeToString(key.sign([]byte(input))), claims, nil
+}
+
+// Verify checks the token's signature, expiry and issuer, and that it hasn't
+// been revoked. Errors satisfy IsCredentialsRejected with the status 401
+// Unauthorized.
+func (s *TokenSigner) Verify(token string) (claims Claims, err error) {
+	invalid := func(reason string) (Claims, error) {
+		return Claims{}, CredentialsRejected(http.StatusUnauthorized, reason)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return invalid("malformed token")
+	}
+	var header jwtHeader
+	if err = decodeTokenPart(parts[0], &header); err != nil {
+		return invalid("malformed token header")
+	}
+	signature, err := jwtEncoding.DecodeString(parts[2])
+	if err != nil {
+		return invalid("malformed token signature")
+	}
+	s.lock.RLock()
+	key, ok := s.keys[header.Kid]
+	s.lock.RUnlock()
+	// the algorithm must be the key's, so that a public key can't be used as
+	// an HMAC secret
+	if !ok || header.Alg != key.alg {
+		return invalid("token signed with an unknown key")
+	}
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return invalid("invalid token signature")
+	}
+	if err = decodeTokenPart(parts[1], &claims); err != nil {
+		return invalid("malformed token claims")
+	}
+	if claims.User == "" || claims.Expiry().Before(time.Now()) {
+		return invalid("token expired")
+	}
+	if s.Issuer != "" && claims.Issuer != s.Issuer {
+		return invalid("token from another issuer")
+	}
+	if s.isRevoked(claims.ID) {
+		return invalid("token revoked")
+	}
+	return claims, nil
+}
+
+func decodeTokenPart(part string, into interface{}) error {
+	decoded, err := jwtEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, into)
+}
+
+// Revoke rejects the token until it expires, for signing out. Revocations
+// are only held in memory by this signer.
+func (s *TokenSigner) Revoke(claims Claims) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.revoked == nil {
+		s.revoked = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for id, expiry := range s.revoked {
+		if expiry.Before(now) {
+			delete(s.revoked, id)
+		}
+	}
+	s.revoked[claims.ID] = claims.Expiry()
+}
+
+func (s *TokenSigner) isRevoked(id string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, revoked := s.revoked[id]
+	return revoked
+}
+
+type claimsContextKey struct{}
+
+// WithClaims gets a copy of the request carrying the claims of the token which
+// authenticated it.
+func WithClaims(r *http.Request, claims Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, &claims))
+}
+
+// ClaimsFrom gets the claims of the token which authenticated the request, or
+// nil if it wasn't authenticated by a signed token.
+func ClaimsFrom(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(claimsContextKey{}).(*Claims)
+	return claims
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestSignedTokens(t *testing.T) {
+	var (
+		test   = attest.New(t)
+		signer = NewTokenSigner(time.Hour)
+		user   = Username("test token user")
+	)
+	_, _, err := signer.Issue(user)
+	test.NotNil(err, "issued a token without a key")
+	test.NotNil(signer.AddHMACKey("short", []byte("short")), "accepted a short secret")
+	test.Handle(signer.AddHMACKey("one", []byte("test token signing secret, 32+ bytes")))
+	token, issued, err := signer.Issue(user, "reader")
+	test.Handle(err)
+	t.Run("verify", func(t *testing.T) {
+		test := attest.New(t)
+		claims, err := signer.Verify(token)
+		test.Handle(err)
+		test.Equals(user, claims.User)
+		test.Equals(issued.ID, claims.ID)
+		test.Attest(claims.HasRole("reader"), "role was lost")
+		test.Attest(!claims.HasRole("admin"), "token has a role it wasn't issued")
+	})
+	t.Run("tampering", func(t *testing.T) {
+		test := attest.New(t)
+		parts := strings.Split(token, ".")
+		forged := NewTokenSigner(time.Hour)
+		test.Handle(forged.AddHMACKey("one", []byte("someone else's secret, 32+ bytes")))
+		other, _, err := forged.Issue("admin")
+		test.Handle(err)
+		otherParts := strings.Split(other, ".")
+		_, err = signer.Verify(parts[0] + "." + otherParts[1] + "." + parts[2])
+		test.Attest(IsCredentialsRejected(err), "a token with swapped claims was accepted")
+		_, err = signer.Verify(other)
+		test.Attest(IsCredentialsRejected(err), "a token signed with another secret was accepted")
+		_, err = signer.Verify("not.a token")
+		test.Attest(IsCredentialsRejected(err), "a malformed token was accepted")
+	})
+	t.Run("EdDSA and rotation", func(t *testing.T) {
+		test := attest.New(t)
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		test.Handle(err)
+		test.Handle(signer.AddEd25519Key("two", private))
+		test.Handle(signer.UseKey("two"))
+		rotated, _, err := signer.Issue(user)
+		test.Handle(err)
+		_, err = signer.Verify(rotated)
+		test.Handle(err)
+		_, err = signer.Verify(token)
+		test.Handle(err)
+		verifier := NewTokenSigner(time.Hour)
+		test.Handle(verifier.AddEd25519VerifyKey("two", public))
+		test.NotNil(verifier.UseKey("two"), "a verify-only key was used for signing")
+		_, err = verifier.Verify(rotated)
+		test.Handle(err)
+		_, err = verifier.Verify(token)
+		test.Attest(IsCredentialsRejected(err), "a token with an unknown kid was accepted")
+		signer.RemoveKey("one")
+		_, err = signer.Verify(token)
+		test.Attest(IsCredentialsRejected(err), "a token signed with a removed key was accepted")
+	})
+	t.Run("expiry and revocation", func(t *testing.T) {
+		test := attest.New(t)
+		signer.TTL = time.Second
+		expired, _, err := signer.Issue(user)
+		test.Handle(err)
+		signer.TTL = time.Hour
+		time.Sleep(2 * time.Second)
+		_, err = signer.Verify(expired)
+		test.Attest(IsCredentialsRejected(err), "an expired token was accepted")
+		token, claims, err := signer.Issue(user)
+		test.Handle(err)
+		signer.Revoke(claims)
+		_, err = signer.Verify(token)
+		test.Equals(http.StatusUnauthorized, StatusOf(err))
+	})
+	t.Run("renewal", func(t *testing.T) {
+		test := attest.New(t)
+		previous := issued
+		previous.AuthTime = time.Now().Add(-time.Hour).Unix()
+		token, renewed, err := signer.Renew(previous, "writer")
+		test.Handle(err)
+		test.NotEqual(previous.ID, renewed.ID)
+		test.Equals(previous.AuthTime, renewed.AuthTime)
+		test.Equals(1, len(renewed.AuthMethods))
+		test.Equals(AuthPassword, renewed.AuthMethods[0])
+		claims, err := signer.Verify(token)
+		test.Handle(err)
+		test.Attest(claims.HasRole("writer"), "renewed token lacks its roles")
+		test.Equals(previous.AuthTime, claims.Metadata().AuthenticatedAt.Unix())
+	})
+	t.Run("context", func(t *testing.T) {
+		test := attest.New(t)
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		test.Attest(ClaimsFrom(req) == nil, "found claims in a new request")
+		test.Equals(user, ClaimsFrom(WithClaims(req, issued)).User)
+	})
+}
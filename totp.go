@@ -0,0 +1,351 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// AuthOTP is the authentication method reference (see RFC 8176) for
+	// entering a one-time code from an authenticator app.
+	AuthOTP = "otp"
+	// the RFC 6238 parameters which authenticator apps all support: 6 digit
+	// HMAC-SHA1 codes which change every 30 seconds
+	totpDigits = 6
+	totpPeriod = 30
+	// 160 bits, the length of an HMAC-SHA1 key
+	totpSecretLength = 20
+	// additional authenticated data for sealed secrets, which the username
+	// is appended to so that secrets can't be swapped between users
+	totpSecretAAD = "go-middleware-session-auth totp v1\n"
+)
+
+var (
+	// totpKey provides the key TOTP secrets are encrypted with. If it's nil
+	// the user file's key is used.
+	totpKey KeyProvider
+	// how many time steps either side of the current one codes are accepted
+	// from, to allow for clock drift
+	totpSkew = 1
+	// totpNow gets the time codes are checked against
+	totpNow = time.Now
+	// totpEncoding is how secrets are shown to users, as authenticator apps
+	// expect them
+	totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// TOTPSecret is a user's enrollment in TOTP (RFC 6238) two-factor
+// authentication. The secret is only stored encrypted; see
+// EncryptTOTPSecretsWith.
+type TOTPSecret struct {
+	// Sealed is the nonce and the encrypted secret.
+	Sealed []byte
+	// Confirmed is set once the user has entered a code from their
+	// authenticator app, proving it was set up. Until then signing in doesn't
+	// ask for a code.
+	Confirmed bool
+	// LastCounter is the time step of the last code accepted, so that codes
+	// can't be replayed.
+	LastCounter uint64
+}
+
+// TOTPEnrollment is what a user needs to set up their authenticator app.
+type TOTPEnrollment struct {
+	// Secret is the base32-encoded secret, for entering by hand.
+	Secret string
+	// URI is an otpauth:// URI, for showing as a QR code.
+	URI string
+	// RecoveryCodes can each be entered once instead of a code, if the user
+	// loses their authenticator app. They should be kept somewhere safe.
+	RecoveryCodes []string
+}
+
+// EncryptTOTPSecretsWith sets the KeyProvider which TOTP secrets are
+// encrypted with. If it's nil, the user file's key is used (see
+// EncryptUserFileWith), and RotateUserFileKey re-encrypts them along with the
+// file. Enrolling fails if neither is set. Secrets enrolled under one key
+// can't be read with another, so changing this one means resetting every
+// user's enrollment.
+func EncryptTOTPSecretsWith(provider KeyProvider) {
+	totpKey = provider
+}
+
+// SetTOTPSkew sets how many 30-second time steps either side of the current
+// one codes are accepted from, to allow for clocks which have drifted. It
+// defaults to 1.
+func SetTOTPSkew(steps int) {
+	if steps < 0 {
+		steps = 0
+	}
+	totpSkew = steps
+}
+
+func totpKeyProvider() (KeyProvider, error) {
+	if totpKey != nil {
+		return totpKey, nil
+	}
+	if usersKey != nil {
+		return usersKey, nil
+	}
+	return nil, fmt.Errorf(
+		"no key has been configured to encrypt TOTP secrets with; see " +
+			"EncryptTOTPSecretsWith",
+	)
+}
+
+// sealTOTPSecret encrypts a user's secret.
+func sealTOTPSecret(user Username, secret []byte) ([]byte, error) {
+	provider, err := totpKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	return sealTOTPSecretWith(provider, user, secret)
+}
+
+func sealTOTPSecretWith(
+	provider KeyProvider, user Username, secret []byte,
+) ([]byte, error) {
+	aead, err := userFileCipher(provider)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("error reading from random number generator! %v", err)
+	}
+	return aead.Seal(nonce, nonce, secret, []byte(totpSecretAAD+string(user))), nil
+}
+
+// openTOTPSecret decrypts a secret sealed by sealTOTPSecret.
+func openTOTPSecret(user Username, sealed []byte) ([]byte, error) {
+	provider, err := totpKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	return openTOTPSecretWith(provider, user, sealed)
+}
+
+func openTOTPSecretWith(
+	provider KeyProvider, user Username, sealed []byte,
+) ([]byte, error) {
+	aead, err := userFileCipher(provider)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("TOTP secret for %s is truncated", user)
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, ciphertext, []byte(totpSecretAAD+string(user)))
+	if err != nil {
+		return nil, fmt.Errorf(
+			"couldn't decrypt the TOTP secret for %s, is the key correct? %v",
+			user,
+			err,
+		)
+	}
+	return secret, nil
+}
+
+// resealTOTPSecrets re-encrypts every user's TOTP secret, which was sealed
+// with one key, with another. It changes nothing unless every secret could be
+// re-encrypted, and returns a function which puts back the secrets sealed
+// with the old key.
+func resealTOTPSecrets(from, to KeyProvider) (restore func(), err error) {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	resealed := make(map[Username][]byte)
+	for name, token := range AllUsers {
+		if len(token.TOTP.Sealed) == 0 {
+			continue
+		}
+		if to == nil {
+			return nil, fmt.Errorf(
+				"%s's TOTP secret can't be stored unencrypted; see "+
+					"EncryptTOTPSecretsWith",
+				name,
+			)
+		}
+		secret, err := openTOTPSecretWith(from, name, token.TOTP.Sealed)
+		if err != nil {
+			return nil, err
+		}
+		if resealed[name], err = sealTOTPSecretWith(to, name, secret); err != nil {
+			return nil, err
+		}
+	}
+	previous := make(map[Username][]byte, len(resealed))
+	for name, sealed := range resealed {
+		updated := *AllUsers[name]
+		previous[name] = updated.TOTP.Sealed
+		updated.TOTP.Sealed = sealed
+		AllUsers[name] = &updated
+	}
+	return func() {
+		usersLock.Lock()
+		defer usersLock.Unlock()
+		for name, sealed := range previous {
+			// leave secrets which have been changed since alone
+			if current := AllUsers[name]; current != nil &&
+				bytes.Equal(current.TOTP.Sealed, resealed[name]) {
+				updated := *current
+				updated.TOTP.Sealed = sealed
+				AllUsers[name] = &updated
+			}
+		}
+	}, nil
+}
+
+// totpCode computes the code for the given time step (RFC 4226 section 5.3).
+func totpCode(secret []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// TOTPURI gets the otpauth:// URI which sets up an authenticator app with the
+// given secret, labelled with the issuer and the username.
+func TOTPURI(issuer string, user Username, secret []byte) string {
+	query := url.Values{}
+	query.Set("secret", totpEncoding.EncodeToString(secret))
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	label := string(user)
+	if issuer != "" {
+		query.Set("issuer", issuer)
+		label = issuer + ":" + label
+	}
+	return (&url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + label,
+		RawQuery: query.Encode(),
+	}).String()
+}
+
+// EnrollTOTP generates a new TOTP secret for the user and saves it,
+// unconfirmed. The user sets up their authenticator app with the returned
+// enrollment, then confirms it with ConfirmTOTP. A new set of recovery codes
+// is generated along with the secret. A user who has already confirmed an
+// enrollment has to be reset with ResetTOTP first.
+func (u *Username) EnrollTOTP(issuer string) (enrollment TOTPEnrollment, err error) {
+	secret := make([]byte, totpSecretLength)
+	if _, err = rand.Read(secret); err != nil {
+		return
+	}
+	sealed, err := sealTOTPSecret(*u, secret)
+	if err != nil {
+		return
+	}
+	codes, hashed, err := newRecoveryCodes()
+	if err != nil {
+		return
+	}
+	err = updateUser(*u, func(token *Token) error {
+		if token.TOTP.Confirmed {
+			return fmt.Errorf("%s is already enrolled in two-factor authentication", *u)
+		}
+		token.TOTP = TOTPSecret{Sealed: sealed}
+		token.RecoveryCodes = hashed
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	if err = SyncAllUsers(); err != nil {
+		return
+	}
+	return TOTPEnrollment{
+		Secret:        totpEncoding.EncodeToString(secret),
+		URI:           TOTPURI(issuer, *u, secret),
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// ConfirmTOTP completes the user's enrollment if the code is correct, after
+// which signing in requires a code.
+func (u *Username) ConfirmTOTP(code string) error {
+	return u.checkTOTP(code, true)
+}
+
+// VerifyTOTP checks a code from the user's authenticator app. Each code is
+// only accepted once, and none from before it afterwards.
+func (u *Username) VerifyTOTP(code string) error {
+	return u.checkTOTP(code, false)
+}
+
+// HasTOTP reports whether the user has confirmed their enrollment in
+// two-factor authentication, so that signing in requires a code.
+func (u *Username) HasTOTP() bool {
+	token := lookupUser(*u)
+	return token != nil && token.TOTP.Confirmed
+}
+
+// ResetTOTP removes the user's enrollment and recovery codes, e.g. when
+// they've lost their authenticator app. They can sign in with their password
+// alone until they enroll again.
+func (u *Username) ResetTOTP() error {
+	err := updateUser(*u, func(token *Token) error {
+		token.TOTP = TOTPSecret{}
+		token.RecoveryCodes = RecoveryCodes{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return SyncAllUsers()
+}
+
+// checkTOTP checks the code against the user's secret, which must be
+// unconfirmed if confirming and confirmed otherwise, and records its time
+// step so it can't be used again.
+func (u *Username) checkTOTP(code string, confirming bool) error {
+	code = strings.Replace(strings.TrimSpace(code), " ", "", -1)
+	err := updateUser(*u, func(token *Token) error {
+		switch {
+		case len(token.TOTP.Sealed) == 0:
+			return fmt.Errorf("%s is not enrolled in two-factor authentication", *u)
+		case confirming && token.TOTP.Confirmed:
+			return fmt.Errorf("%s has already confirmed two-factor authentication", *u)
+		case !confirming && !token.TOTP.Confirmed:
+			return fmt.Errorf("%s hasn't confirmed two-factor authentication", *u)
+		}
+		secret, err := openTOTPSecret(*u, token.TOTP.Sealed)
+		if err != nil {
+			return err
+		}
+		current := uint64(totpNow().Unix()) / totpPeriod
+		for step := -totpSkew; step <= totpSkew; step++ {
+			counter := current + uint64(step)
+			if counter <= token.TOTP.LastCounter {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+				token.TOTP.LastCounter = counter
+				token.TOTP.Confirmed = true
+				return nil
+			}
+		}
+		return InvalidTOTPCode(u)
+	})
+	if err != nil {
+		return err
+	}
+	return SyncAllUsers()
+}
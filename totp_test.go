@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestTOTPCode(t *testing.T) {
+	test := attest.New(t)
+	// RFC 4226 appendix D
+	secret := []byte("12345678901234567890")
+	for counter, expected := range []string{"755224", "287082", "359152", "969429"} {
+		test.Equals(expected, totpCode(secret, uint64(counter)))
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	test := attest.New(t)
+	uri := test.EatError(url.Parse(
+		TOTPURI("Example Co", "test user", []byte("12345678901234567890")),
+	)).(*url.URL)
+	test.Equals("otpauth", uri.Scheme)
+	test.Equals("totp", uri.Host)
+	test.Equals("/Example Co:test user", uri.Path)
+	test.Equals("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	test.Equals("Example Co", uri.Query().Get("issuer"))
+}
+
+func TestTOTP(t *testing.T) {
+	const password = "test TOTP user's password"
+	var (
+		test = attest.New(t)
+		user = Username("test TOTP user")
+		now  = time.Unix(1700000000, 0)
+	)
+	AllUsers = make(UserCollection)
+	test.Handle(CreateNewUser(string(user), password))
+	totpNow = func() time.Time { return now }
+	defer func() { totpNow = time.Now }()
+
+	_, err := user.EnrollTOTP("test")
+	test.NotNil(err, "a secret was enrolled without a key to encrypt it")
+	EncryptTOTPSecretsWith(StaticKey("test TOTP key"))
+	defer EncryptTOTPSecretsWith(nil)
+	enrollment, err := user.EnrollTOTP("test")
+	test.Handle(err)
+	secret := test.EatError(totpEncoding.DecodeString(enrollment.Secret)).([]byte)
+	test.Attest(
+		!bytes.Contains(lookupUser(user).TOTP.Sealed, secret),
+		"the secret was stored in plain text",
+	)
+	test.Attest(!user.HasTOTP(), "the enrollment counted before it was confirmed")
+	code := func(offset time.Duration) string {
+		return totpCode(secret, uint64(now.Add(offset).Unix())/totpPeriod)
+	}
+	test.Attest(
+		IsInvalidTOTPCode(user.ConfirmTOTP("000000")) || code(0) == "000000",
+		"a wrong code confirmed the enrollment",
+	)
+	test.Handle(user.ConfirmTOTP(code(0)))
+	test.Attest(user.HasTOTP(), "the confirmed enrollment didn't count")
+	_, err = user.EnrollTOTP("test")
+	test.NotNil(err, "a confirmed enrollment was replaced")
+
+	t.Run("replay", func(t *testing.T) {
+		test := attest.New(t)
+		test.Attest(
+			IsInvalidTOTPCode(user.VerifyTOTP(code(0))),
+			"the confirmation code was accepted again",
+		)
+		now = now.Add(totpPeriod * time.Second)
+		test.Handle(user.VerifyTOTP(code(0)))
+		test.Attest(
+			IsInvalidTOTPCode(user.VerifyTOTP(code(0))),
+			"a code was accepted twice",
+		)
+	})
+	t.Run("drift", func(t *testing.T) {
+		test := attest.New(t)
+		now = now.Add(10 * totpPeriod * time.Second)
+		test.Handle(user.VerifyTOTP(code(totpPeriod * time.Second)))
+		test.Attest(
+			IsInvalidTOTPCode(user.VerifyTOTP(code(-totpPeriod*time.Second))),
+			"a code older than the last one accepted was accepted",
+		)
+		test.Attest(
+			IsInvalidTOTPCode(user.VerifyTOTP(code(5*totpPeriod*time.Second))),
+			"a code from too far ahead was accepted",
+		)
+	})
+	t.Run("bound to the user", func(t *testing.T) {
+		test := attest.New(t)
+		other := Username("other test TOTP user")
+		test.Handle(CreateNewUser(string(other), password))
+		sealed := lookupUser(user).TOTP.Sealed
+		_, err := openTOTPSecret(other, sealed)
+		test.NotNil(err, "a secret was decrypted for another user")
+	})
+	t.Run("two-step sign in", func(t *testing.T) {
+		test := attest.New(t)
+		now = now.Add(10 * totpPeriod * time.Second)
+		req := httptest.NewRequest("POST", "/", nil)
+		_, _, err := NewSessionForClient(user, req)
+		test.Attest(IsSecondFactorRequired(err), "signed in without a code")
+		pending, _, err := NewPendingSession(user, req)
+		test.Handle(err)
+		_, exists := pending.Touch()
+		test.Attest(!exists, "a pending session authenticated a request")
+		for _, info := range user.Sessions() {
+			test.NotEqual(pending.PublicID(), info.ID)
+		}
+		_, err = pending.CompleteSecondFactor("000000")
+		test.Attest(IsInvalidTOTPCode(err) || code(0) == "000000", "a wrong code was accepted")
+		signedIn, err := pending.CompleteSecondFactor(code(0))
+		test.Handle(err)
+		test.Equals(user, signedIn)
+		test.Attest(!pending.CurrentlyExists(), "the pending session outlived the sign in")
+		token, metadata, err := NewSessionForClient(user, req, AuthPassword, AuthOTP)
+		test.Handle(err)
+		defer token.Delete()
+		test.Equals(2, len(metadata.AuthMethods))
+
+		pending, _, err = NewPendingSession(user, req)
+		test.Handle(err)
+		for i := 0; i < maxSecondFactorAttempts; i++ {
+			pending.CompleteSecondFactor("not a code")
+		}
+		test.Attest(!pending.CurrentlyExists(), "wrong codes didn't cancel the sign in")
+		// starting over doesn't get the user any more attempts
+		now = now.Add(totpPeriod * time.Second)
+		pending, _, err = NewPendingSession(user, req)
+		test.Handle(err)
+		_, err = pending.CompleteSecondFactor(code(0))
+		test.NotNil(err, "a code was accepted after too many wrong ones")
+		test.Attest(!pending.CurrentlyExists(), "a locked out sign in was kept")
+
+		sessionsLock.Lock()
+		delete(secondFactorFailures, user)
+		sessionsLock.Unlock()
+		pending, _, err = NewPendingSession(user, req)
+		test.Handle(err)
+		var (
+			wg      sync.WaitGroup
+			lock    sync.Mutex
+			checked int
+		)
+		for i := 0; i < 4*maxSecondFactorAttempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := pending.CompleteSecondFactor("not a code")
+				if IsInvalidTOTPCode(err) {
+					lock.Lock()
+					checked++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		test.Attest(
+			checked <= maxSecondFactorAttempts,
+			"%d codes were checked in parallel",
+			checked,
+		)
+		sessionsLock.Lock()
+		delete(secondFactorFailures, user)
+		sessionsLock.Unlock()
+	})
+	t.Run("outside a sign in", func(t *testing.T) {
+		test := attest.New(t)
+		now = now.Add(10 * totpPeriod * time.Second)
+		test.Handle(user.CheckSecondFactor(code(0)))
+		for i := 0; i < maxSecondFactorAttempts; i++ {
+			test.Attest(
+				IsInvalidTOTPCode(user.CheckSecondFactor("not a code")),
+				"a wrong code was accepted",
+			)
+		}
+		now = now.Add(totpPeriod * time.Second)
+		test.NotNil(
+			user.CheckSecondFactor(code(0)),
+			"a code was accepted after too many wrong ones",
+		)
+		pending, _, err := NewPendingSession(user, httptest.NewRequest("POST", "/", nil))
+		test.Handle(err)
+		_, err = pending.CompleteSecondFactor(code(0))
+		test.NotNil(err, "signing in got around the limit")
+		sessionsLock.Lock()
+		delete(secondFactorFailures, user)
+		sessionsLock.Unlock()
+	})
+	t.Run("reset", func(t *testing.T) {
+		test := attest.New(t)
+		test.Handle(user.ResetTOTP())
+		test.Attest(!user.HasTOTP(), "the enrollment outlived the reset")
+		token, _, err := NewSessionForClient(user, httptest.NewRequest("POST", "/", nil))
+		test.Handle(err)
+		token.Delete()
+	})
+}
+
+func TestTOTPWithUserFileKey(t *testing.T) {
+	const password = "test TOTP user's password"
+	var (
+		test = attest.New(t)
+		user = Username("test TOTP user file key user")
+		now  = time.Unix(1700000000, 0)
+	)
+	AllUsers = make(UserCollection)
+	test.Handle(CreateNewUser(string(user), password))
+	totpNow = func() time.Time { return now }
+	defer func() { totpNow = time.Now }()
+	EncryptUserFileWith(StaticKey("test user file key"))
+	defer func() {
+		EncryptUserFileWith(nil)
+		SyncAllUsers()
+	}()
+	test.Handle(SyncAllUsers())
+	enrollment, err := user.EnrollTOTP("test")
+	test.Handle(err)
+	secret := test.EatError(totpEncoding.DecodeString(enrollment.Secret)).([]byte)
+	code := func() string {
+		return totpCode(secret, uint64(now.Unix())/totpPeriod)
+	}
+	test.Handle(user.ConfirmTOTP(code()))
+	test.Handle(RotateUserFileKey(StaticKey("test rotated user file key")))
+	now = now.Add(totpPeriod * time.Second)
+	test.Handle(user.VerifyTOTP(code()))
+	read := test.EatError(ReadFrom(ConfigLocation)).(UserCollection)
+	_, err = openTOTPSecret(user, read[user].TOTP.Sealed)
+	test.Handle(err)
+}
@@ -2,10 +2,15 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/dscottboggs/go-middleware-session-auth"
+	"github.com/dscottboggs/go-middleware-session-auth/gorilla_middleware"
 )
 
 const (
@@ -24,20 +29,112 @@ func main() {
 		uname         string
 		pw            string
 		newpw         string
+		keyfile       string
+		grace         time.Duration
+		keyName       string
+		keyScopes     string
+		keyID         string
+		keyExpiry     time.Duration
+		issuer        string
+		code          string
 	)
 	flag.StringVar(
 		&actionString,
 		"do",
 		"check",
-		"action to be taken: new,create,check,verify,delete,update,change,up,c,v,u,d",
+		"action to be taken: new,create,check,verify,delete,update,change,up,"+
+			"c,v,u,d,rotate-keys,apikey,totp,users,encrypt. apikey takes a "+
+			"further argument after the flags: create, list or revoke; totp "+
+			"takes enroll, confirm, recovery-codes or reset. users lists the "+
+			"users and their two-factor status; encrypt encrypts an "+
+			"unencrypted token file with the key from the environment. Both "+
+			"only need -tf",
 	)
 	flag.StringVar(&tokenLocation, "tf", "", "the token file to use")
 	flag.StringVar(&uname, "usr", "", "the username to work with")
 	flag.StringVar(&pw, "pw", "", "the password to work with")
 	flag.StringVar(&newpw, "new-pw", "", "the new password to use when changing.")
+	flag.StringVar(
+		&keyfile,
+		"kf",
+		gorilla_middleware.DefaultKeyringLocation(),
+		"the cookie keyring to rotate",
+	)
+	flag.DurationVar(
+		&grace,
+		"grace",
+		auth.DefaultExpiry(),
+		"how long cookies signed with the old keys are still accepted after "+
+			"rotating",
+	)
+	flag.StringVar(&keyName, "name", "", "what a new API key is for")
+	flag.StringVar(
+		&keyScopes,
+		"scopes",
+		"",
+		"comma-separated scopes to issue a new API key with",
+	)
+	flag.DurationVar(
+		&keyExpiry,
+		"expires",
+		0,
+		"how long a new API key lasts; 0 means it doesn't expire",
+	)
+	flag.StringVar(&keyID, "id", "", "the ID of the API key to revoke")
+	flag.StringVar(
+		&issuer,
+		"issuer",
+		"go-middleware-session-auth",
+		"the name authenticator apps show for a TOTP enrollment",
+	)
+	flag.StringVar(
+		&code,
+		"code",
+		"",
+		"the code from the authenticator app, to confirm a TOTP enrollment",
+	)
 
 	flag.Parse()
 
+	if actionString == "rotate-keys" {
+		keyring, err := gorilla_middleware.RotateKeyfile(keyfile, grace)
+		if err != nil {
+			log.Fatalf("couldn't rotate the keys in %s: %v\n", keyfile, err)
+		}
+		log.Printf(
+			"rotated the keys in %s; %d key pairs are still accepted\n",
+			keyfile,
+			len(keyring.Pairs),
+		)
+		os.Exit(statusOK)
+	}
+
+	if actionString == "users" {
+		if tokenLocation == "" {
+			flag.Usage()
+			os.Exit(statusIncorrectUsage)
+		}
+		readUsers(tokenLocation)
+		listUsers()
+		os.Exit(statusOK)
+	}
+
+	if actionString == "encrypt" {
+		if tokenLocation == "" {
+			flag.Usage()
+			os.Exit(statusIncorrectUsage)
+		}
+		if err := auth.ConfigureFromEnv(); err != nil {
+			log.Fatalf("invalid configuration: %v\n", err)
+		}
+		auth.ConfigLocation = tokenLocation
+		if err := auth.EncryptExistingUserFile(); err != nil {
+			log.Fatalf("couldn't encrypt %s: %v\n", tokenLocation, err)
+		}
+		log.Printf("encrypted %s\n", tokenLocation)
+		os.Exit(statusOK)
+	}
+
 	var foundEmptyString bool
 	switch {
 	case tokenLocation == "":
@@ -56,7 +153,7 @@ func main() {
 		flag.Usage()
 		os.Exit(statusIncorrectUsage)
 	}
-	auth.ConfigLocation = tokenLocation
+	readUsers(tokenLocation)
 	switch actionString {
 	case "new", "create", "c", "add":
 		if err := auth.CreateNewUser(uname, pw); err != nil {
@@ -87,8 +184,177 @@ func main() {
 			log.Fatalf("couldn't change password for %s; %v\n", uname, err)
 		}
 		os.Exit(0)
+	case "apikey":
+		user := auth.Username(uname)
+		if !user.IsAuthenticatedBy(pw) {
+			log.Fatalf("couldn't authenticate %s\n", uname)
+		}
+		apiKey(user, flag.Arg(0), keyName, keyScopes, keyID, keyExpiry)
+		os.Exit(statusOK)
+	case "totp":
+		user := auth.Username(uname)
+		if !user.IsAuthenticatedBy(pw) {
+			log.Fatalf("couldn't authenticate %s\n", uname)
+		}
+		totp(user, flag.Arg(0), issuer, code)
+		os.Exit(statusOK)
 	default:
 		log.Fatalf("invalid action %s\n", actionString)
 	}
 
 }
+
+// apiKey performs one of the "-do apikey" sub-actions.
+func apiKey(
+	user auth.Username,
+	action, name, scopes, id string,
+	expiry time.Duration,
+) {
+	switch action {
+	case "create":
+		var (
+			expires   time.Time
+			scopeList []string
+		)
+		if expiry > 0 {
+			expires = time.Now().Add(expiry)
+		}
+		if scopes != "" {
+			scopeList = strings.Split(scopes, ",")
+		}
+		key, info, err := user.CreateAPIKey(name, scopeList, expires)
+		if err != nil {
+			log.Fatalf("couldn't create an API key for %s: %v\n", user, err)
+		}
+		log.Printf(
+			"created API key %s for %s; it won't be shown again:\n",
+			info.ID,
+			user,
+		)
+		fmt.Println(key)
+	case "list":
+		for _, key := range user.APIKeys() {
+			expires, lastUsed := "never", "never"
+			if !key.Expires.IsZero() {
+				expires = key.Expires.Format(time.RFC3339)
+			}
+			if !key.LastUsed.IsZero() {
+				lastUsed = key.LastUsed.Format(time.RFC3339)
+			}
+			fmt.Printf(
+				"%s\t%s\tscopes: %s\texpires: %s\tlast used: %s\n",
+				key.ID,
+				key.Name,
+				strings.Join(key.Scopes, ","),
+				expires,
+				lastUsed,
+			)
+		}
+	case "revoke":
+		if id == "" {
+			log.Println("no API key ID specified.")
+			flag.PrintDefaults()
+			os.Exit(statusIncorrectUsage)
+		}
+		if err := user.RevokeAPIKey(id); err != nil {
+			log.Fatalf("couldn't revoke API key %s: %v\n", id, err)
+		}
+	default:
+		log.Printf("invalid apikey action %q; use create, list or revoke\n", action)
+		flag.Usage()
+		os.Exit(statusIncorrectUsage)
+	}
+}
+
+// totp performs one of the "-do totp" sub-actions.
+func totp(user auth.Username, action, issuer, code string) {
+	switch action {
+	case "enroll":
+		enrollment, err := user.EnrollTOTP(issuer)
+		if err != nil {
+			log.Fatalf("couldn't enroll %s in two-factor authentication: %v\n", user, err)
+		}
+		log.Printf(
+			"add this to %s's authenticator app, as a QR code or by entering "+
+				"the secret, then confirm it with -do totp -code ... confirm:\n",
+			user,
+		)
+		fmt.Printf("%s\n%s\n", enrollment.URI, enrollment.Secret)
+		printRecoveryCodes(user, enrollment.RecoveryCodes)
+	case "confirm":
+		if code == "" {
+			log.Println("no code specified.")
+			flag.PrintDefaults()
+			os.Exit(statusIncorrectUsage)
+		}
+		if err := user.ConfirmTOTP(code); err != nil {
+			log.Fatalf("couldn't confirm two-factor authentication for %s: %v\n", user, err)
+		}
+		log.Printf("%s now has to enter a code to sign in\n", user)
+	case "recovery-codes":
+		codes, err := user.RegenerateRecoveryCodes()
+		if err != nil {
+			log.Fatalf("couldn't generate recovery codes for %s: %v\n", user, err)
+		}
+		printRecoveryCodes(user, codes)
+	case "reset":
+		if err := user.ResetTOTP(); err != nil {
+			log.Fatalf("couldn't reset two-factor authentication for %s: %v\n", user, err)
+		}
+	default:
+		log.Printf(
+			"invalid totp action %q; use enroll, confirm, recovery-codes or "+
+				"reset\n",
+			action,
+		)
+		flag.Usage()
+		os.Exit(statusIncorrectUsage)
+	}
+}
+
+func printRecoveryCodes(user auth.Username, codes []string) {
+	log.Printf(
+		"%s's recovery codes, which replace any previous ones; each can be "+
+			"used once instead of a code, and they won't be shown again:\n",
+		user,
+	)
+	for _, code := range codes {
+		fmt.Println(code)
+	}
+}
+
+// readUsers configures the package from the environment, then reads the
+// users from the token file, if it exists.
+func readUsers(tokenLocation string) {
+	if err := auth.ConfigureFromEnv(); err != nil {
+		log.Fatalf("invalid configuration: %v\n", err)
+	}
+	auth.ConfigLocation = tokenLocation
+	if users, err := auth.ReadFrom(tokenLocation); err == nil {
+		auth.AllUsers = users
+	} else if !os.IsNotExist(err) {
+		log.Fatalf("couldn't read the token file %s: %v\n", tokenLocation, err)
+	}
+}
+
+// listUsers prints each user's two-factor status, and how many recovery codes
+// they have left.
+func listUsers() {
+	names := make([]string, 0, len(auth.AllUsers))
+	for name := range auth.AllUsers {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		user := auth.Username(name)
+		if user.HasTOTP() {
+			fmt.Printf(
+				"%s\ttwo-factor\t%d recovery codes left\n",
+				user,
+				user.RecoveryCodesLeft(),
+			)
+		} else {
+			fmt.Printf("%s\tpassword only\n", user)
+		}
+	}
+}
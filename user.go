@@ -2,11 +2,10 @@ package auth
 
 import (
 	"crypto/rand"
-	"crypto/sha512"
+	"crypto/subtle"
 	"fmt"
+	"log"
 	"math/big"
-
-	"golang.org/x/crypto/pbkdf2"
 )
 
 /*
@@ -24,19 +23,38 @@ func (s *salt) Randomize() (err error) {
 type Token struct {
 	HashValue [KeyLength]byte
 	Salt      salt
+	// PepperVersion is the version of the pepper the hash was created with,
+	// or 0 if it wasn't peppered. See AddPepper.
+	PepperVersion uint8
+	// APIKeys issued to the user. See CreateAPIKey.
+	APIKeys []APIKey
+	// TOTP is the user's enrollment in two-factor authentication, if any.
+	// See EnrollTOTP.
+	TOTP TOTPSecret
+	// RecoveryCodes stand in for TOTP codes. See RegenerateRecoveryCodes.
+	RecoveryCodes RecoveryCodes
+}
+
+// replaceSecret swaps the user's password hash for the given token's, keeping
+// everything else.
+func (u *Username) replaceSecret(token Token) error {
+	return updateUser(*u, func(current *Token) error {
+		current.HashValue = token.HashValue
+		current.Salt = token.Salt
+		current.PepperVersion = token.PepperVersion
+		return nil
+	})
 }
 
 // NewAuthToken from the given secret. Handles creating the random salt and
-// hashing the value.
+// hashing the value with the current pepper.
 func NewAuthToken(secret []byte) (t Token, err error) {
 	err = t.Salt.Randomize()
 	if err != nil {
 		return
 	}
-	hashval := pbkdf2.Key(
-		secret, t.Salt[:], Iterations, KeyLength, sha512.New,
-	)
-	copy(t.HashValue[:], hashval)
+	t.PepperVersion = currentPepperVersion()
+	t.HashValue, err = hashSecret(secret, t.Salt, t.PepperVersion)
 	return
 }
 
@@ -44,18 +62,22 @@ func NewAuthToken(secret []byte) (t Token, err error) {
 type Username string
 
 // ChangePassword for a given user from the old password to the new one, if the
-// old one is correct.
+// old one is correct. The user is signed out of every session except those
+// to keep, e.g. the one the password was changed from.
 // returns non-nil error on failure to authenticate user, failure to create a
 // salt, or the result of SyncAllUsers, which may be a non-nil error.
-func (u *Username) ChangePassword(from, to string) error {
+func (u *Username) ChangePassword(from, to string, keep ...Session) error {
 	if !u.IsAuthenticatedBy(from) {
-		return fmt.Errorf("Password %s doesn't authenticate %v\n", from, u)
+		return WrongPassword(u)
 	}
 	token, err := NewAuthToken([]byte(to))
 	if err != nil {
 		return err
 	}
-	AllUsers[*u] = &token
+	if err = u.replaceSecret(token); err != nil {
+		return err
+	}
+	u.RevokeSessions(keep...)
 	return SyncAllUsers()
 }
 
@@ -63,11 +85,12 @@ func (u *Username) ChangePassword(from, to string) error {
 // Returns a typed error on failure, which would satisfy IsNoSuchUser() or
 // IsWrongPassword()
 func (u *Username) Delete(password string) error {
-	if AllUsers[*u] == nil {
+	if lookupUser(*u) == nil {
 		return NoSuchUser(u)
 	}
 	if u.IsAuthenticatedBy(password) {
-		AllUsers[*u] = nil
+		storeUser(*u, nil)
+		u.RevokeSessions()
 	} else {
 		return WrongPassword(u)
 	}
@@ -75,19 +98,23 @@ func (u *Username) Delete(password string) error {
 }
 
 // IsAuthenticatedBy --
-// Checks if a user IsAuthenticatedBy a password or not.
+// Checks if a user IsAuthenticatedBy a password or not. Tokens hashed with an
+// old pepper are re-hashed with the current one on success.
 func (u *Username) IsAuthenticatedBy(password string) bool {
-	user := AllUsers[*u]
+	user := lookupUser(*u)
 	if user == nil {
 		return false
 	}
-	return string(pbkdf2.Key(
-		[]byte(password),
-		user.Salt[:],
-		Iterations,
-		KeyLength,
-		sha512.New,
-	)) == string(user.HashValue[:])
+	hash, err := hashSecret([]byte(password), user.Salt, user.PepperVersion)
+	if err != nil {
+		log.Printf("error checking password for %s: %v", *u, err)
+		return false
+	}
+	if subtle.ConstantTimeCompare(hash[:], user.HashValue[:]) != 1 {
+		return false
+	}
+	u.repepper(password, user)
+	return true
 }
 
 // RandomSalt creates a cryptographically random AuthToken.Salt value.
@@ -1,10 +1,13 @@
 package auth
 
 import (
+	"bytes"
 	"encoding/gob"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path"
 )
 
 // UserCollection -- A collection of users and their associated tokens
@@ -17,21 +20,60 @@ func (c *UserCollection) Write(to io.WriteCloser) error {
 }
 
 // WriteWithoutClose -- Write the collection to the given destination which may
-// or may not implement Close().
+// or may not implement Close(). The collection is encrypted if a key has been
+// set with EncryptUserFileWith.
 func (c *UserCollection) WriteWithoutClose(destination io.Writer) error {
-	encoder := gob.NewEncoder(destination)
-	return encoder.Encode(c)
+	if usersKey == nil {
+		encoder := gob.NewEncoder(destination)
+		return encoder.Encode(c)
+	}
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(c); err != nil {
+		return err
+	}
+	sealed, err := encryptUsers(plaintext.Bytes(), usersKey)
+	if err != nil {
+		return err
+	}
+	_, err = destination.Write(sealed)
+	return err
 }
 
 // AllUsers -- The map of all Usernames to their AuthTokens
 var AllUsers UserCollection
 
+// lookupUser gets the token for the given user, if any.
+func lookupUser(name Username) *Token {
+	usersLock.RLock()
+	defer usersLock.RUnlock()
+	return AllUsers[name]
+}
+
+// storeUser sets the token for the given user; a nil token removes the user.
+func storeUser(name Username, token *Token) {
+	usersLock.Lock()
+	defer usersLock.Unlock()
+	if token == nil {
+		delete(AllUsers, name)
+		return
+	}
+	AllUsers[name] = token
+}
+
 // Read a gob-encoded reader into a UserCollection, or return an error on
-// failure.
+// failure. Encrypted collections are decrypted with the key set by
+// EncryptUserFileWith.
 func Read(config io.Reader) (UserCollection, error) {
 	users := make(UserCollection, 0)
-	decoder := gob.NewDecoder(config)
-	err := decoder.Decode(&users)
+	data, err := ioutil.ReadAll(config)
+	if err != nil {
+		return users, err
+	}
+	if data, err = decryptUsers(data, usersKey); err != nil {
+		return users, err
+	}
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err = decoder.Decode(&users)
 	return users, err
 }
 
@@ -41,33 +83,56 @@ func ReadFrom(config string) (UserCollection, error) {
 	if err != nil {
 		return UserCollection{}, err
 	}
+	defer configFile.Close()
 	return Read(configFile)
 }
 
 // CreateNewUser with the given information
 func CreateNewUser(name, password string) error {
-	if AllUsers[Username(name)] != nil {
+	if lookupUser(Username(name)) != nil {
 		return UserExists(name)
 	}
 	token, err := NewAuthToken([]byte(password))
 	if err != nil {
 		return err
 	}
-	AllUsers[Username(name)] = &token
+	storeUser(Username(name), &token)
 	return SyncAllUsers()
 }
 
-// SyncAllUsers to the file.
-func SyncAllUsers() error {
-	// create the file
-	configFile, err := os.Create(ConfigLocation)
-	// return any error gotten from the file creation, unless it's just that
-	// the file exists already; we're overwriting it anyway.
-	if err != nil && !(os.IsExist(err) || os.IsNotExist(err)) {
+// writeUserFile writes the collection to a temporary file next to
+// ConfigLocation, flushes it to disk, and renames it over ConfigLocation.
+func writeUserFile(users UserCollection) error {
+	dir, name := path.Split(ConfigLocation)
+	if dir == "" {
+		dir = "."
+	}
+	temp, err := ioutil.TempFile(dir, "."+name+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if err = users.WriteWithoutClose(temp); err == nil {
+		err = temp.Sync()
+	}
+	if err != nil {
+		temp.Close()
 		return err
 	}
+	if err = temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), ConfigLocation)
+}
+
+// SyncAllUsers to the file. The file is replaced atomically, readable only by
+// its owner, so a crash or a failed write leaves the previous file in place
+// and the watcher never reads half a file.
+func SyncAllUsers() error {
 	// write the config
-	err = AllUsers.Write(configFile)
+	usersLock.RLock()
+	err := writeUserFile(AllUsers)
+	usersLock.RUnlock()
 	// return if any errors encounterd
 	if err != nil {
 		return fmt.Errorf(
@@ -82,7 +147,11 @@ func SyncAllUsers() error {
 		return err
 	}
 	for k, v := range read {
-		mv := AllUsers[k]
+		mv := lookupUser(k)
+		if mv == nil {
+			// the user was removed while the file was being written
+			return fmt.Errorf("User %s was written but is no longer loaded", k)
+		}
 		// check token
 		for index, byteval := range v.HashValue {
 			if mv.HashValue[index] != byteval {
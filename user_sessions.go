@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SessionInfo describes one of a user's sessions, for showing them where
+// they're signed in. It doesn't contain the session itself, so it's safe to
+// hand to the user.
+type SessionInfo struct {
+	// ID identifies the session to RevokeSession. See Session.PublicID.
+	ID         string    `json:"id"`
+	Created    time.Time `json:"created"`
+	LastSeen   time.Time `json:"last_seen"`
+	Expires    time.Time `json:"expires"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	// Current is set by handlers for the session the request was made with.
+	Current bool `json:"current,omitempty"`
+}
+
+// PublicID gets an identifier for the session which can be shown to its user
+// without letting anyone who sees it use the session.
+func (s Session) PublicID() string {
+	hash := sha256.Sum256(s[:])
+	return hex.EncodeToString(hash[:8])
+}
+
+// Sessions lists the user's active sessions, most recently used first.
+// Sessions which have been replaced by Rotate, or which are still waiting for
+// a two-factor code, aren't included.
+func (u *Username) Sessions() []SessionInfo {
+	var (
+		sessions []SessionInfo
+		now      = time.Now()
+	)
+	sessionsLock.RLock()
+	for token := range userSessions[*u] {
+		metadata := AllSessions[token]
+		if metadata == nil || metadata.Rotated || metadata.PendingSecondFactor || metadata.expiredAt(now) {
+			continue
+		}
+		sessions = append(sessions, SessionInfo{
+			ID:         token.PublicID(),
+			Created:    metadata.Created,
+			LastSeen:   metadata.LastSeen,
+			Expires:    metadata.Expiry,
+			UserAgent:  metadata.UserAgent,
+			RemoteAddr: metadata.RemoteAddr,
+		})
+	}
+	sessionsLock.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+	return sessions
+}
+
+// RevokeSession signs the user out of the session with the given PublicID.
+func (u *Username) RevokeSession(id string) error {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for token := range userSessions[*u] {
+		if token.PublicID() == id {
+			token.delete()
+			return nil
+		}
+	}
+	return fmt.Errorf("no session %s found for %s", id, *u)
+}
+
+// RevokeSessions signs the user out everywhere except the given sessions, and
+// revokes their refresh tokens. It returns how many sessions were deleted.
+// Signed tokens can't be revoked this way; they last until they expire.
+func (u *Username) RevokeSessions(except ...Session) (revoked int) {
+	keep := make(map[Session]bool, len(except))
+	for _, s := range except {
+		keep[s] = true
+	}
+	// refreshLock is taken before sessionsLock, as in NewAccessSessionFor
+	revokeRefreshTokensFor(*u, keep)
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for token := range userSessions[*u] {
+		if !keep[token] {
+			token.delete()
+			revoked++
+		}
+	}
+	return
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestUserSessions(t *testing.T) {
+	var (
+		test = attest.New(t)
+		user = Username("test user sessions user")
+		req  = httptest.NewRequest("GET", "/", nil)
+	)
+	req.Header.Set("User-Agent", "test user agent")
+	first, _, err := NewSessionForClient(user, req)
+	test.Handle(err)
+	second, _ := NewSessionFor(user)
+	third, _ := NewSessionFor(user)
+	sessions := user.Sessions()
+	test.Equals(3, len(sessions))
+	ids := make(map[string]SessionInfo)
+	for _, s := range sessions {
+		ids[s.ID] = s
+	}
+	test.Equals("test user agent", ids[first.PublicID()].UserAgent)
+	test.Equals(req.RemoteAddr, ids[first.PublicID()].RemoteAddr)
+	test.NotEqual(first.ID(), first.PublicID())
+
+	test.Handle(user.RevokeSession(second.PublicID()))
+	test.Attest(!second.CurrentlyExists(), "a revoked session still exists")
+	test.NotNil(user.RevokeSession(second.PublicID()), "revoked a session twice")
+	other := Username("test user sessions other user")
+	test.NotNil(other.RevokeSession(first.PublicID()), "revoked another user's session")
+
+	rotated, _, err := third.Rotate()
+	test.Handle(err)
+	test.Equals(2, len(user.Sessions()))
+	test.Equals(2, user.RevokeSessions(first))
+	test.Attest(first.CurrentlyExists(), "the session to keep was revoked")
+	test.Attest(!rotated.CurrentlyExists(), "a rotated session survived")
+	test.Equals(1, len(user.Sessions()))
+	first.Delete()
+	test.Equals(0, len(user.Sessions()))
+	test.Attest(userSessions[user] == nil, "the user's index entry was kept")
+}
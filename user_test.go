@@ -38,7 +38,12 @@ func TestChangePassword(t *testing.T) {
 	if username.IsAuthenticatedBy(testchpw) {
 		t.Error("user was authenticated by new password before changing.")
 	}
-	test.Handle(username.ChangePassword(testpass, testchpw))
+	current, _ := NewSessionFor(username)
+	other, _ := NewSessionFor(username)
+	test.Handle(username.ChangePassword(testpass, testchpw, current))
+	test.Attest(current.CurrentlyExists(), "the session to keep was revoked")
+	test.Attest(!other.CurrentlyExists(), "another session survived a password change")
+	current.Delete()
 	if !username.IsAuthenticatedBy(testchpw) {
 		t.Error("authentication failed after changing password")
 	}
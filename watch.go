@@ -0,0 +1,207 @@
+package auth
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+var (
+	// usersLock guards swapping AllUsers out from under running handlers
+	usersLock sync.RWMutex
+	// how frequently to stat the user file when inotify isn't available
+	reloadPollInterval = 2 * time.Second
+	// how long to wait after a change before re-reading the file, so that a
+	// file which is still being written isn't read half-way through.
+	reloadSettleDelay = 100 * time.Millisecond
+	reloadHooks       []func(ReloadEvent)
+	reloadHooksLock   sync.Mutex
+	watchQuitter      chan bool
+	watchLock         sync.Mutex
+)
+
+// ReloadEvent is passed to each hook registered with OnReload after the user
+// file has been re-read.
+type ReloadEvent struct {
+	// Location is the file which was read
+	Location string
+	// Users is the collection which replaced AllUsers, or nil on failure
+	Users UserCollection
+	// Err is non-nil if the file couldn't be read or failed validation, in
+	// which case the previous collection is still in use.
+	Err error
+}
+
+// OnReload registers a function to be called every time the user file is
+// re-read, successfully or not.
+func OnReload(hook func(ReloadEvent)) {
+	reloadHooksLock.Lock()
+	defer reloadHooksLock.Unlock()
+	reloadHooks = append(reloadHooks, hook)
+}
+
+// SetReloadPollInterval sets how frequently the user file is checked for
+// changes when inotify isn't available.
+func SetReloadPollInterval(interval time.Duration) {
+	reloadPollInterval = interval
+}
+
+// ReloadUsers re-reads the user file at ConfigLocation, validates it, and
+// swaps it in for AllUsers. On failure AllUsers is left as it was.
+func ReloadUsers() error {
+	users, err := ReadFrom(ConfigLocation)
+	if err == nil {
+		err = users.Validate()
+	}
+	if err != nil {
+		err = fmt.Errorf(
+			"not reloading users from %s, keeping existing users: %v",
+			ConfigLocation,
+			err,
+		)
+		emitReload(ReloadEvent{Location: ConfigLocation, Err: err})
+		return err
+	}
+	usersLock.Lock()
+	AllUsers = users
+	usersLock.Unlock()
+	emitReload(ReloadEvent{Location: ConfigLocation, Users: users})
+	return nil
+}
+
+func emitReload(event ReloadEvent) {
+	reloadHooksLock.Lock()
+	hooks := make([]func(ReloadEvent), len(reloadHooks))
+	copy(hooks, reloadHooks)
+	reloadHooksLock.Unlock()
+	for _, hook := range hooks {
+		hook(event)
+	}
+}
+
+// Validate checks that every entry in the collection has a usable token.
+func (c UserCollection) Validate() error {
+	var zero [KeyLength]byte
+	for name, token := range c {
+		if name == "" {
+			return fmt.Errorf("found a user with an empty name")
+		}
+		if token == nil {
+			return fmt.Errorf("user %s has no token", name)
+		}
+		if bytes.Equal(token.HashValue[:], zero[:]) {
+			return fmt.Errorf("user %s has an empty password hash", name)
+		}
+	}
+	return nil
+}
+
+// WatchUserFile starts watching ConfigLocation and calls ReloadUsers whenever
+// it changes on disk, so that users added by another process (e.g. the update
+// command) are picked up without a restart. inotify is used where available,
+// otherwise the file is polled every reloadPollInterval.
+func WatchUserFile() error {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	if watchQuitter != nil {
+		return fmt.Errorf("already watching %s", ConfigLocation)
+	}
+	quit := make(chan bool)
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		// watch the directory rather than the file so that replacing the file
+		// (e.g. by renaming a new one over it) is noticed too.
+		err = watcher.Add(path.Dir(ConfigLocation))
+		if err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		log.Printf(
+			"WARNING couldn't set up inotify for %s, falling back to polling "+
+				"every %v: %v",
+			ConfigLocation,
+			reloadPollInterval,
+			err,
+		)
+		go pollUserFile(ConfigLocation, quit)
+	} else {
+		go notifyUserFile(watcher, ConfigLocation, quit)
+	}
+	watchQuitter = quit
+	return nil
+}
+
+// StopWatchingUserFile stops the watcher started by WatchUserFile, if any.
+func StopWatchingUserFile() {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	if watchQuitter != nil {
+		close(watchQuitter)
+		watchQuitter = nil
+	}
+}
+
+func notifyUserFile(watcher *fsnotify.Watcher, location string, quit chan bool) {
+	defer watcher.Close()
+	var (
+		settled = time.NewTimer(reloadSettleDelay)
+		changes = fsnotify.Write | fsnotify.Create | fsnotify.Rename
+	)
+	settled.Stop()
+	for /*ever*/ {
+		select {
+		case <-quit:
+			settled.Stop()
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if path.Clean(event.Name) == path.Clean(location) &&
+				event.Op&changes != 0 {
+				settled.Reset(reloadSettleDelay)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("error watching %s: %v", location, err)
+		case <-settled.C:
+			ReloadUsers()
+		}
+	}
+}
+
+func pollUserFile(location string, quit chan bool) {
+	var lastMod time.Time
+	var lastSize int64
+	if info, err := os.Stat(location); err == nil {
+		lastMod, lastSize = info.ModTime(), info.Size()
+	}
+	ticker := time.NewTicker(reloadPollInterval)
+	defer ticker.Stop()
+	for /*ever*/ {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(location)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+				continue
+			}
+			lastMod, lastSize = info.ModTime(), info.Size()
+			time.Sleep(reloadSettleDelay)
+			ReloadUsers()
+		}
+	}
+}
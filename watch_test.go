@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dscottboggs/attest"
+)
+
+func TestReloadUsers(t *testing.T) {
+	test := attest.New(t)
+	AllUsers = make(UserCollection)
+	test.Handle(CreateNewUser("test reload user", "test reload password"))
+	var events []ReloadEvent
+	OnReload(func(event ReloadEvent) { events = append(events, event) })
+	t.Run("user added by another process", func(t *testing.T) {
+		test := attest.New(t)
+		token, err := NewAuthToken([]byte("other process password"))
+		test.Handle(err)
+		onDisk := UserCollection{
+			"test reload user":         lookupUser("test reload user"),
+			"other process's new user": &token,
+		}
+		file, err := os.Create(ConfigLocation)
+		test.Handle(err)
+		test.Handle(onDisk.Write(file))
+		test.Handle(ReloadUsers())
+		user := Username("other process's new user")
+		test.Attest(
+			user.IsAuthenticatedBy("other process password"),
+			"user written by another process wasn't loaded",
+		)
+		test.Handle(events[len(events)-1].Err)
+	})
+	t.Run("invalid file keeps old users", func(t *testing.T) {
+		test := attest.New(t)
+		test.Handle(
+			ioutil.WriteFile(ConfigLocation, []byte("not a gob"), 0600),
+		)
+		test.NotNil(ReloadUsers(), "got nil error reloading an invalid file")
+		user := Username("test reload user")
+		test.Attest(
+			user.IsAuthenticatedBy("test reload password"),
+			"existing user was dropped after a failed reload",
+		)
+		test.NotNil(events[len(events)-1].Err, "hook didn't receive the error")
+		test.Handle(SyncAllUsers())
+	})
+	t.Run("polling watcher", func(t *testing.T) {
+		test := attest.New(t)
+		SetReloadPollInterval(100 * time.Millisecond)
+		done := make(chan bool)
+		go pollUserFile(ConfigLocation, done)
+		defer close(done)
+		// make sure the modification time differs
+		time.Sleep(50 * time.Millisecond)
+		test.Handle(CreateNewUser("test polled user", "test polled password"))
+		usersLock.Lock()
+		AllUsers = make(UserCollection)
+		usersLock.Unlock()
+		time.Sleep(500 * time.Millisecond)
+		user := Username("test polled user")
+		test.Attest(
+			user.IsAuthenticatedBy("test polled password"),
+			"polling watcher didn't reload the user file",
+		)
+	})
+}